@@ -1,3 +1,3 @@
 #!/bin/bash
 
-GOOS=linux GOARCH=amd64 go build -o updater updater.go
+GOOS=linux GOARCH=amd64 go build -o updater .
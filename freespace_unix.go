@@ -0,0 +1,39 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// freeSpace returns the space available to unprivileged users and the free
+// inodes on the file system holding dir, or its closest existing parent. The
+// inode count is -1 for file systems that don't report one.
+func freeSpace(dir string) (int64, int64, error) {
+	current, err := filepath.Abs(dir)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for {
+		var stat syscall.Statfs_t
+		err := syscall.Statfs(current, &stat)
+
+		if err == nil && stat.Files == 0 {
+			return int64(stat.Bavail) * int64(stat.Bsize), -1, nil
+		}
+
+		if err == nil {
+			return int64(stat.Bavail) * int64(stat.Bsize), int64(stat.Ffree), nil
+		}
+
+		if !os.IsNotExist(err) || current == filepath.Dir(current) {
+			return 0, 0, err
+		}
+
+		current = filepath.Dir(current)
+	}
+}
@@ -0,0 +1,54 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// freeSpace returns the space available to the user on the volume holding
+// dir, or its closest existing parent. Windows has no inodes to count, so
+// their number is always -1.
+func freeSpace(dir string) (int64, int64, error) {
+	current, err := filepath.Abs(dir)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for {
+		var available uint64
+		err := diskFreeSpace(current, &available)
+
+		if err == nil {
+			return int64(available), -1, nil
+		}
+
+		if !os.IsNotExist(err) || current == filepath.Dir(current) {
+			return 0, 0, err
+		}
+
+		current = filepath.Dir(current)
+	}
+}
+
+// diskFreeSpace stores the bytes available to the caller on the volume of
+// dir, which has to exist.
+func diskFreeSpace(dir string, available *uint64) error {
+	name, err := syscall.UTF16PtrFromString(dir)
+
+	if err != nil {
+		return err
+	}
+
+	if ok, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(available)), 0, 0); ok == 0 {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,3 @@
+module github.com/pjotrsavitski/updater
+
+go 1.18
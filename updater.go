@@ -1,19 +1,51 @@
 package main
 
 import (
+	"archive/tar"
 	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/user"
 	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unicode/utf16"
 )
 
 const colorReset string = "\033[0m"
@@ -22,307 +54,8888 @@ const colorRed string = "\033[31m"
 const colorBlue string = "\033[34m"
 
 type updater struct {
-	repository string
-	token      string
-	directory  string
-}
-
-func (u updater) RepositoryURL() string {
-	return fmt.Sprintf("https://api.github.com/repos/%s/actions/artifacts", u.repository)
-}
+	repository       string
+	token            string
+	directory        string
+	hostTokens       map[string]string
+	artifactDirs     map[string]string
+	strict           bool
+	artifactName     string
+	artifactNames    []string
+	namePrefix       string
+	channel          string
+	channelSeparator string
+	nameRegexp       *regexp.Regexp
+	atomicGroup      bool
+	keepGoing        bool
+	noExtract        bool
+	output           string
+	apiURL           string
+	merge            bool
+	prune            bool
+	requireEmpty     bool
+	destOwnerCheck   bool
+	destOwner        string
+	retryCorrupt     bool
+	allowProtected   bool
+	force            bool
+	confirm          bool
+	assumeYes        bool
+	skipNewer        bool
+	resumeExtract    bool
+	normalizeEOL     bool
+	umask            os.FileMode
+	longPaths        bool
+	textGlobs        []string
+	bestEffort       bool
+	allowPaths       []string
+	extractWorkers   int
+	keep             []string
+	expectMinFiles   int
+	expectMaxFiles   int
+	ensureDirs       []string
+	permissionsFrom  string
+	fsync            bool
+	subpath          string
+	destTemplate     string
+	latestSymlink    string
+	cacheFile        string
+	cacheTTL         time.Duration
+	cacheDir         string
+	refresh          bool
 
-func (u updater) AddAuthorizationHeader(req *http.Request) {
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", u.token))
-}
+	symlinkTarget bool
+	keepReleases  int
 
-func (u updater) Artifacts() (artifacts, error) {
-	var data artifacts
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", u.RepositoryURL(), nil)
-	u.AddAuthorizationHeader(req)
+	chmodExec         []string
+	failOnExpired     bool
+	withLogs          bool
+	fromLatestRun     bool
+	runID             int
+	requireConclusion string
+	commit            string
+	runs              *runCache
+	repositories      *repoCache
+	tokenCmd          *tokenCommand
+	warnPublic        bool
+	workflow          string
 
-	if err != nil {
-		return data, err
-	}
+	maxDownloadSize byteSize
+	maxResponseSize byteSize
+	downloadChunks  int
+	minFreeSpace    byteSize
+	spaceReport     bool
+	maxBandwidth    bandwidth
+	retry           retryPolicy
+	limiter         *rateLimiter
 
-	resp, err := client.Do(req)
+	fallbackRepository string
 
-	if err != nil {
-		return data, err
-	}
+	signatureURL string
+	publicKey    crypto.PublicKey
 
-	defer resp.Body.Close()
+	maxAge  time.Duration
+	headers http.Header
 
-	if resp.StatusCode != 200 {
-		return data, fmt.Errorf("received non 200 response code of %d", resp.StatusCode)
-	}
+	since           time.Time
+	waitForArtifact bool
+	sinceLastDeploy bool
+	waitTimeout     time.Duration
+	selectPolicy    string
+	pollInterval    time.Duration
 
-	body, err := ioutil.ReadAll(resp.Body)
+	backup               bool
+	backupDir            string
+	reversible           bool
+	patchDir             string
+	keepBackups          int
+	keepArchive          bool
+	archiveDir           string
+	keepArchives         int
+	compressBackups      bool
+	diffSummary          bool
+	postHook             string
+	postHookOnlyOnChange bool
+	fileManifest         string
+	fileURL              string
+	validateCmd          string
+	scanCmd              string
+	quarantineDir        string
+	verbose              bool
+	healthURL            string
+	healthTimeout        time.Duration
+	healthInterval       time.Duration
+	rollbackOnHealthFail bool
 
-	if err != nil {
-		return data, err
-	}
+	concurrency    int
+	checkpointFile string
+	resume         bool
+	client         *http.Client
+	dumpResponse   string
+	dumpHeaders    bool
+	trace          bool
+	events         *eventWriter
+	// record collects the details of the deploy in progress for -report-file
+	record     *deployRecord
+	reportFile string
+	progress   *progressFile
+	// stdout is the real standard output, kept for -o - when messages are
+	// moved to standard error
+	stdout io.Writer
+	// stdin is where -confirm reads the answer from, interactive tells
+	// whether it is a terminal
+	stdin       io.Reader
+	interactive bool
 
-	unmarshalErr := json.Unmarshal(body, &data)
+	stats *runStats
+}
 
-	if unmarshalErr != nil {
-		return data, unmarshalErr
-	}
+// byteSize is a flag value accepting sizes like `512`, `10KB`, `500MB` or
+// `2GB`, using the same 1024 based units as artifact.Size().
+type byteSize int64
 
-	return data, nil
+var byteSizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"TB", 1024 * 1024 * 1024 * 1024},
+	{"GB", 1024 * 1024 * 1024},
+	{"MB", 1024 * 1024},
+	{"KB", 1024},
+	{"B", 1},
 }
 
-func (u updater) DownloadFile(URL, fileName string) error {
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", URL, nil)
-	u.AddAuthorizationHeader(req)
+func parseByteSize(value string) (byteSize, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
 
-	if err != nil {
-		return err
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
 	}
 
-	resp, err := client.Do(req)
+	number, err := strconv.ParseFloat(value, 64)
 
-	if err != nil {
-		return err
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
 	}
 
-	defer resp.Body.Close()
+	return byteSize(number * float64(multiplier)), nil
+}
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("received non 200 response code of %d", resp.StatusCode)
+func (b byteSize) String() string {
+	for _, unit := range byteSizeUnits {
+		if b != 0 && int64(b)%unit.multiplier == 0 {
+			return fmt.Sprintf("%d%s", int64(b)/unit.multiplier, unit.suffix)
+		}
 	}
 
-	//Create a empty file
-	file, err := os.Create(fileName)
-	if err != nil {
-		return err
+	return "0"
+}
+
+// Human formats the size with two decimals in the largest fitting unit.
+func (b byteSize) Human() string {
+	for _, unit := range byteSizeUnits {
+		if b >= byteSize(unit.multiplier) || b <= -byteSize(unit.multiplier) {
+			return fmt.Sprintf("%.2f %s", float64(b)/float64(unit.multiplier), unit.suffix)
+		}
 	}
-	defer file.Close()
 
-	//Write the bytes to the file
-	_, err = io.Copy(file, resp.Body)
+	return fmt.Sprintf("%d B", int64(b))
+}
+
+func (b *byteSize) Set(value string) error {
+	size, err := parseByteSize(value)
+
 	if err != nil {
 		return err
 	}
 
+	*b = size
 	return nil
 }
 
-func (u updater) DownloadAndReplace(artifact artifact) error {
-	sizeValue, sizeSuffix := artifact.Size()
+// bandwidth is a byteSize per second, accepting values like `5MB/s`.
+type bandwidth struct {
+	byteSize
+}
 
-	fmt.Printf("Downloading artifact archive `%s` (%.2f %s) created at %s\n", artifact.Name, sizeValue, sizeSuffix, artifact.CreatedAt)
-	fmt.Printf("Artifact location URL: %s\n", artifact.ArchiveDownloadURL)
-	fmt.Println("Please be patient ...")
-	err := u.DownloadFile(artifact.ArchiveDownloadURL, "dist.zip")
+func (b bandwidth) String() string {
+	if b.byteSize == 0 {
+		return "0"
+	}
 
-	if err != nil {
-		return err
+	return b.byteSize.String() + "/s"
+}
+
+func (b *bandwidth) Set(value string) error {
+	value = strings.TrimSpace(value)
+
+	if strings.HasSuffix(strings.ToLower(value), "/s") {
+		value = value[:len(value)-2]
 	}
 
-	_, statErr := os.Stat(u.directory)
+	return b.byteSize.Set(value)
+}
 
-	if os.IsNotExist(statErr) {
-		fmt.Println("Directory doesn't exist, creating one")
-		mkdirError := os.Mkdir(u.directory, 0755)
+func (b bandwidth) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
 
-		if mkdirError != nil {
-			return mkdirError
-		}
-	} else {
-		fmt.Println("Removing catalog contents")
-		files, err := ioutil.ReadDir(u.directory)
+// progressReader calls report with the number of bytes read so far after
+// every read.
+type progressReader struct {
+	r      io.Reader
+	read   int64
+	report func(current int64)
+}
 
-		if err != nil {
-			return err
-		}
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	p.report(p.read)
 
-		for _, f := range files {
-			filePath := path.Join(u.directory, f.Name())
+	return n, err
+}
 
-			if f.IsDir() {
-				err := os.RemoveAll(filePath)
+// throttledReader reads at most rate bytes per second on average. Reads are
+// kept to a tenth of a second worth of data so that the transfer stays smooth
+// instead of coming in bursts.
+type throttledReader struct {
+	r       io.Reader
+	rate    int64
+	started time.Time
+	read    int64
+}
 
-				if err != nil {
-					return err
-				}
-			} else {
-				err := os.Remove(filePath)
+func newThrottledReader(r io.Reader, rate int64) *throttledReader {
+	return &throttledReader{r: r, rate: rate, started: time.Now()}
+}
 
-				if err != nil {
-					return err
-				}
-			}
-		}
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if chunk := t.rate / 10; chunk > 0 && int64(len(p)) > chunk {
+		p = p[:chunk]
 	}
 
-	fmt.Println("Extracting archive contents")
-	_, unzipErr := unzip("dist.zip", u.directory)
+	n, err := t.r.Read(p)
+	t.read += int64(n)
 
-	if unzipErr != nil {
-		return unzipErr
+	due := time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second))
+
+	if wait := due - time.Since(t.started); wait > 0 {
+		time.Sleep(wait)
 	}
 
-	fmt.Println("Removing archive")
-	removeErr := os.Remove("dist.zip")
+	return n, err
+}
 
-	if removeErr != nil {
-		return removeErr
-	}
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
 
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
 	return nil
 }
 
-type artifact struct {
-	ID                 int    `json:"id"`
-	NodeID             string `json:"node_id"`
-	Name               string `json:"name"`
-	SizeInBytes        int    `json:"size_in_bytes"`
-	URL                string `json:"url"`
-	ArchiveDownloadURL string `json:"archive_download_url"`
-	Expired            bool   `json:"expired"`
-	CreatedAt          string `json:"created_at"`
-	UpdatedAt          string `json:"updated_at"`
-	ExpiresAt          string `json:"expires_at"`
+func (u updater) RepositoryURL() string {
+	return fmt.Sprintf("%s/repos/%s/actions/artifacts", strings.TrimRight(u.apiURL, "/"), u.repository)
 }
 
-func (a artifact) Size() (float64, string) {
-	if a.SizeInBytes > 1024 * 1024 * 1024 * 1024 {
-		return float64(a.SizeInBytes) / float64(1024*1024*1024*1024), "terabytes"
-	} else if a.SizeInBytes > 1024 * 1024 * 1024 {
-		return float64(a.SizeInBytes / (1024 * 1024 * 1024)), "gigabytes"
-	} else if a.SizeInBytes > 1024 * 1024 {
-		return float64(a.SizeInBytes) / float64(1024*1024), "megabytes"
-	} else if a.SizeInBytes > 1024 {
-		return float64(a.SizeInBytes) / float64(1024), "kilobytes"
-	}
+func (u updater) RepositoryInfoURL() string {
+	return fmt.Sprintf("%s/repos/%s", strings.TrimRight(u.apiURL, "/"), u.repository)
+}
 
-	return float64(a.SizeInBytes), "bytes"
+func (u updater) WorkflowRunsURL() string {
+	return fmt.Sprintf("%s/repos/%s/actions/workflows/%s/runs?status=success&per_page=1", strings.TrimRight(u.apiURL, "/"), u.repository, url.PathEscape(u.workflow))
 }
 
-type artifacts struct {
-	Count     int        `json:"total_count"`
-	Artifacts []artifact `json:"artifacts"`
+func (u updater) RunArtifactsURL(runID int) string {
+	return fmt.Sprintf("%s/repos/%s/actions/runs/%d/artifacts", strings.TrimRight(u.apiURL, "/"), u.repository, runID)
 }
 
-func (a artifacts) HasArtifacts() bool {
-	return a.Count > 0
+func (u updater) RunURL(runID int) string {
+	return fmt.Sprintf("%s/repos/%s/actions/runs/%d", strings.TrimRight(u.apiURL, "/"), u.repository, runID)
 }
 
-func (a artifacts) LatestActiveSherpaArtifact() (artifact, error) {
-	var response artifact
-	err := errors.New("no suitable artifacts found")
+func (u updater) RunLogsURL(runID int) string {
+	return fmt.Sprintf("%s/repos/%s/actions/runs/%d/logs", strings.TrimRight(u.apiURL, "/"), u.repository, runID)
+}
 
-	for _, artifact := range a.Artifacts {
-		if artifact.Name == "sherpa4selfie" && !artifact.Expired {
-			response = artifact
-			err = nil
-			break
-		}
+type retryPolicy struct {
+	retries int
+	backoff time.Duration
+	jitter  bool
+	rand    *rand.Rand
+}
+
+// Delay returns the exponential backoff before the given retry, counted from
+// zero. With jitter enabled the delay is picked uniformly between zero and the
+// backoff ("full jitter"), so a fleet of updaters started by the same cron
+// schedule doesn't retry in lockstep.
+func (p retryPolicy) Delay(retry int) time.Duration {
+	delay := p.backoff << uint(retry)
+
+	if p.jitter && p.rand != nil && delay > 0 {
+		delay = time.Duration(p.rand.Int63n(int64(delay) + 1))
 	}
 
-	return response, err
+	return delay
 }
 
-// Source: https://golangcode.com/unzip-files-in-go/
-// Unzip will decompress a zip archive, moving all files and folders
-// within the zip file (parameter 1) to an output directory (parameter 2).
-func unzip(src string, dest string) ([]string, error) {
+func isRetryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
 
-	var filenames []string
+// newHTTPClient returns the client shared by all requests. With a resolver
+// address host names are looked up through that DNS server instead of the
+// system resolver, with http1 HTTP/2 is never negotiated.
+func newHTTPClient(resolver string, http1 bool) (*http.Client, error) {
+	if resolver == "" && !http1 {
+		return &http.Client{}, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if http1 {
+		// An empty, rather than nil, map keeps the transport from setting up
+		// HTTP/2 on its own
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	if resolver == "" {
+		return &http.Client{Transport: transport}, nil
+	}
+
+	host, port, err := net.SplitHostPort(resolver)
+
+	if err == nil && net.ParseIP(host) == nil {
+		err = errors.New("not an IP address")
+	}
+
+	if err == nil {
+		_, err = strconv.ParseUint(port, 10, 16)
+	}
 
-	r, err := zip.OpenReader(src)
 	if err != nil {
-		return filenames, err
+		return nil, fmt.Errorf("invalid -resolver %q, expected ip:port like 10.0.0.53:53 or [fd00::53]:53", resolver)
 	}
-	defer r.Close()
 
-	for _, f := range r.File {
+	address := net.JoinHostPort(host, port)
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, address)
+			},
+		},
+	}
 
-		// Store filename/path for returning and using later on
-		filePath := filepath.Join(dest, f.Name)
+	transport.DialContext = dialer.DialContext
 
-		// Check for ZipSlip. More Info: http://bit.ly/2MsjAWE
-		if !strings.HasPrefix(filePath, filepath.Clean(dest)+string(os.PathSeparator)) {
-			return filenames, fmt.Errorf("%s: illegal file path", filePath)
+	return &http.Client{Transport: transport}, nil
+}
+
+// doWithRetry performs the request, retrying on network errors and on
+// responses that indicate a transient server side problem. A request
+// authorized with the token of -token-cmd is retried once with a refreshed
+// token when it is rejected with 401, without counting as a retry.
+func (u updater) doWithRetry(client *http.Client, req *http.Request) (*http.Response, error) {
+	refreshed := false
+
+	for retry := 0; ; retry++ {
+		attempt := req.Clone(req.Context())
+
+		if u.trace {
+			attempt = traceRequest(attempt)
 		}
 
-		filenames = append(filenames, filePath)
+		u.limiter.Wait()
+		resp, err := client.Do(attempt)
+
+		if err == nil && resp.StatusCode == http.StatusUnauthorized && !refreshed && u.UsesTokenCommand(req) {
+			resp.Body.Close()
+			refreshed = true
+			fmt.Fprintln(os.Stderr, "Request was unauthorized, refreshing the token with -token-cmd")
+
+			token, err := u.tokenCmd.Refresh(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+
+			if err != nil {
+				return nil, err
+			}
+
+			req.Header.Set("Authorization", "Bearer "+token)
+			retry--
 
-		if f.FileInfo().IsDir() {
-			// Make Folder
-			os.MkdirAll(filePath, os.ModePerm)
 			continue
 		}
 
-		// Make File
-		if err = os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
-			return filenames, err
+		if retry >= u.retry.retries || (err == nil && !isRetryableStatus(resp.StatusCode)) {
+			return resp, err
 		}
 
-		outFile, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
-		if err != nil {
-			return filenames, err
-		}
+		reason := ""
 
-		rc, err := f.Open()
 		if err != nil {
-			return filenames, err
+			reason = err.Error()
+		} else {
+			reason = fmt.Sprintf("response code %d", resp.StatusCode)
+			resp.Body.Close()
 		}
 
-		_, err = io.Copy(outFile, rc)
+		delay := u.retry.Delay(retry)
+		fmt.Fprintf(os.Stderr, "Request failed (%s), retrying in %s\n", reason, delay.Round(time.Millisecond))
+		time.Sleep(delay)
+	}
+}
 
-		// Close the file without defer to close before next iteration of loop
-		outFile.Close()
-		rc.Close()
+// rateLimiter is a token bucket shared by every copy of an updater, so that
+// concurrent manifest targets and artifacts together stay within -rate-limit.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
 
-		if err != nil {
-			return filenames, err
-		}
+// newRateLimiter allows perHour requests an hour on average and bursts of up
+// to burst requests. It returns nil, which never waits, when perHour is zero.
+func newRateLimiter(perHour, burst int) *rateLimiter {
+	if perHour <= 0 {
+		return nil
 	}
-	return filenames, nil
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimiter{rate: float64(perHour) / 3600, burst: float64(burst), tokens: float64(burst), last: time.Now()}
 }
 
-func main() {
-	var repository string
-	var token string
-	var directory string
+// Wait blocks until the next request is allowed. Waiting requests reserve
+// their token up front, so a burst is let through one by one at the rate.
+func (l *rateLimiter) Wait() {
+	if l == nil {
+		return
+	}
 
-	flag.StringVar(&repository, "r", "pjotrsavitski/sherpa-helper", "Specify GitHub repository. Default is `pjotrsavitski/sherpa-helper`")
-	flag.StringVar(&token, "t", "", "Specify authentication token. Default value is an empty string")
-	flag.StringVar(&directory, "d", "sherpa4selfie", "Specify asset directory. Default value is `sherpa4selfie` and could also be a fully qualified path")
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	l.last = now
 
-	flag.Parse()
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
 
-	if repository == "" || token == "" || directory == "" {
-		fmt.Println(colorRed, "At least one of the parameters is missing!", colorReset)
-		return
+	l.tokens--
+	delay := time.Duration(0)
+
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+
+	l.mu.Unlock()
+
+	if delay >= time.Second {
+		fmt.Fprintf(os.Stderr, "Rate limit reached, waiting %s\n", delay.Round(time.Second))
+	}
+
+	time.Sleep(delay)
+}
+
+// traceRequest attaches httptrace hooks to the request that log connection
+// reuse, DNS, connect and TLS timings and the time to the first response
+// byte to standard error. Only the URL without its query is logged, as it
+// holds the signature of pre-signed URLs, and no headers.
+func traceRequest(req *http.Request) *http.Request {
+	started := time.Now()
+	var mu sync.Mutex
+	var dnsStarted, tlsStarted time.Time
+
+	logf := func(format string, args ...interface{}) {
+		fmt.Fprintf(os.Stderr, "[trace %8s] %s\n", time.Since(started).Round(time.Microsecond), fmt.Sprintf(format, args...))
+	}
+
+	target := *req.URL
+	target.RawQuery = ""
+	target.User = nil
+	logf("%s %s", req.Method, target.String())
+
+	trace := &httptrace.ClientTrace{
+		GetConn: func(hostPort string) {
+			logf("getting connection to %s", hostPort)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				logf("reusing connection to %s, idle for %s", info.Conn.RemoteAddr(), info.IdleTime)
+			} else {
+				logf("got new connection to %s", info.Conn.RemoteAddr())
+			}
+		},
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			mu.Lock()
+			dnsStarted = time.Now()
+			mu.Unlock()
+			logf("looking up %s", info.Host)
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			mu.Lock()
+			took := time.Since(dnsStarted)
+			mu.Unlock()
+
+			if info.Err != nil {
+				logf("DNS lookup failed after %s: %s", took, info.Err)
+			} else {
+				logf("DNS lookup took %s, found %d addresses", took, len(info.Addrs))
+			}
+		},
+		ConnectStart: func(network, addr string) {
+			logf("connecting to %s over %s", addr, network)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err != nil {
+				logf("connecting to %s failed: %s", addr, err)
+			} else {
+				logf("connected to %s", addr)
+			}
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			tlsStarted = time.Now()
+			mu.Unlock()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			mu.Lock()
+			took := time.Since(tlsStarted)
+			mu.Unlock()
+
+			if err != nil {
+				logf("TLS handshake failed after %s: %s", took, err)
+			} else {
+				logf("TLS handshake took %s, %s", took, tls.VersionName(state.Version))
+			}
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err != nil {
+				logf("writing the request failed: %s", info.Err)
+			}
+		},
+		GotFirstResponseByte: func() {
+			logf("first response byte")
+		},
+	}
+
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+func (u updater) AddAuthorizationHeader(req *http.Request) {
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", u.TokenFor(req.URL)))
+}
+
+// TokenFor picks the token of the -token or -netrc entry for the host of the
+// URL, with or without its port, falling back to the -t token.
+func (u updater) TokenFor(target *url.URL) string {
+	if token, ok := u.HostToken(target); ok {
+		return token
+	}
+
+	if u.tokenCmd != nil {
+		return u.tokenCmd.Token()
+	}
+
+	return u.token
+}
+
+// HostToken returns the -token or -netrc entry for the host of the URL.
+func (u updater) HostToken(target *url.URL) (string, bool) {
+	if token, ok := u.hostTokens[target.Host]; ok {
+		return token, true
+	}
+
+	token, ok := u.hostTokens[target.Hostname()]
+
+	return token, ok
+}
+
+// tokenCommand holds the token printed by -token-cmd, shared between the
+// copies of an updater so that a refresh is seen by all of them.
+type tokenCommand struct {
+	mu      sync.Mutex
+	command string
+	token   string
+}
+
+func newTokenCommand(command, token string) *tokenCommand {
+	if command == "" {
+		return nil
 	}
 
-	var updater = updater{repository, token, directory}
+	return &tokenCommand{command: command, token: token}
+}
+
+func (t *tokenCommand) Token() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	fmt.Println("Downloading artifacts data, please wait ...")
-	data, err := updater.Artifacts()
+	return t.token
+}
+
+// Refresh runs the command again, unless the token was already refreshed
+// since the stale one was used.
+func (t *tokenCommand) Refresh(stale string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.token != stale {
+		return t.token, nil
+	}
+
+	token, err := runTokenCommand(t.command)
 
 	if err != nil {
-		log.Fatal(colorRed, err, colorReset)
+		return "", err
 	}
 
-	if data.HasArtifacts() {
-		artifact, err := data.LatestActiveSherpaArtifact()
+	t.token = token
 
-		if err != nil {
-			log.Fatal(colorRed, err, colorReset)
-		}
+	return token, nil
+}
 
-		err1 := updater.DownloadAndReplace(artifact)
+// runTokenCommand runs the -token-cmd command with sh and returns what it
+// printed, trimmed. The output is never logged.
+func runTokenCommand(command string) (string, error) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
 
-		if err1 != nil {
-			log.Fatal(colorRed, err1, colorReset)
+	if err != nil {
+		return "", fmt.Errorf("-token-cmd failed: %w", err)
+	}
+
+	token := strings.TrimSpace(string(output))
+
+	if token == "" {
+		return "", errors.New("-token-cmd printed no token")
+	}
+
+	return token, nil
+}
+
+// UsesTokenCommand tells whether the request is authorized with the token of
+// -token-cmd.
+func (u updater) UsesTokenCommand(req *http.Request) bool {
+	if u.tokenCmd == nil || req.Header.Get("Authorization") == "" {
+		return false
+	}
+
+	_, ok := u.HostToken(req.URL)
+
+	return !ok
+}
+
+// parseHostTokens turns `host=token` strings into a map by host.
+func parseHostTokens(values []string, tokens map[string]string) error {
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return errors.New("invalid -token value, expected `host=token`")
 		}
-	} else {
-		fmt.Println(colorBlue, "No artifacts found!", colorReset)
+
+		tokens[strings.ToLower(strings.TrimSpace(parts[0]))] = strings.TrimSpace(parts[1])
+	}
+
+	return nil
+}
+
+// readNetrc reads the password of every machine entry of a netrc file as the
+// token of the host. Entries without a password and default entries are
+// ignored, use -t for a default token.
+func readNetrc(fileName string, tokens map[string]string) error {
+	content, err := os.ReadFile(fileName)
+
+	if err != nil {
+		return err
+	}
+
+	fields := strings.Fields(string(content))
+	machine := ""
+
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "machine":
+			if i+1 < len(fields) {
+				i++
+				machine = strings.ToLower(fields[i])
+			}
+		case "default":
+			machine = ""
+		case "login", "account":
+			i++
+		case "macdef":
+			// Macro definitions run until an empty line and can't be told
+			// apart from fields, nothing after them is read
+			return nil
+		case "password":
+			if i+1 < len(fields) {
+				i++
+
+				if machine != "" {
+					tokens[machine] = fields[i]
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// DecorateRequest applies the -header values to an outgoing request and, when
+// withAuth is set, the authorization header.
+func (u updater) DecorateRequest(req *http.Request, withAuth bool) {
+	if req == nil {
+		return
+	}
+
+	for key, values := range u.headers {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+
+	if withAuth {
+		u.AddAuthorizationHeader(req)
+	}
+}
+
+// parseHeaders turns `Key: Value` strings into headers. Authorization can't
+// be set this way, the token of -t is always used for it.
+func parseHeaders(values []string) (http.Header, error) {
+	headers := http.Header{}
+
+	for _, value := range values {
+		parts := strings.SplitN(value, ":", 2)
+
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid header %q, expected `Key: Value`", value)
+		}
+
+		key := strings.TrimSpace(parts[0])
+
+		if key == "" || strings.ContainsAny(key, " \t\r\n") {
+			return nil, fmt.Errorf("invalid header name %q", key)
+		}
+
+		if strings.EqualFold(key, "Authorization") {
+			return nil, errors.New("the Authorization header can't be overridden with -header, use -t instead")
+		}
+
+		headers.Add(key, strings.TrimSpace(parts[1]))
+	}
+
+	return headers, nil
+}
+
+type artifactsCache struct {
+	Repository   string    `json:"repository"`
+	URL          string    `json:"url"`
+	FetchedAt    time.Time `json:"fetched_at"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Data         artifacts `json:"data"`
+}
+
+var errNotModified = errors.New("not modified")
+
+// Artifacts returns the artifacts listing of the repository, served from the
+// cache file when one is configured, still fresh and made for the same
+// repository and API URL. The -cache-dir entry of the repository works the
+// same way. Once the cache is stale, the listing is requested with
+// If-Modified-Since when the server sent a Last-Modified header before, and a
+// 304 response keeps using the cached listing. Fresh responses are written
+// back to the cache.
+func (u updater) Artifacts() (artifacts, error) {
+	var cache artifactsCache
+	cacheErr := errors.New("cache disabled")
+
+	if u.CacheFile() != "" && !u.refresh {
+		cache, cacheErr = u.readCache()
+
+		if cacheErr == nil && time.Since(cache.FetchedAt) < u.cacheTTL {
+			fmt.Fprintf(os.Stderr, "Using cached artifacts data fetched at %s\n", cache.FetchedAt.Format(time.RFC3339))
+			return cache.Data, nil
+		}
+	}
+
+	conditions := http.Header{}
+
+	if cacheErr == nil && cache.LastModified != "" {
+		conditions.Set("If-Modified-Since", cache.LastModified)
+	}
+
+	data, lastModified, err := u.fetchArtifacts(conditions)
+
+	if errors.Is(err, errNotModified) {
+		fmt.Fprintf(os.Stderr, "Artifacts data not modified since %s, using the cached one\n", cache.LastModified)
+		u.stats.ListingNotModified = true
+		data, lastModified, err = cache.Data, cache.LastModified, nil
+	}
+
+	if err != nil {
+		return data, err
+	}
+
+	if u.CacheFile() != "" {
+		if err := u.writeCache(data, lastModified); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to write artifacts cache: %s\n", err)
+		}
+	}
+
+	return data, nil
+}
+
+// CacheFile returns -cache-file, or the entry of the repository and API URL
+// in -cache-dir. Entries in the cache directory are compressed.
+func (u updater) CacheFile() string {
+	if u.cacheFile != "" || u.cacheDir == "" {
+		return u.cacheFile
+	}
+
+	key := sha256.Sum256([]byte(strings.TrimRight(u.apiURL, "/") + "\n" + u.repository))
+
+	return filepath.Join(u.cacheDir, hex.EncodeToString(key[:8])+compressedCacheSuffix)
+}
+
+const compressedCacheSuffix string = ".json.gz"
+
+// cacheRetention is how long entries of -cache-dir are kept at least, past
+// their TTL they are still revalidated with If-Modified-Since.
+const cacheRetention time.Duration = 24 * time.Hour
+
+// EvictCache removes the entries of -cache-dir that weren't refreshed within
+// the TTL, or cacheRetention when that's longer.
+func (u updater) EvictCache() error {
+	entries, err := os.ReadDir(u.cacheDir)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	retention := cacheRetention
+
+	if u.cacheTTL > retention {
+		retention = u.cacheTTL
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), compressedCacheSuffix) {
+			continue
+		}
+
+		info, err := entry.Info()
+
+		if err != nil || time.Since(info.ModTime()) < retention {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(u.cacheDir, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (u updater) readCache() (artifactsCache, error) {
+	var cache artifactsCache
+	body, err := os.ReadFile(u.CacheFile())
+
+	if err != nil {
+		return cache, err
+	}
+
+	if strings.HasSuffix(u.CacheFile(), ".gz") {
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+
+		if err != nil {
+			return cache, err
+		}
+
+		body, err = io.ReadAll(reader)
+
+		if err != nil {
+			return cache, err
+		}
+	}
+
+	if err := json.Unmarshal(body, &cache); err != nil {
+		return cache, err
+	}
+
+	if cache.Repository != u.repository || cache.URL != u.RepositoryURL() {
+		return cache, errors.New("cache belongs to a different repository")
+	}
+
+	return cache, nil
+}
+
+func (u updater) writeCache(data artifacts, lastModified string) error {
+	body, err := json.Marshal(artifactsCache{
+		Repository:   u.repository,
+		URL:          u.RepositoryURL(),
+		FetchedAt:    time.Now(),
+		LastModified: lastModified,
+		Data:         data,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(u.CacheFile(), ".gz") {
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+
+		if _, err := writer.Write(body); err != nil {
+			return err
+		}
+
+		if err := writer.Close(); err != nil {
+			return err
+		}
+
+		body = compressed.Bytes()
+	}
+
+	if err := os.MkdirAll(filepath.Dir(u.CacheFile()), 0700); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(u.CacheFile(), body, 0600)
+}
+
+// writeFileAtomic writes data to a temporary file next to fileName and renames
+// it into place, so readers never observe a partially written file.
+func writeFileAtomic(fileName string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(fileName), "."+filepath.Base(fileName)+".tmp")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), fileName)
+}
+
+type apiErrorBody struct {
+	Message          string `json:"message"`
+	DocumentationURL string `json:"documentation_url"`
+}
+
+// HTTPError is returned for responses with an unexpected status code.
+// errors.Is matches it against an HTTPError with the same Code, or any
+// HTTPError when the target Code is zero.
+type HTTPError struct {
+	Code    int
+	Message string
+}
+
+func (e *HTTPError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("received non 200 response code of %d: %s", e.Code, e.Message)
+	}
+
+	return fmt.Sprintf("received non 200 response code of %d", e.Code)
+}
+
+func (e *HTTPError) Is(target error) bool {
+	t, ok := target.(*HTTPError)
+	return ok && (t.Code == 0 || t.Code == e.Code)
+}
+
+// AuthError is returned when the token was rejected or lacks a permission.
+type AuthError struct {
+	HTTPError
+	Permission string
+}
+
+func (e *AuthError) Error() string {
+	if e.Permission != "" {
+		return fmt.Sprintf("token is missing a required permission, GitHub accepts %s (%s). Grant the token read access to Actions of the repository", e.Permission, e.Message)
+	}
+
+	if e.Message != "" {
+		return fmt.Sprintf("authentication failed with response code %d: %s", e.Code, e.Message)
+	}
+
+	return fmt.Sprintf("authentication failed with response code %d", e.Code)
+}
+
+func (e *AuthError) Unwrap() error {
+	return &e.HTTPError
+}
+
+// NotFoundError is returned when the repository, the artifact or its archive
+// doesn't exist. HTTP is set when the error comes from a response.
+type NotFoundError struct {
+	Message string
+	HTTP    *HTTPError
+}
+
+func (e *NotFoundError) Error() string {
+	if e.HTTP != nil {
+		return e.HTTP.Error()
+	}
+
+	return e.Message
+}
+
+func (e *NotFoundError) Unwrap() error {
+	if e.HTTP == nil {
+		return nil
+	}
+
+	return e.HTTP
+}
+
+// ExtractionError is returned when an archive can't be read or extracted.
+type ExtractionError struct {
+	Archive string
+	Err     error
+}
+
+func (e *ExtractionError) Error() string {
+	return fmt.Sprintf("extracting %s failed: %s", e.Archive, e.Err)
+}
+
+func (e *ExtractionError) Unwrap() error {
+	return e.Err
+}
+
+// DisallowedPathError is returned for an archive entry outside -allow-paths.
+type DisallowedPathError struct {
+	Name string
+}
+
+func (e *DisallowedPathError) Error() string {
+	return fmt.Sprintf("%s: not allowed by -allow-paths", e.Name)
+}
+
+// PathTooLongError is returned for an archive entry whose extracted path, or
+// one of its names, would exceed the limits of the platform.
+type PathTooLongError struct {
+	Name    string
+	Element string
+	Length  int
+	Limit   int
+	Hint    string
+}
+
+func (e *PathTooLongError) Error() string {
+	if e.Element != "" {
+		return fmt.Sprintf("%s: name %q is %d characters long, over the limit of %d", e.Name, e.Element, e.Length, e.Limit)
+	}
+
+	return fmt.Sprintf("%s: extracted path would be %d characters long, over the limit of %d%s", e.Name, e.Length, e.Limit, e.Hint)
+}
+
+// isRejectedPath tells whether the archive was refused for the paths of its
+// entries rather than for being corrupt.
+func isRejectedPath(err error) bool {
+	var disallowed *DisallowedPathError
+	var tooLong *PathTooLongError
+
+	return errors.As(err, &disallowed) || errors.As(err, &tooLong)
+}
+
+// ChecksumError is returned when downloaded content doesn't match what was
+// expected of it, be it the size, a digest or a signature.
+type ChecksumError struct {
+	Subject  string
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumError) Error() string {
+	if e.Expected == "" && e.Actual == "" {
+		return e.Subject + " mismatch"
+	}
+
+	return fmt.Sprintf("%s mismatch, expected %s but got %s", e.Subject, e.Expected, e.Actual)
+}
+
+// phaseError records which phase of an update failed, for the summary of
+// targets. The message is the one of the wrapped error.
+type phaseError struct {
+	phase string
+	err   error
+}
+
+func (e *phaseError) Error() string {
+	return e.err.Error()
+}
+
+func (e *phaseError) Unwrap() error {
+	return e.err
+}
+
+func inPhase(phase string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &phaseError{phase: phase, err: err}
+}
+
+// failedPhase tells which phase the error came from: auth, list, select,
+// download, verify, extract or hook.
+func failedPhase(err error) string {
+	var authErr *AuthError
+	var checksumErr *ChecksumError
+	var phaseErr *phaseError
+	var extractionErr *ExtractionError
+
+	switch {
+	case errors.As(err, &authErr):
+		return "auth"
+	case errors.As(err, &checksumErr):
+		return "verify"
+	case errors.As(err, &phaseErr):
+		return phaseErr.phase
+	case errors.As(err, &extractionErr):
+		return "extract"
+	}
+
+	return "deploy"
+}
+
+const exitAuthError int = 4
+const exitNotFound int = 5
+const exitChecksumError int = 6
+const exitExtractionError int = 7
+const exitHTTPError int = 8
+
+// exitCode maps an error to the process exit code, so that scripts can tell
+// failures apart without parsing messages.
+func exitCode(err error) int {
+	var authErr *AuthError
+	var notFoundErr *NotFoundError
+	var checksumErr *ChecksumError
+	var extractionErr *ExtractionError
+	var httpErr *HTTPError
+
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &authErr):
+		return exitAuthError
+	case errors.As(err, &notFoundErr):
+		return exitNotFound
+	case errors.As(err, &checksumErr):
+		return exitChecksumError
+	case errors.As(err, &extractionErr):
+		return exitExtractionError
+	case errors.As(err, &httpErr):
+		return exitHTTPError
+	}
+
+	return 1
+}
+
+// errorCodes name the exit codes in the error event of -json.
+var errorCodes = map[int]string{
+	exitAuthError:       "AUTH",
+	exitNotFound:        "NOT_FOUND",
+	exitChecksumError:   "CHECKSUM",
+	exitExtractionError: "EXTRACTION",
+	exitHTTPError:       "HTTP",
+}
+
+// errorCode returns the name of the exit code the error maps to, or ERROR for
+// untyped errors.
+func errorCode(err error) string {
+	if code, ok := errorCodes[exitCode(err)]; ok {
+		return code
+	}
+
+	return "ERROR"
+}
+
+// apiResponseError turns a failed response into a typed error, explaining
+// missing token permissions when GitHub tells which ones it expected.
+// Fine-grained personal access tokens get a 403 with the accepted permissions
+// in the X-Accepted-GitHub-Permissions header when they lack a scope.
+func apiResponseError(resp *http.Response) error {
+	var body apiErrorBody
+	json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&body)
+
+	httpErr := HTTPError{Code: resp.StatusCode, Message: body.Message}
+	accepted := resp.Header.Get("X-Accepted-GitHub-Permissions")
+
+	switch {
+	case resp.StatusCode == http.StatusForbidden && (accepted != "" || strings.Contains(body.Message, "Resource not accessible by")):
+		if accepted == "" {
+			accepted = "actions=read"
+		}
+
+		return &AuthError{HTTPError: httpErr, Permission: accepted}
+	case resp.StatusCode == http.StatusUnauthorized:
+		return &AuthError{HTTPError: httpErr}
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return &NotFoundError{HTTP: &httpErr}
+	}
+
+	return &httpErr
+}
+
+// fetchArtifacts downloads the artifacts listing of the repository or, with
+// -run-id, of the given workflow run or, with -from-latest-run, of the latest
+// successful run of -workflow. It returns the
+// Last-Modified header of the response, if any.
+func (u updater) fetchArtifacts(conditions http.Header) (artifacts, string, error) {
+	var data artifacts
+	URL := u.RepositoryURL()
+
+	if u.runID != 0 {
+		header, err := u.fetchJSON(u.RunArtifactsURL(u.runID), &data, conditions, u.dumpResponse)
+
+		var notFound *NotFoundError
+
+		if errors.As(err, &notFound) {
+			err = fmt.Errorf("workflow run %d not found in %s: %w", u.runID, u.repository, err)
+		}
+
+		return data, header.Get("Last-Modified"), err
+	}
+
+	if u.fromLatestRun {
+		run, err := u.LatestSuccessfulRun()
+
+		if err != nil {
+			return data, "", err
+		}
+
+		fmt.Printf("Using artifacts of workflow run %d (%s at %s)\n", run.ID, run.HeadBranch, run.HeadSHA)
+		URL = u.RunArtifactsURL(run.ID)
+	}
+
+	header, err := u.fetchJSON(URL, &data, conditions, u.dumpResponse)
+
+	return data, header.Get("Last-Modified"), err
+}
+
+type workflowRuns struct {
+	TotalCount   int           `json:"total_count"`
+	WorkflowRuns []workflowRun `json:"workflow_runs"`
+}
+
+// LatestSuccessfulRun returns the most recent successful run of -workflow.
+func (u updater) LatestSuccessfulRun() (workflowRun, error) {
+	var data workflowRuns
+
+	if _, err := u.fetchJSON(u.WorkflowRunsURL(), &data, nil, ""); err != nil {
+		return workflowRun{}, err
+	}
+
+	// GitHub lists the runs newest first
+	if len(data.WorkflowRuns) == 0 {
+		return workflowRun{}, &NotFoundError{Message: fmt.Sprintf("no successful runs of workflow %s found", u.workflow)}
+	}
+
+	return data.WorkflowRuns[0], nil
+}
+
+// fetchJSON sends an authenticated GET request with the extra conditions
+// headers to the API and decodes the response into v. It returns the response
+// headers, and errNotModified for a 304 response. The raw response is written
+// to dumpFile first, when given.
+func (u updater) fetchJSON(URL string, v interface{}, conditions http.Header, dumpFile string) (http.Header, error) {
+	client := u.client
+	req, err := http.NewRequest("GET", URL, nil)
+
+	if err != nil {
+		return http.Header{}, err
+	}
+
+	u.DecorateRequest(req, true)
+
+	for key, values := range conditions {
+		req.Header[key] = values
+	}
+
+	resp, err := u.doWithRetry(client, req)
+
+	if err != nil {
+		return http.Header{}, err
+	}
+
+	defer resp.Body.Close()
+
+	u.stats.RecordRateLimit(resp)
+
+	var reader io.Reader = resp.Body
+
+	if u.maxResponseSize > 0 {
+		// Read one byte past the cap to tell an exact fit from an overflow
+		reader = io.LimitReader(resp.Body, int64(u.maxResponseSize)+1)
+	}
+
+	body, err := io.ReadAll(reader)
+
+	if err != nil {
+		return resp.Header, err
+	}
+
+	if u.maxResponseSize > 0 && int64(len(body)) > int64(u.maxResponseSize) {
+		return resp.Header, fmt.Errorf("response of %s exceeds the maximum response size of %s", URL, u.maxResponseSize)
+	}
+
+	if dumpFile != "" {
+		if err := u.DumpResponse(dumpFile, resp, body); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to dump the response: %s\n", err)
+		}
+	}
+
+	if resp.StatusCode == http.StatusNotModified {
+		return resp.Header, errNotModified
+	}
+
+	if resp.StatusCode != 200 {
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		return resp.Header, apiResponseError(resp)
+	}
+
+	return resp.Header, json.Unmarshal(body, v)
+}
+
+// DumpResponse writes the raw response body to fileName for bug reports. With
+// -dump-headers the request and response headers come first, leaving out the
+// Authorization header.
+func (u updater) DumpResponse(fileName string, resp *http.Response, body []byte) error {
+	var buffer bytes.Buffer
+
+	if u.dumpHeaders {
+		request := resp.Request.Clone(resp.Request.Context())
+		request.Header.Del("Authorization")
+
+		fmt.Fprintf(&buffer, "%s %s\n", request.Method, request.URL)
+		request.Header.Write(&buffer)
+		fmt.Fprintf(&buffer, "\n%s %s\n", resp.Proto, resp.Status)
+		resp.Header.Write(&buffer)
+		buffer.WriteString("\n")
+	}
+
+	buffer.Write(body)
+
+	return writeFileAtomic(fileName, buffer.Bytes(), 0600)
+}
+
+// FetchBytes downloads a small document into memory, refusing anything larger
+// than limit. The token is only sent along to the GitHub API host, so that a
+// signature hosted elsewhere doesn't leak it.
+func (u updater) FetchBytes(URL string, limit int64) ([]byte, error) {
+	client := u.client
+	req, err := http.NewRequest("GET", URL, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	u.DecorateRequest(req, u.IsAPIHost(req.URL))
+
+	resp, err := u.doWithRetry(client, req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, apiResponseError(resp)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("response exceeds %d bytes", limit)
+	}
+
+	return body, nil
+}
+
+// IsAPIHost tells whether the URL points to the GitHub API, the only host the
+// token is sent to.
+func (u updater) IsAPIHost(target *url.URL) bool {
+	apiURL, err := url.Parse(u.apiURL)
+
+	return err == nil && apiURL.Host == target.Host
+}
+
+// DownloadFile downloads URL into fileName. The number of written bytes is
+// checked against the Content-Length of the response or, when the server
+// doesn't send one, against expectedSize if it is known (non-zero).
+//
+// GitHub answers archive downloads with a redirect to a pre-signed URL on
+// another host. The token is only sent on the hops to the API host, so the
+// pre-signed URL is followed without it.
+func (u updater) DownloadFile(URL, fileName string, expectedSize int64) error {
+	client := *u.client
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+
+		if !u.IsAPIHost(req.URL) {
+			req.Header.Del("Authorization")
+		}
+
+		return nil
+	}
+
+	req, err := http.NewRequest("GET", URL, nil)
+
+	if err != nil {
+		return err
+	}
+
+	u.DecorateRequest(req, u.IsAPIHost(req.URL))
+	resp, err := u.doWithRetry(&client, req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	redirected := resp.Request.URL.Host != req.URL.Host
+
+	if redirected && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+		return &AuthError{HTTPError: HTTPError{
+			Code:    resp.StatusCode,
+			Message: fmt.Sprintf("%s rejected the download redirected from %s, the pre-signed URL may have expired or the host wants credentials of its own", resp.Request.URL.Host, req.URL.Host),
+		}}
+	}
+
+	if resp.StatusCode != 200 {
+		return apiResponseError(resp)
+	}
+
+	var body io.Reader = resp.Body
+
+	if u.maxDownloadSize > 0 {
+		if resp.ContentLength > int64(u.maxDownloadSize) {
+			return fmt.Errorf("download of %d bytes exceeds the maximum download size of %s", resp.ContentLength, u.maxDownloadSize)
+		}
+
+		// Read one byte past the cap to tell an exact fit from an overflow
+		body = io.LimitReader(resp.Body, int64(u.maxDownloadSize)+1)
+	}
+
+	if u.downloadChunks > 1 && fileName != stdoutFile && u.maxBandwidth.byteSize == 0 {
+		if resp.Header.Get("Accept-Ranges") == "bytes" && resp.ContentLength >= int64(u.downloadChunks) {
+			return u.DownloadChunks(&client, resp, fileName)
+		}
+
+		fmt.Printf("%s doesn't support range requests, downloading in a single stream\n", resp.Request.URL.Host)
+	}
+
+	if u.maxBandwidth.byteSize > 0 {
+		body = newThrottledReader(body, int64(u.maxBandwidth.byteSize))
+	}
+
+	if u.ReportsProgress() {
+		total := expectedSize
+
+		if resp.ContentLength >= 0 {
+			total = resp.ContentLength
+		}
+
+		body = &progressReader{r: body, report: func(current int64) {
+			u.ReportProgress("download", current, total)
+		}}
+	}
+
+	var written int64
+
+	if fileName == stdoutFile {
+		written, err = io.Copy(u.stdout, body)
+	} else {
+		written, err = saveFile(fileName, body)
+	}
+
+	u.stats.BytesDownloaded += written
+
+	if err != nil {
+		return err
+	}
+
+	if u.maxDownloadSize > 0 && written > int64(u.maxDownloadSize) {
+		removeDownload(fileName)
+		return fmt.Errorf("download exceeds the maximum download size of %s", u.maxDownloadSize)
+	}
+
+	if resp.ContentLength >= 0 {
+		expectedSize = resp.ContentLength
+	}
+
+	if expectedSize > 0 && written != expectedSize {
+		removeDownload(fileName)
+		return &ChecksumError{Subject: "download size", Expected: fmt.Sprintf("%d bytes", expectedSize), Actual: fmt.Sprintf("%d bytes", written)}
+	}
+
+	return nil
+}
+
+// DownloadChunks downloads the file of the response in -download-chunks byte
+// ranges concurrently, writing each at its offset. The first range is read
+// from the body of the response itself, the others are requested from the URL
+// it was served from, after any redirects.
+func (u updater) DownloadChunks(client *http.Client, resp *http.Response, fileName string) error {
+	size := resp.ContentLength
+	chunks := int64(u.downloadChunks)
+	chunkSize := (size + chunks - 1) / chunks
+
+	fmt.Printf("Downloading %d bytes in %d chunks\n", size, chunks)
+
+	file, err := os.Create(fileName)
+
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	var written int64
+	errs := make([]error, chunks)
+
+	for i := int64(0); i < chunks; i++ {
+		start := i * chunkSize
+		end := start + chunkSize
+
+		if end > size {
+			end = size
+		}
+
+		if start >= end {
+			break
+		}
+
+		wg.Add(1)
+
+		go func(i, start, end int64) {
+			defer wg.Done()
+
+			body := resp.Body
+
+			if i > 0 {
+				var err error
+				body, err = u.fetchRange(client, resp.Request.URL.String(), start, end-1)
+
+				if err != nil {
+					errs[i] = err
+					return
+				}
+			}
+
+			defer body.Close()
+
+			r := io.LimitReader(body, end-start)
+			n, err := io.Copy(io.NewOffsetWriter(file, start), &chunkReader{r: r, written: &written, report: func(current int64) {
+				u.ReportProgress("download", current, size)
+			}})
+
+			if err == nil && n != end-start {
+				err = fmt.Errorf("chunk at offset %d ended after %d of %d bytes", start, n, end-start)
+			}
+
+			errs[i] = err
+		}(i, start, end)
+	}
+
+	wg.Wait()
+
+	closeErr := file.Close()
+	u.stats.BytesDownloaded += written
+
+	for _, chunkErr := range errs {
+		if chunkErr != nil {
+			err = chunkErr
+			break
+		}
+	}
+
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(fileName)
+		return err
+	}
+
+	if written != size {
+		os.Remove(fileName)
+		return &ChecksumError{Subject: "download size", Expected: fmt.Sprintf("%d bytes", size), Actual: fmt.Sprintf("%d bytes", written)}
+	}
+
+	return nil
+}
+
+// chunkReader adds what is read to the shared count of written bytes of a
+// chunked download.
+type chunkReader struct {
+	r       io.Reader
+	written *int64
+	report  func(current int64)
+}
+
+func (c *chunkReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.report(atomic.AddInt64(c.written, int64(n)))
+
+	return n, err
+}
+
+// fetchRange requests the bytes from start to end, inclusive, of URL and
+// makes sure the server answered with exactly that range.
+func (u updater) fetchRange(client *http.Client, URL string, start, end int64) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", URL, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	u.DecorateRequest(req, u.IsAPIHost(req.URL))
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	resp, err := u.doWithRetry(client, req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("range request for bytes %d-%d got %s instead of partial content", start, end, resp.Status)
+	}
+
+	if contentRange := resp.Header.Get("Content-Range"); !strings.HasPrefix(contentRange, fmt.Sprintf("bytes %d-%d/", start, end)) {
+		resp.Body.Close()
+		return nil, fmt.Errorf("range request for bytes %d-%d got the range %q", start, end, contentRange)
+	}
+
+	return resp.Body, nil
+}
+
+// stdoutFile is the -o value writing the archive to standard output.
+const stdoutFile string = "-"
+
+// removeDownload removes a rejected download, unless it already went to
+// standard output.
+func removeDownload(fileName string) {
+	if fileName != stdoutFile {
+		os.Remove(fileName)
+	}
+}
+
+// saveFile writes everything read from r into fileName. When reading or
+// writing fails midway the partially written file is removed, so a broken
+// download never stays around to be extracted.
+func saveFile(fileName string, r io.Reader) (int64, error) {
+	//Create a empty file
+	file, err := os.Create(fileName)
+	if err != nil {
+		return 0, err
+	}
+
+	//Write the bytes to the file
+	written, err := io.Copy(file, r)
+	closeErr := file.Close()
+
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(fileName)
+		return written, err
+	}
+
+	return written, nil
+}
+
+// CheckDirectory makes sure the target is either missing or a directory, so
+// that nothing is downloaded or removed for a target that can't be replaced.
+func (u updater) CheckDirectory() error {
+	if !u.allowProtected {
+		if err := checkProtectedDirectory(u.directory); err != nil {
+			return err
+		}
+	}
+
+	info, err := os.Stat(u.directory)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("%s: target exists and is not a directory", u.directory)
+	}
+
+	if (u.destOwnerCheck || u.destOwner != "") && !u.force {
+		if err := u.CheckOwner(info); err != nil {
+			return err
+		}
+	}
+
+	if u.requireEmpty && !u.force {
+		return u.CheckPreviousDeploy()
+	}
+
+	return nil
+}
+
+// CheckOwner makes sure the asset directory is owned by -dest-owner, or the
+// current user, so that a misconfigured path doesn't wipe the files of
+// another user.
+func (u updater) CheckOwner(info os.FileInfo) error {
+	uid, _, ok := fileOwner(info)
+
+	if !ok {
+		fmt.Println(colorBlue, "Warning: file ownership is not supported on this system, skipping the owner check", colorReset)
+		return nil
+	}
+
+	expected, err := u.ExpectedOwner()
+
+	if err != nil {
+		return err
+	}
+
+	if uid != expected {
+		return fmt.Errorf("%s: owned by uid %d instead of uid %d, use -force to replace it anyway", u.directory, uid, expected)
+	}
+
+	return nil
+}
+
+// ExpectedOwner returns the uid of -dest-owner, given as a user name or a
+// uid, defaulting to the current user.
+func (u updater) ExpectedOwner() (int, error) {
+	if u.destOwner == "" {
+		return os.Getuid(), nil
+	}
+
+	if uid, err := strconv.Atoi(u.destOwner); err == nil {
+		return uid, nil
+	}
+
+	owner, err := user.Lookup(u.destOwner)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(owner.Uid)
+}
+
+// protectedDirectories are never replaced without -i-know-what-im-doing, next
+// to the file system root, the home directory and the working directory. Only
+// the directories themselves are protected, and /opt, /srv, /tmp and /var are
+// left out as they hold data rather than the system itself.
+var protectedDirectories = []string{"/bin", "/boot", "/dev", "/etc", "/home", "/lib", "/lib64", "/proc", "/root", "/sbin", "/sys", "/usr"}
+
+// checkProtectedDirectory refuses directories where wiping the contents would
+// be catastrophic, after resolving them to absolute paths without symlinks.
+func checkProtectedDirectory(dir string) error {
+	resolved, err := resolvePath(dir)
+
+	if err != nil {
+		return err
+	}
+
+	protected := protectedDirectories
+
+	if home, err := os.UserHomeDir(); err == nil {
+		protected = append(protected, home)
+	}
+
+	if cwd, err := os.Getwd(); err == nil {
+		protected = append(protected, cwd)
+	}
+
+	if resolved == filepath.Dir(resolved) {
+		return fmt.Errorf("%s: refusing to replace the file system root, use -i-know-what-im-doing to override", dir)
+	}
+
+	for _, candidate := range protected {
+		candidate, err := resolvePath(candidate)
+
+		if err == nil && candidate == resolved {
+			return fmt.Errorf("%s: refusing to replace protected directory %s, use -i-know-what-im-doing to override", dir, resolved)
+		}
+	}
+
+	return nil
+}
+
+// resolvePath returns the absolute path with symlinks evaluated, as far as it
+// exists.
+func resolvePath(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+
+	if err != nil {
+		return "", err
+	}
+
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved, nil
+	}
+
+	return abs, nil
+}
+
+// CheckPreviousDeploy refuses a target directory that has contents but no
+// state marker, as it most likely isn't a previous deployment and pointing
+// -d at the wrong directory would wipe it.
+func (u updater) CheckPreviousDeploy() error {
+	files, err := os.ReadDir(u.directory)
+
+	if err != nil {
+		return err
+	}
+
+	if len(files) == 0 {
+		return nil
+	}
+
+	if _, err := os.Stat(u.StateFile()); err == nil {
+		return nil
+	}
+
+	return fmt.Errorf("%s: target is not empty and wasn't deployed by updater, use -force to replace it anyway", u.directory)
+}
+
+// IsKept reports whether a path relative to the target directory, or one of
+// its parent directories, matches one of the -keep patterns. Patterns are
+// matched against the whole relative path and against the base name, so both
+// `config/local.json` and `*.env` work.
+func (u updater) IsKept(relPath string) bool {
+	if filepath.ToSlash(relPath) == stateMarker {
+		return true
+	}
+
+	for current := filepath.ToSlash(relPath); current != "." && current != "/"; current = path.Dir(current) {
+		for _, pattern := range u.keep {
+			if matched, _ := path.Match(pattern, current); matched {
+				return true
+			}
+
+			if matched, _ := path.Match(pattern, path.Base(current)); matched {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ConfirmClear asks to type yes before the contents of the asset directory
+// are deleted when -confirm is given. It never blocks without a terminal, the
+// run fails there unless -yes answered the question up front.
+func (u updater) ConfirmClear() error {
+	if !u.confirm || u.assumeYes {
+		return nil
+	}
+
+	count, err := u.CountRemovable()
+
+	if err != nil || count == 0 {
+		return err
+	}
+
+	return u.ConfirmChanges(fmt.Sprintf("deletes %d files", count))
+}
+
+// ConfirmChanges asks to type yes before the described changes are made to
+// the asset directory when -confirm is given, like ConfirmClear does for
+// deploys that only change some of the files.
+func (u updater) ConfirmChanges(changes string) error {
+	if !u.confirm || u.assumeYes {
+		return nil
+	}
+
+	if !u.interactive {
+		return fmt.Errorf("-confirm needs a terminal to ask before it %s in %s, use -yes to go ahead without asking", changes, u.directory)
+	}
+
+	confirmed, err := askConfirmation(u.stdin, os.Stderr, fmt.Sprintf("This %s in %s. Type yes to continue: ", changes, u.directory))
+
+	if err != nil {
+		return err
+	}
+
+	if !confirmed {
+		return fmt.Errorf("%s: not confirmed, directory was left untouched", u.directory)
+	}
+
+	return nil
+}
+
+// askConfirmation prints the prompt and tells whether the answer read from r
+// is yes. Anything else, including no answer at all, declines.
+func askConfirmation(r io.Reader, w io.Writer, prompt string) (bool, error) {
+	fmt.Fprint(w, prompt)
+	answer, err := bufio.NewReader(r).ReadString('\n')
+
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+
+	return strings.TrimSpace(answer) == "yes", nil
+}
+
+// isTerminal tells whether the file is a character device other than the
+// null device, like a terminal.
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+
+	null, err := os.Stat(os.DevNull)
+
+	return err != nil || !os.SameFile(info, null)
+}
+
+// CountRemovable counts the files ClearDirectory would delete from the asset
+// directory, leaving out the ones matched by -keep.
+func (u updater) CountRemovable() (int, error) {
+	count := 0
+
+	err := filepath.WalkDir(u.directory, func(filePath string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(u.directory, filePath)
+
+		if err != nil || relPath == "." {
+			return err
+		}
+
+		if u.IsKept(relPath) && d.IsDir() {
+			return filepath.SkipDir
+		}
+
+		if !u.IsKept(relPath) && !d.IsDir() {
+			count++
+		}
+
+		return nil
+	})
+
+	return count, err
+}
+
+// ClearDirectory removes the contents of dir, leaving the directory itself and
+// anything matched by -keep in place. Directories holding kept files survive.
+// Entry types come with the directory listing, so large directories are
+// cleared without a stat per entry.
+func (u updater) ClearDirectory(dir string) error {
+	files, err := os.ReadDir(dir)
+
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		filePath := path.Join(dir, f.Name())
+		relPath, err := filepath.Rel(u.directory, filePath)
+
+		if err != nil {
+			return err
+		}
+
+		if u.IsKept(relPath) {
+			if relPath != stateMarker {
+				fmt.Printf("Keeping %s\n", relPath)
+			}
+
+			continue
+		}
+
+		if f.Type().IsDir() && len(u.keep) > 0 {
+			err := u.ClearDirectory(filePath)
+
+			if err != nil {
+				return err
+			}
+
+			remaining, err := os.ReadDir(filePath)
+
+			if err != nil {
+				return err
+			}
+
+			if len(remaining) == 0 {
+				err := os.Remove(filePath)
+
+				if err != nil {
+					return err
+				}
+			}
+		} else if f.Type().IsDir() {
+			err := os.RemoveAll(filePath)
+
+			if err != nil {
+				return err
+			}
+		} else {
+			err := os.Remove(filePath)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Prune removes every file and empty directory under the target directory that
+// was not extracted from the artifact and is not matched by -keep, returning
+// the relative paths of removed entries.
+func (u updater) Prune(extracted []string) ([]string, error) {
+	var pruned []string
+	var walked []string
+	present := make(map[string]bool, len(extracted))
+
+	for _, filePath := range extracted {
+		present[filepath.Clean(filePath)] = true
+	}
+
+	err := filepath.Walk(u.directory, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if filePath != u.directory {
+			walked = append(walked, filePath)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return pruned, err
+	}
+
+	// Walk deepest entries first so directories are emptied before being checked
+	for i := len(walked) - 1; i >= 0; i-- {
+		filePath := walked[i]
+		relPath, err := filepath.Rel(u.directory, filePath)
+
+		if err != nil {
+			return pruned, err
+		}
+
+		if present[filepath.Clean(filePath)] || u.IsKept(relPath) {
+			continue
+		}
+
+		info, err := os.Lstat(filePath)
+
+		if err != nil {
+			return pruned, err
+		}
+
+		if info.IsDir() {
+			entries, err := os.ReadDir(filePath)
+
+			if err != nil {
+				return pruned, err
+			}
+
+			if len(entries) > 0 {
+				continue
+			}
+		}
+
+		if err := os.Remove(filePath); err != nil {
+			return pruned, err
+		}
+
+		fmt.Printf("Pruned %s\n", relPath)
+		pruned = append(pruned, relPath)
+	}
+
+	return pruned, nil
+}
+
+// ValidateArchive checks the downloaded archive can be extracted before any
+// existing files are removed.
+func (u updater) ValidateArchive(archive string) error {
+	extractor, err := extractorFor(archive)
+
+	if err != nil {
+		return err
+	}
+
+	if err := extractor.Validate(archive, u.directory, u.extractOptions()); err != nil {
+		return &ExtractionError{Archive: archive, Err: err}
+	}
+
+	return nil
+}
+
+func (u updater) extractOptions() extractOptions {
+	options := extractOptions{
+		SkipNewer:   u.skipNewer,
+		SkipCurrent: u.resumeExtract,
+		Subpath:     u.subpath,
+		BestEffort:  u.bestEffort,
+		AllowPaths:  u.allowPaths,
+		Progress:    u.ExtractProgress,
+		Workers:     u.extractWorkers,
+		Verbose:     u.verbose,
+		Umask:       u.umask,
+		LongPaths:   u.longPaths,
+	}
+
+	if u.normalizeEOL {
+		options.NormalizeEOL = func(name string) bool {
+			return matchesGlob(u.textGlobs, name)
+		}
+	}
+
+	return options
+}
+
+// CheckFileCount fails when the number of extracted files, not counting
+// directories, is outside -expect-min-files and -expect-max-files.
+func (u updater) CheckFileCount(filenames []string) error {
+	if u.expectMinFiles == 0 && u.expectMaxFiles == 0 {
+		return nil
+	}
+
+	count := 0
+
+	for _, fileName := range filenames {
+		if info, err := os.Lstat(fileName); err == nil && !info.IsDir() {
+			count++
+		}
+	}
+
+	return u.CheckCount(count)
+}
+
+// CheckCount fails when the number of files is outside -expect-min-files and
+// -expect-max-files.
+func (u updater) CheckCount(count int) error {
+	switch {
+	case u.expectMaxFiles > 0 && count > u.expectMaxFiles:
+		return fmt.Errorf("artifact has %d files, expected at most %d", count, u.expectMaxFiles)
+	case count < u.expectMinFiles:
+		return fmt.Errorf("artifact has %d files, expected at least %d", count, u.expectMinFiles)
+	}
+
+	return nil
+}
+
+// Extract unpacks the archive into dest with the extractor registered for its
+// format and fixes up permissions of the extracted files.
+func (u updater) Extract(archive, dest string) ([]string, error) {
+	extractor, err := extractorFor(archive)
+
+	if err != nil {
+		return nil, err
+	}
+
+	filenames, err := extractor.Extract(archive, dest, u.extractOptions())
+	u.stats.FilesExtracted += len(filenames)
+
+	if err != nil {
+		return filenames, err
+	}
+
+	if err := u.CheckFileCount(filenames); err != nil {
+		return filenames, err
+	}
+
+	if err := u.FixPermissions(dest, filenames); err != nil {
+		return filenames, err
+	}
+
+	created, err := u.EnsureDirectories(dest)
+	filenames = append(filenames, created...)
+
+	if err != nil {
+		return filenames, err
+	}
+
+	if u.permissionsFrom != "" {
+		if err := u.MirrorPermissions(dest, filenames); err != nil {
+			return filenames, err
+		}
+	}
+
+	if u.fsync {
+		fmt.Println("Syncing extracted files to disk")
+		return filenames, syncTree(dest)
+	}
+
+	return filenames, nil
+}
+
+// MirrorPermissions applies the mode and owner of the -permissions-from file
+// to the extracted files and the directories holding them. Directories, and
+// files that were executable, also get the execute bits wherever the mode has
+// the read bits.
+func (u updater) MirrorPermissions(dest string, filenames []string) error {
+	if runtime.GOOS == "windows" {
+		fmt.Println(colorBlue, "Warning: -permissions-from is not supported on Windows, leaving permissions alone", colorReset)
+		return nil
+	}
+
+	reference, err := os.Stat(u.permissionsFrom)
+
+	if err != nil {
+		return err
+	}
+
+	mode := reference.Mode().Perm()
+	executableMode := mode | (mode&0444)>>2
+	uid, gid, hasOwner := fileOwner(reference)
+
+	// Archives don't always have entries for the parent directories
+	paths := make(map[string]bool)
+	root := filepath.Clean(dest)
+
+	for _, filePath := range filenames {
+		for current := filepath.Clean(filePath); current != root && strings.HasPrefix(current, root); current = filepath.Dir(current) {
+			paths[current] = true
+		}
+	}
+
+	for filePath := range paths {
+		info, err := os.Lstat(filePath)
+
+		if err != nil {
+			return err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			continue
+		}
+
+		newMode := mode
+
+		if info.IsDir() || info.Mode()&0111 != 0 {
+			newMode = executableMode
+		}
+
+		if err := os.Chmod(filePath, newMode); err != nil {
+			return err
+		}
+
+		if hasOwner {
+			if err := os.Lchown(filePath, uid, gid); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// fileOwner returns the owner of the file on systems that have one. Reflection
+// keeps this building on Windows, where syscall.Stat_t doesn't exist.
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	sys := reflect.ValueOf(info.Sys())
+
+	if sys.Kind() != reflect.Ptr || sys.IsNil() || sys.Elem().Kind() != reflect.Struct {
+		return 0, 0, false
+	}
+
+	uid := sys.Elem().FieldByName("Uid")
+	gid := sys.Elem().FieldByName("Gid")
+
+	if !uid.IsValid() || !gid.IsValid() {
+		return 0, 0, false
+	}
+
+	return int(uid.Uint()), int(gid.Uint()), true
+}
+
+// EnsureDirectories creates the -ensure-dir directories under dest that the
+// archive didn't bring along and returns their paths.
+func (u updater) EnsureDirectories(dest string) ([]string, error) {
+	var created []string
+
+	for _, dir := range u.ensureDirs {
+		dirPath := filepath.Join(dest, dir)
+
+		if _, err := os.Stat(dirPath); err == nil {
+			created = append(created, dirPath)
+			continue
+		}
+
+		fmt.Printf("Creating directory %s\n", dir)
+
+		if err := os.MkdirAll(dirPath, 0755); err != nil {
+			return created, err
+		}
+
+		created = append(created, dirPath)
+	}
+
+	return created, nil
+}
+
+// FixPermissions sets the execute bits on extracted files matched by
+// -chmod-exec and warns about files that look like executables but can't be
+// executed, which happens when the artifact was zipped without file modes.
+func (u updater) FixPermissions(dest string, filenames []string) error {
+	for _, filePath := range filenames {
+		info, err := os.Lstat(filePath)
+
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		relPath, err := filepath.Rel(dest, filePath)
+
+		if err != nil {
+			return err
+		}
+
+		if u.IsExecutable(relPath) {
+			if err := os.Chmod(filePath, info.Mode().Perm()|0111); err != nil {
+				return err
+			}
+		} else if info.Mode().Perm()&0111 == 0 && looksExecutable(filePath) {
+			fmt.Printf("%sWarning: %s looks like an executable but lacks the execute bit%s\n", colorBlue, relPath, colorReset)
+		}
+	}
+
+	return nil
+}
+
+func (u updater) IsExecutable(relPath string) bool {
+	for _, pattern := range u.chmodExec {
+		if matched, _ := path.Match(pattern, filepath.ToSlash(relPath)); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// looksExecutable checks for an ELF header or a shebang line.
+func looksExecutable(fileName string) bool {
+	file, err := os.Open(fileName)
+
+	if err != nil {
+		return false
+	}
+
+	defer file.Close()
+
+	header := make([]byte, 4)
+	n, _ := io.ReadFull(file, header)
+	header = header[:n]
+
+	return bytes.HasPrefix(header, []byte("\x7fELF")) || bytes.HasPrefix(header, []byte("#!"))
+}
+
+// ReplaceContents extracts the archive directly into the target directory,
+// clearing or merging with the existing contents first.
+func (u updater) ReplaceContents(archive string) error {
+	_, statErr := os.Stat(u.directory)
+	backupPath := ""
+
+	// Reversible deploys ask about the files they actually change
+	if statErr == nil && !u.merge && !u.reversible {
+		if err := u.ConfirmClear(); err != nil {
+			return err
+		}
+	}
+
+	if statErr == nil && u.backup {
+		path, err := u.Backup()
+
+		if err != nil {
+			return err
+		}
+
+		backupPath = path
+	}
+
+	var err error
+
+	if u.reversible {
+		err = u.ReplaceReversible(archive, statErr == nil)
+	} else if u.ChecksStaged() {
+		err = u.ReplaceStaged(archive, statErr == nil)
+	} else {
+		err = u.replaceInPlace(archive, statErr)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if u.diffSummary {
+		if backupPath == "" {
+			fmt.Println("No backup of the previous contents, skipping diff summary")
+		} else if err := u.PrintDiffSummary(backupPath, u.directory); err != nil {
+			return err
+		}
+	}
+
+	if u.backup && u.keepBackups > 0 {
+		return u.PruneBackups()
+	}
+
+	return nil
+}
+
+// ReplaceStaged prepares the new contents in a staging directory next to the
+// asset directory, starting from a copy of the current contents, and swaps it
+// into place only when CheckStaged passes.
+func (u updater) ReplaceStaged(archive string, exists bool) error {
+	parent := filepath.Dir(filepath.Clean(u.directory))
+
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return err
+	}
+
+	staging, err := os.MkdirTemp(parent, "."+filepath.Base(u.directory)+".staging-")
+
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		fmt.Printf("Copying catalog contents into %s\n", staging)
+		err = copyTree(u.directory, staging)
+	} else {
+		// TempDir creates the directory with 0700
+		err = os.Chmod(staging, 0755)
+	}
+
+	if err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+
+	target := u
+	target.directory = staging
+
+	if err := target.replaceInPlace(archive, nil); err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+
+	if err := u.CheckStaged(staging); err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+
+	previous, err := swapDirectory(staging, u.directory)
+
+	if err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+
+	if previous != "" {
+		return os.RemoveAll(previous)
+	}
+
+	return nil
+}
+
+// ChecksStaged tells whether the extracted contents are checked by
+// -validate-cmd or -scan-cmd before they are deployed.
+func (u updater) ChecksStaged() bool {
+	return u.validateCmd != "" || u.scanCmd != ""
+}
+
+// CheckStaged runs -validate-cmd and -scan-cmd on the directory holding the
+// extracted contents before they are deployed. A failed scan moves the
+// directory into quarantine.
+func (u updater) CheckStaged(dir string) error {
+	if u.validateCmd != "" {
+		if err := u.RunValidateCommand(dir); err != nil {
+			return err
+		}
+	}
+
+	if u.scanCmd != "" {
+		return u.Scan(dir)
+	}
+
+	return nil
+}
+
+// QuarantineDirectory returns where staged contents failing -scan-cmd are
+// moved to, defaulting to a sibling of the asset directory.
+func (u updater) QuarantineDirectory() string {
+	if u.quarantineDir != "" {
+		return u.quarantineDir
+	}
+
+	return filepath.Clean(u.directory) + ".quarantine"
+}
+
+// Scan runs -scan-cmd with sh in the directory holding the extracted contents
+// and prints its output. When the scan fails the directory is moved into a
+// new timestamped directory under QuarantineDirectory for review.
+func (u updater) Scan(dir string) error {
+	fmt.Println("Running scan command:", u.scanCmd)
+
+	cmd := exec.Command("sh", "-c", u.scanCmd)
+	cmd.Dir = dir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"UPDATER_DIRECTORY="+u.directory,
+		"UPDATER_STAGING_DIRECTORY="+dir,
+	)
+
+	scanErr := cmd.Run()
+
+	if scanErr == nil {
+		fmt.Println("Scan passed")
+		return nil
+	}
+
+	quarantinePath := filepath.Join(u.QuarantineDirectory(), time.Now().UTC().Format("20060102150405"))
+
+	if err := os.MkdirAll(u.QuarantineDirectory(), 0700); err != nil {
+		return fmt.Errorf("scan failed (%s) and quarantining the files failed: %w", scanErr, err)
+	}
+
+	if err := moveDirectory(dir, quarantinePath); err != nil {
+		return fmt.Errorf("scan failed (%s) and quarantining the files failed: %w", scanErr, err)
+	}
+
+	fmt.Printf("Quarantined the scanned files in %s\n", quarantinePath)
+
+	return fmt.Errorf("scan failed, nothing was deployed and the files were quarantined in %s: %w", quarantinePath, scanErr)
+}
+
+// RunValidateCommand runs -validate-cmd with sh in the directory holding the
+// extracted contents before they are deployed. Its output is only shown when
+// it fails or with -verbose.
+func (u updater) RunValidateCommand(dir string) error {
+	fmt.Println("Running validate command:", u.validateCmd)
+
+	cmd := exec.Command("sh", "-c", u.validateCmd)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"UPDATER_DIRECTORY="+u.directory,
+		"UPDATER_STAGING_DIRECTORY="+dir,
+	)
+	output, err := cmd.CombinedOutput()
+
+	if err != nil && len(output) > 0 {
+		return fmt.Errorf("validate command failed, nothing was deployed: %w\n%s", err, strings.TrimRight(string(output), "\n"))
+	}
+
+	if err != nil {
+		return fmt.Errorf("validate command failed, nothing was deployed: %w", err)
+	}
+
+	if u.verbose && len(output) > 0 {
+		os.Stdout.Write(output)
+	}
+
+	return nil
+}
+
+// replaceInPlace clears the asset directory, unless merging, and extracts the
+// archive into it.
+func (u updater) replaceInPlace(archive string, statErr error) error {
+	if os.IsNotExist(statErr) {
+		fmt.Println("Directory doesn't exist, creating one")
+		mkdirError := os.MkdirAll(u.directory, 0755)
+
+		if mkdirError != nil {
+			return mkdirError
+		}
+	} else if u.merge {
+		fmt.Println("Merging archive contents into existing catalog")
+	} else {
+		fmt.Println("Removing catalog contents")
+		err := u.ClearDirectory(u.directory)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("Extracting archive contents")
+	filenames, unzipErr := u.Extract(archive, u.directory)
+
+	if unzipErr != nil {
+		return unzipErr
+	}
+
+	if u.merge && u.prune {
+		pruned, err := u.Prune(filenames)
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Pruned %d entries not present in the artifact\n", len(pruned))
+	}
+
+	return nil
+}
+
+// BackupDirectory returns where backups of the asset directory are kept,
+// defaulting to a sibling named after it.
+func (u updater) BackupDirectory() string {
+	if u.backupDir != "" {
+		return u.backupDir
+	}
+
+	return filepath.Clean(u.directory) + ".backups"
+}
+
+// backupTimestamp names backups after the time they were taken, down to the
+// nanosecond so that two backups within a second don't share a directory.
+const backupTimestamp = "20060102150405.000000000"
+
+// backupName matches the names Backup gives, raw or compressed, and the ones
+// of second precision earlier versions gave.
+var backupName = regexp.MustCompile(`^\d{14}(\.\d{9})?(\.tar\.gz)?$`)
+
+// Backup copies the current directory contents into a new timestamped
+// directory under BackupDirectory and returns its path.
+func (u updater) Backup() (string, error) {
+	backupPath := filepath.Join(u.BackupDirectory(), time.Now().UTC().Format(backupTimestamp))
+	copyFn := copyTree
+
+	if u.compressBackups {
+		backupPath += compressedBackupSuffix
+		copyFn = writeTarGz
+	}
+
+	if err := os.MkdirAll(u.BackupDirectory(), 0755); err != nil {
+		return "", err
+	}
+
+	fmt.Printf("Backing up catalog contents to %s\n", backupPath)
+
+	if err := copyFn(u.directory, backupPath); err != nil {
+		os.RemoveAll(backupPath)
+		return "", err
+	}
+
+	return backupPath, nil
+}
+
+const compressedBackupSuffix = ".tar.gz"
+
+// LatestBackup returns the path of the most recent backup, raw or compressed.
+// Other files in the backup directory are ignored.
+func (u updater) LatestBackup() (string, error) {
+	backups, err := timestampedEntries(u.BackupDirectory(), matchesName(backupName))
+
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if len(backups) == 0 {
+		return "", fmt.Errorf("no backups found in %s", u.BackupDirectory())
+	}
+
+	return filepath.Join(u.BackupDirectory(), backups[len(backups)-1]), nil
+}
+
+// Rollback replaces the directory contents with the most recent backup.
+func (u updater) Rollback() error {
+	backupPath, err := u.LatestBackup()
+
+	if err != nil {
+		return err
+	}
+
+	if err := u.CheckDirectory(); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(u.directory); err == nil {
+		if err := u.ConfirmClear(); err != nil {
+			return err
+		}
+
+		fmt.Println("Removing catalog contents")
+
+		if err := u.ClearDirectory(u.directory); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Restoring backup %s\n", backupPath)
+
+	if strings.HasSuffix(backupPath, compressedBackupSuffix) {
+		return extractTarGz(backupPath, u.directory)
+	}
+
+	return copyTree(backupPath, u.directory)
+}
+
+// hashBackup hashes the files of a backup like hashTree, reading compressed
+// backups without unpacking them.
+func hashBackup(backupPath string) (map[string]string, error) {
+	if !strings.HasSuffix(backupPath, compressedBackupSuffix) {
+		return hashTree(backupPath)
+	}
+
+	hashes := make(map[string]string)
+	err := walkTarGz(backupPath, func(header *tar.Header, r io.Reader) error {
+		hash := sha256.New()
+
+		switch header.Typeflag {
+		case tar.TypeReg:
+			if _, err := io.Copy(hash, r); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			io.WriteString(hash, "symlink:"+header.Linkname)
+		case tar.TypeLink:
+			// Hard links share the content of an earlier entry
+			if linked, ok := hashes[path.Clean(header.Linkname)]; ok {
+				hashes[path.Clean(header.Name)] = linked
+			}
+
+			return nil
+		default:
+			return nil
+		}
+
+		hashes[path.Clean(header.Name)] = hex.EncodeToString(hash.Sum(nil))
+
+		return nil
+	})
+
+	return hashes, err
+}
+
+// writeTarGz packs the tree under src into a gzip compressed tarball at dst.
+func writeTarGz(src, dst string) error {
+	file, err := os.Create(dst)
+
+	if err != nil {
+		return err
+	}
+
+	gzipWriter := gzip.NewWriter(file)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	err = filepath.Walk(src, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(src, filePath)
+
+		if err != nil || relPath == "." {
+			return err
+		}
+
+		return addTarEntry(tarWriter, filePath, filepath.ToSlash(relPath), info)
+	})
+
+	for _, closer := range []io.Closer{tarWriter, gzipWriter, file} {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+// addTarEntry writes the file, directory or symlink at filePath into the
+// tarball under the given name.
+func addTarEntry(tarWriter *tar.Writer, filePath, name string, info os.FileInfo) error {
+	link := ""
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+
+		if link, err = os.Readlink(filePath); err != nil {
+			return err
+		}
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+
+	if err != nil {
+		return err
+	}
+
+	header.Name = name
+
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	in, err := os.Open(filePath)
+
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	_, err = io.Copy(tarWriter, in)
+
+	return err
+}
+
+// walkTarGz calls fn for every entry of a gzip compressed tarball.
+func walkTarGz(src string, fn func(header *tar.Header, r io.Reader) error) error {
+	file, err := os.Open(src)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	gzipReader, err := gzip.NewReader(file)
+
+	if err != nil {
+		return err
+	}
+
+	defer gzipReader.Close()
+
+	tarReader := tar.NewReader(gzipReader)
+
+	for {
+		header, err := tarReader.Next()
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err := fn(header, tarReader); err != nil {
+			return err
+		}
+	}
+}
+
+// extractTarGz unpacks a gzip compressed tarball into dest, restoring modes,
+// modification times, symlinks and hard links. Entries and the targets of
+// links have to be inside dest, as checked by tarGzExtractor.
+func extractTarGz(src, dest string) error {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	return walkTarGz(src, func(header *tar.Header, r io.Reader) error {
+		name, filePath, err := tarEntryPath(header, dest, extractOptions{})
+
+		if err != nil || filePath == "" {
+			return err
+		}
+
+		if err := checkTarLink(header, filePath, dest, extractOptions{}); err != nil {
+			return err
+		}
+
+		if header.Typeflag != tar.TypeDir {
+			_, err := writeTarEntry(header, r, name, filePath, dest, extractOptions{})
+			return err
+		}
+
+		if err := os.MkdirAll(filePath, os.FileMode(header.Mode).Perm()|0700); err != nil {
+			return err
+		}
+
+		return os.Chtimes(filePath, header.ModTime, header.ModTime)
+	})
+}
+
+// PatchDirectory returns where the patches recorded by -reversible are kept,
+// defaulting to a sibling named after the asset directory.
+func (u updater) PatchDirectory() string {
+	if u.patchDir != "" {
+		return u.patchDir
+	}
+
+	return filepath.Clean(u.directory) + ".patches"
+}
+
+const patchSuffix = ".patch.tar.gz"
+
+// patchOperation is a single file operation of a reversible patch. SHA256 is
+// the hash of the content written by create and overwrite, as hashTree
+// computes it, so -revert can tell when the file changed since. Mode is the
+// permissions of the directory made by mkdir or removed by rmdir.
+type patchOperation struct {
+	Op     string      `json:"op"`
+	Path   string      `json:"path"`
+	SHA256 string      `json:"sha256,omitempty"`
+	Mode   os.FileMode `json:"mode,omitempty"`
+}
+
+// reversiblePatch lists the operations a -reversible deploy applied. The
+// patch file is a gzip compressed tarball holding it as patch.json, followed
+// by the previous contents of the overwritten and deleted files, and of the
+// state marker, under previous/.
+type reversiblePatch struct {
+	Directory     string           `json:"directory"`
+	CreatedAt     string           `json:"created_at"`
+	PreviousState bool             `json:"previous_state"`
+	Operations    []patchOperation `json:"operations"`
+}
+
+// ComputePatch compares the current contents of the asset directory with the
+// extracted archive in staging and returns the operations reaching the
+// latter: deletes, rmdir of the directories left empty, mkdir of the new
+// directories, including empty ones and -ensure-dir, then creates and
+// overwrites. Files matched by -keep are never deleted.
+func (u updater) ComputePatch(staging string, exists bool) (reversiblePatch, error) {
+	directory, err := filepath.Abs(u.directory)
+
+	if err != nil {
+		return reversiblePatch{}, err
+	}
+
+	patch := reversiblePatch{Directory: directory, CreatedAt: time.Now().UTC().Format(time.RFC3339)}
+	current := make(map[string]string)
+	currentDirs := make(map[string]os.FileMode)
+
+	if exists {
+		hashes, err := hashTree(u.directory)
+
+		if err != nil {
+			return patch, err
+		}
+
+		dirs, err := listDirectories(u.directory)
+
+		if err != nil {
+			return patch, err
+		}
+
+		current, currentDirs = hashes, dirs
+	}
+
+	next, err := hashTree(staging)
+
+	if err != nil {
+		return patch, err
+	}
+
+	nextDirs, err := listDirectories(staging)
+
+	if err != nil {
+		return patch, err
+	}
+
+	var kept []string
+
+	for _, relPath := range sortedKeys(current) {
+		if _, ok := next[relPath]; ok {
+			continue
+		}
+
+		if u.IsKept(relPath) {
+			kept = append(kept, relPath)
+		} else {
+			patch.Operations = append(patch.Operations, patchOperation{Op: "delete", Path: relPath})
+		}
+	}
+
+	// Children sort after their parents, so going backwards empties them first
+	currentNames := sortedDirs(currentDirs)
+
+	for i := len(currentNames) - 1; i >= 0; i-- {
+		relPath := currentNames[i]
+
+		if _, ok := nextDirs[relPath]; ok || u.IsKept(relPath) || holdsAny(relPath, kept) {
+			continue
+		}
+
+		patch.Operations = append(patch.Operations, patchOperation{Op: "rmdir", Path: relPath, Mode: currentDirs[relPath]})
+	}
+
+	for _, relPath := range sortedDirs(nextDirs) {
+		if _, ok := currentDirs[relPath]; !ok {
+			patch.Operations = append(patch.Operations, patchOperation{Op: "mkdir", Path: relPath, Mode: nextDirs[relPath]})
+		}
+	}
+
+	for _, relPath := range sortedKeys(next) {
+		hash, ok := current[relPath]
+
+		if !ok {
+			patch.Operations = append(patch.Operations, patchOperation{Op: "create", Path: relPath, SHA256: next[relPath]})
+			continue
+		}
+
+		same, err := sameMode(filepath.Join(u.directory, relPath), filepath.Join(staging, relPath))
+
+		if err != nil {
+			return patch, err
+		}
+
+		if hash != next[relPath] || !same {
+			patch.Operations = append(patch.Operations, patchOperation{Op: "overwrite", Path: relPath, SHA256: next[relPath]})
+		}
+	}
+
+	if _, err := os.Lstat(filepath.Join(u.directory, stateMarker)); err == nil {
+		patch.PreviousState = true
+	}
+
+	return patch, nil
+}
+
+// listDirectories returns the permissions of the directories under root by
+// slash separated path.
+func listDirectories(root string) (map[string]os.FileMode, error) {
+	dirs := make(map[string]os.FileMode)
+
+	err := filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() || filePath == root {
+			return err
+		}
+
+		relPath, err := filepath.Rel(root, filePath)
+
+		if err != nil {
+			return err
+		}
+
+		dirs[filepath.ToSlash(relPath)] = info.Mode().Perm()
+
+		return nil
+	})
+
+	return dirs, err
+}
+
+func sortedDirs(dirs map[string]os.FileMode) []string {
+	names := make([]string, 0, len(dirs))
+
+	for name := range dirs {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// holdsAny tells whether one of the slash separated paths is inside dir.
+func holdsAny(dir string, paths []string) bool {
+	for _, relPath := range paths {
+		if strings.HasPrefix(relPath, dir+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func sameMode(a, b string) (bool, error) {
+	aInfo, err := os.Lstat(a)
+
+	if err != nil {
+		return false, err
+	}
+
+	bInfo, err := os.Lstat(b)
+
+	if err != nil {
+		return false, err
+	}
+
+	return aInfo.Mode() == bInfo.Mode(), nil
+}
+
+// WritePatch records the patch and the previous contents of the files it
+// replaces or deletes into a new file under PatchDirectory, returning its
+// path.
+func (u updater) WritePatch(patch reversiblePatch) (string, error) {
+	if err := os.MkdirAll(u.PatchDirectory(), 0755); err != nil {
+		return "", err
+	}
+
+	fileName := filepath.Join(u.PatchDirectory(), time.Now().UTC().Format("20060102150405")+patchSuffix)
+	body, err := json.MarshalIndent(patch, "", "  ")
+
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.Create(fileName)
+
+	if err != nil {
+		return "", err
+	}
+
+	gzipWriter := gzip.NewWriter(file)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	err = tarWriter.WriteHeader(&tar.Header{Name: "patch.json", Mode: 0644, Size: int64(len(body)), ModTime: time.Now()})
+
+	if err == nil {
+		_, err = tarWriter.Write(body)
+	}
+
+	previous := []string{}
+
+	for _, operation := range patch.Operations {
+		if operation.Op == "overwrite" || operation.Op == "delete" {
+			previous = append(previous, operation.Path)
+		}
+	}
+
+	if patch.PreviousState {
+		previous = append(previous, stateMarker)
+	}
+
+	for _, relPath := range previous {
+		if err != nil {
+			break
+		}
+
+		filePath := filepath.Join(u.directory, filepath.FromSlash(relPath))
+		var info os.FileInfo
+
+		if info, err = os.Lstat(filePath); err == nil {
+			err = addTarEntry(tarWriter, filePath, "previous/"+relPath, info)
+		}
+	}
+
+	for _, closer := range []io.Closer{tarWriter, gzipWriter, file} {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	if err != nil {
+		os.Remove(fileName)
+		return "", err
+	}
+
+	return fileName, nil
+}
+
+// ReplaceReversible extracts the archive into a staging directory next to the
+// asset directory and applies only the file operations needed to reach it,
+// recording them in a patch first so -revert can undo exactly those.
+func (u updater) ReplaceReversible(archive string, exists bool) error {
+	if !exists {
+		fmt.Println("Directory doesn't exist, creating one")
+	}
+
+	if err := os.MkdirAll(u.directory, 0755); err != nil {
+		return err
+	}
+
+	parent := filepath.Dir(filepath.Clean(u.directory))
+
+	staging, err := os.MkdirTemp(parent, "."+filepath.Base(u.directory)+".staging-")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(staging)
+
+	target := u
+	target.directory = staging
+
+	fmt.Println("Extracting archive contents")
+
+	if _, err := target.Extract(archive, staging); err != nil {
+		return err
+	}
+
+	if err := u.CheckStaged(staging); err != nil {
+		return err
+	}
+
+	patch, err := u.ComputePatch(staging, exists)
+
+	if err != nil {
+		return err
+	}
+
+	counts := make(map[string]int)
+
+	for _, operation := range patch.Operations {
+		counts[operation.Op]++
+	}
+
+	if counts["overwrite"] > 0 || counts["delete"] > 0 {
+		if err := u.ConfirmChanges(fmt.Sprintf("creates %d, overwrites %d and deletes %d files", counts["create"], counts["overwrite"], counts["delete"])); err != nil {
+			return err
+		}
+	}
+
+	patchFile, err := u.WritePatch(patch)
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Recorded %d file operations in %s\n", len(patch.Operations), patchFile)
+
+	for _, operation := range patch.Operations {
+		filePath := filepath.Join(u.directory, filepath.FromSlash(operation.Path))
+
+		switch operation.Op {
+		case "delete", "rmdir":
+			if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		case "mkdir":
+			if err := os.Mkdir(filePath, operation.Mode); err != nil {
+				return err
+			}
+
+			// Mkdir applies the umask of the process
+			if err := os.Chmod(filePath, operation.Mode); err != nil {
+				return err
+			}
+		default:
+			if err := os.Rename(filepath.Join(staging, filepath.FromSlash(operation.Path)), filePath); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Revert undoes the file operations recorded in a patch of -reversible,
+// restoring the overwritten and deleted files and the previous state
+// marker. Files changed since the patch was applied are only reverted with
+// -force.
+func (u updater) Revert(patchFile string) error {
+	if err := u.CheckDirectory(); err != nil {
+		return err
+	}
+
+	parent := filepath.Dir(filepath.Clean(u.directory))
+	unpacked, err := os.MkdirTemp(parent, "."+filepath.Base(u.directory)+".revert-")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(unpacked)
+
+	if err := extractTarGz(patchFile, unpacked); err != nil {
+		return fmt.Errorf("reading patch %s failed: %w", patchFile, err)
+	}
+
+	body, err := os.ReadFile(filepath.Join(unpacked, "patch.json"))
+
+	if err != nil {
+		return fmt.Errorf("reading patch %s failed: %w", patchFile, err)
+	}
+
+	var patch reversiblePatch
+
+	if err := json.Unmarshal(body, &patch); err != nil {
+		return fmt.Errorf("reading patch %s failed: %w", patchFile, err)
+	}
+
+	current, err := hashTree(u.directory)
+
+	if err != nil {
+		return err
+	}
+
+	directory, err := filepath.Abs(u.directory)
+
+	if err != nil {
+		return err
+	}
+
+	if recorded, err := filepath.Abs(patch.Directory); err != nil || recorded != directory {
+		return fmt.Errorf("patch %s was recorded for %s, not %s", patchFile, patch.Directory, directory)
+	}
+
+	if !u.force {
+		for _, operation := range patch.Operations {
+			if (operation.Op == "create" || operation.Op == "overwrite") && current[operation.Path] != operation.SHA256 {
+				return fmt.Errorf("%s changed since the patch was applied, use -force to revert anyway", operation.Path)
+			}
+		}
+	}
+
+	fmt.Printf("Reverting %d file operations of %s\n", len(patch.Operations), patchFile)
+
+	for i := len(patch.Operations) - 1; i >= 0; i-- {
+		operation := patch.Operations[i]
+		filePath := filepath.Join(u.directory, filepath.FromSlash(operation.Path))
+
+		// Same ZipSlip check as in unzip
+		if !strings.HasPrefix(filePath, filepath.Clean(u.directory)+string(os.PathSeparator)) {
+			return fmt.Errorf("%s: illegal file path", filePath)
+		}
+
+		switch operation.Op {
+		case "create", "overwrite", "mkdir":
+			if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+
+		switch operation.Op {
+		case "rmdir":
+			if err := os.MkdirAll(filePath, operation.Mode); err != nil {
+				return err
+			}
+
+			if err := os.Chmod(filePath, operation.Mode); err != nil {
+				return err
+			}
+		case "overwrite", "delete":
+			if err := os.Rename(filepath.Join(unpacked, "previous", filepath.FromSlash(operation.Path)), filePath); err != nil {
+				return err
+			}
+		}
+	}
+
+	marker := filepath.Join(u.directory, stateMarker)
+
+	if patch.PreviousState {
+		return os.Rename(filepath.Join(unpacked, "previous", stateMarker), marker)
+	}
+
+	if err := os.Remove(marker); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// PruneBackups removes the oldest backups beyond -keep-backups.
+func (u updater) PruneBackups() error {
+	return pruneOldest(u.BackupDirectory(), u.keepBackups, "backup", backupName)
+}
+
+// pruneOldest removes all but the keep newest entries of dir whose names match
+// the pattern, which has to start them with a timestamp. Entries named
+// otherwise are left alone.
+func pruneOldest(dir string, keep int, kind string, pattern *regexp.Regexp) error {
+	names, err := timestampedEntries(dir, matchesName(pattern))
+
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(names)-keep; i++ {
+		fmt.Printf("Removing old %s %s\n", kind, names[i])
+
+		if err := os.RemoveAll(filepath.Join(dir, names[i])); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// timestampedEntries returns the names of the entries of dir that match,
+// oldest first. ReadDir returns entries sorted by name, and names starting
+// with a timestamp of fixed width sort chronologically.
+func timestampedEntries(dir string, matches func(os.DirEntry) bool) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+
+	for _, entry := range entries {
+		if matches(entry) {
+			names = append(names, entry.Name())
+		}
+	}
+
+	return names, nil
+}
+
+func matchesName(pattern *regexp.Regexp) func(os.DirEntry) bool {
+	return func(entry os.DirEntry) bool {
+		return pattern.MatchString(entry.Name())
+	}
+}
+
+// syncTree flushes every file and directory under root, and root's entry in
+// its parent, to disk. Windows can't sync directories, only files are synced
+// there.
+func syncTree(root string) error {
+	err := filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() || (info.IsDir() && runtime.GOOS != "windows") {
+			return syncFile(filePath)
+		}
+
+		return nil
+	})
+
+	if err != nil || runtime.GOOS == "windows" {
+		return err
+	}
+
+	return syncFile(filepath.Dir(filepath.Clean(root)))
+}
+
+func syncFile(fileName string) error {
+	file, err := os.Open(fileName)
+
+	if err != nil {
+		return err
+	}
+
+	err = file.Sync()
+	closeErr := file.Close()
+
+	if err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// copyTree recursively copies src to dst, preserving modes, modification
+// times and symlinks.
+func copyTree(src, dst string) error {
+	var dirs []string
+	var dirInfos []os.FileInfo
+
+	err := filepath.Walk(src, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(src, filePath)
+
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dst, relPath)
+
+		switch {
+		case info.IsDir():
+			dirs = append(dirs, target)
+			dirInfos = append(dirInfos, info)
+
+			return os.MkdirAll(target, 0700)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(filePath)
+
+			if err != nil {
+				return err
+			}
+
+			return os.Symlink(link, target)
+		}
+
+		if err := copyFile(filePath, target, info.Mode().Perm()); err != nil {
+			return err
+		}
+
+		// The mode passed when creating the file is subject to umask
+		if err := os.Chmod(target, info.Mode().Perm()); err != nil {
+			return err
+		}
+
+		return os.Chtimes(target, info.ModTime(), info.ModTime())
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// Directories get their modes and times once their contents are copied,
+	// deepest first, as copying into them changes both
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i], dirInfos[i].Mode().Perm()); err != nil {
+			return err
+		}
+
+		if err := os.Chtimes(dirs[i], dirInfos[i].ModTime(), dirInfos[i].ModTime()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// moveDirectory renames src to dst, falling back to copying and removing src
+// when they are on different file systems, like a tmpfs and a mounted volume.
+// Unlike the rename, the fallback isn't atomic.
+func moveDirectory(src, dst string) error {
+	err := os.Rename(src, dst)
+
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	fmt.Printf("%s is on another file system than %s, copying instead\n", src, dst)
+
+	if err := copyTree(src, dst); err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+
+	return os.RemoveAll(src)
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// hashTree returns the SHA-256 of every file under root keyed by its slash
+// separated relative path. Symlinks are hashed by their target.
+func hashTree(root string) (map[string]string, error) {
+	hashes := make(map[string]string)
+
+	err := filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(root, filePath)
+
+		if err != nil || relPath == stateMarker {
+			return err
+		}
+
+		hash := sha256.New()
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err := os.Readlink(filePath)
+
+			if err != nil {
+				return err
+			}
+
+			io.WriteString(hash, "symlink:"+link)
+		} else {
+			file, err := os.Open(filePath)
+
+			if err != nil {
+				return err
+			}
+
+			_, err = io.Copy(hash, file)
+			file.Close()
+
+			if err != nil {
+				return err
+			}
+		}
+
+		hashes[filepath.ToSlash(relPath)] = hex.EncodeToString(hash.Sum(nil))
+
+		return nil
+	})
+
+	return hashes, err
+}
+
+// treeDigest combines the file hashes of hashTree into a single digest of the
+// whole tree, recorded in the state marker.
+func treeDigest(hashes map[string]string) string {
+	paths := make([]string, 0, len(hashes))
+
+	for relPath := range hashes {
+		paths = append(paths, relPath)
+	}
+
+	sort.Strings(paths)
+	hash := sha256.New()
+
+	for _, relPath := range paths {
+		fmt.Fprintf(hash, "%s\x00%s\n", relPath, hashes[relPath])
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+type treeDiff struct {
+	Added   []string `json:"added"`
+	Changed []string `json:"changed"`
+	Removed []string `json:"removed"`
+}
+
+func (d treeDiff) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Changed) == 0 && len(d.Removed) == 0
+}
+
+// diffTrees compares two results of hashTree.
+func diffTrees(before, after map[string]string) treeDiff {
+	var diff treeDiff
+
+	for relPath, hash := range after {
+		previous, existed := before[relPath]
+
+		if !existed {
+			diff.Added = append(diff.Added, relPath)
+		} else if previous != hash {
+			diff.Changed = append(diff.Changed, relPath)
+		}
+	}
+
+	for relPath := range before {
+		if _, exists := after[relPath]; !exists {
+			diff.Removed = append(diff.Removed, relPath)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Changed)
+	sort.Strings(diff.Removed)
+
+	return diff
+}
+
+// PrintDiffSummary prints how the directory contents changed compared to the
+// backup, listing every file in verbose mode.
+func (u updater) PrintDiffSummary(backupPath, directory string) error {
+	before, err := hashBackup(backupPath)
+
+	if err != nil {
+		return err
+	}
+
+	after, err := hashTree(directory)
+
+	if err != nil {
+		return err
+	}
+
+	u.PrintTreeDiff(diffTrees(before, after))
+
+	return nil
+}
+
+// PrintTreeDiff prints the number of added, changed and removed files,
+// listing every file in verbose mode.
+func (u updater) PrintTreeDiff(diff treeDiff) {
+	fmt.Printf("Changes: %d added, %d changed, %d removed\n", len(diff.Added), len(diff.Changed), len(diff.Removed))
+
+	if u.verbose {
+		for _, relPath := range diff.Added {
+			fmt.Printf("  + %s\n", relPath)
+		}
+
+		for _, relPath := range diff.Changed {
+			fmt.Printf("  ~ %s\n", relPath)
+		}
+
+		for _, relPath := range diff.Removed {
+			fmt.Printf("  - %s\n", relPath)
+		}
+	}
+}
+
+const releasesDirectory string = "releases"
+const currentSymlink string = "current"
+
+// DeployRelease extracts the archive into a new timestamped directory under
+// `releases` and then repoints the `current` symlink to it, so the live
+// directory is never cleared or partially written.
+func (u updater) DeployRelease(archive string) error {
+	releaseName := time.Now().UTC().Format("20060102150405")
+	releasesPath := filepath.Join(u.directory, releasesDirectory)
+	releasePath := filepath.Join(releasesPath, releaseName)
+
+	if err := os.MkdirAll(releasesPath, 0755); err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(releasePath, 0755); err != nil {
+		return err
+	}
+
+	fmt.Printf("Extracting archive contents into release %s\n", releaseName)
+	_, unzipErr := u.Extract(archive, releasePath)
+
+	if unzipErr == nil && u.ChecksStaged() {
+		unzipErr = u.CheckStaged(releasePath)
+	}
+
+	if unzipErr != nil {
+		// A rejected or partial release is never pointed to, don't keep it
+		os.RemoveAll(releasePath)
+		return unzipErr
+	}
+
+	fmt.Printf("Pointing `%s` to release %s\n", currentSymlink, releaseName)
+	err := swapSymlink(filepath.Join(releasesDirectory, releaseName), filepath.Join(u.directory, currentSymlink))
+
+	if err != nil {
+		return err
+	}
+
+	if u.keepReleases > 0 {
+		return u.PruneReleases()
+	}
+
+	return nil
+}
+
+// PruneReleases removes the oldest release directories beyond -keep-releases,
+// never touching the release `current` points to.
+func (u updater) PruneReleases() error {
+	releasesPath := filepath.Join(u.directory, releasesDirectory)
+	releases, err := timestampedEntries(releasesPath, os.DirEntry.IsDir)
+
+	if err != nil {
+		return err
+	}
+
+	current, _ := os.Readlink(filepath.Join(u.directory, currentSymlink))
+
+	for i := 0; i < len(releases)-u.keepReleases; i++ {
+		if filepath.Join(releasesDirectory, releases[i]) == current {
+			continue
+		}
+
+		fmt.Printf("Removing old release %s\n", releases[i])
+
+		if err := os.RemoveAll(filepath.Join(releasesPath, releases[i])); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// swapSymlink atomically points link at target by creating a temporary symlink
+// and renaming it over the existing one. rename(2) replaces the destination in
+// a single step on POSIX systems, so readers see either the old or new target.
+func swapSymlink(target, link string) error {
+	if info, err := os.Lstat(link); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		return fmt.Errorf("%s: exists and is not a symlink", link)
+	}
+
+	tmp := link + ".tmp"
+	os.Remove(tmp)
+
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// DownloadLogs stores the logs of the workflow run that produced the artifact
+// next to the asset directory. Missing or expired logs only produce a warning.
+func (u updater) DownloadLogs(artifact artifact) {
+	if artifact.WorkflowRun == nil {
+		fmt.Println(colorBlue, "Artifact has no workflow run information, skipping logs", colorReset)
+		return
+	}
+
+	fileName := fmt.Sprintf("%s.run-%d-logs.zip", filepath.Clean(u.directory), artifact.WorkflowRun.ID)
+	fmt.Printf("Downloading logs of workflow run %d\n", artifact.WorkflowRun.ID)
+
+	if err := u.DownloadFile(u.RunLogsURL(artifact.WorkflowRun.ID), fileName, 0); err != nil {
+		fmt.Println(colorBlue, "Unable to download workflow run logs:", err, colorReset)
+		return
+	}
+
+	fmt.Printf("Workflow run logs saved to %s\n", fileName)
+}
+
+// Download checks that the artifact is still available and downloads its
+// archive into fileName.
+func (u updater) Download(artifact artifact, fileName string) error {
+	if artifact.IsExpired() {
+		expiresAt := artifact.ExpiresAt
+
+		if parsed, err := artifact.ExpiresAtTime(); err == nil {
+			expiresAt = parsed.Format("2006-01-02 15:04:05 MST")
+		}
+
+		if u.failOnExpired {
+			return fmt.Errorf("artifact `%s` (%d) expired on %s", artifact.Name, artifact.ID, expiresAt)
+		}
+
+		fmt.Println(colorBlue, "Warning: artifact expired on", expiresAt, "and the download is likely to fail", colorReset)
+	}
+
+	sizeValue, sizeSuffix := artifact.Size()
+
+	fmt.Printf("Downloading artifact archive `%s` (%.2f %s) created at %s\n", artifact.Name, sizeValue, sizeSuffix, artifact.CreatedAt)
+	fmt.Printf("Artifact location URL: %s\n", artifact.ArchiveDownloadURL)
+	fmt.Println("Please be patient ...")
+	err := u.DownloadFile(artifact.ArchiveDownloadURL, fileName, int64(artifact.SizeInBytes))
+
+	if err != nil {
+		return err
+	}
+
+	// Archives streamed to standard output are gone by now
+	if artifact.Digest != "" && fileName != stdoutFile {
+		if err := verifyDigest(artifact.Digest, fileName); err != nil {
+			os.Remove(fileName)
+			return err
+		}
+	}
+
+	if u.publicKey != nil {
+		fmt.Println("Verifying archive signature")
+
+		if err := u.VerifySignature(artifact, fileName); err != nil {
+			os.Remove(fileName)
+			return fmt.Errorf("signature verification failed: %w", err)
+		}
+	}
+
+	if u.withLogs {
+		u.DownloadLogs(artifact)
+	}
+
+	return nil
+}
+
+// SignatureURL resolves the {name} and {id} placeholders of -sig-url.
+func (u updater) SignatureURL(artifact artifact) string {
+	return strings.NewReplacer("{name}", artifact.Name, "{id}", strconv.Itoa(artifact.ID)).Replace(u.signatureURL)
+}
+
+// VerifySignature checks the detached signature of the downloaded archive
+// against -public-key. The signature may be raw or base64 encoded, as written
+// by `cosign sign-blob`. ECDSA signatures are ASN.1 encoded over the SHA-256
+// digest of the archive, ed25519 signatures are made over the archive itself.
+func (u updater) VerifySignature(artifact artifact, fileName string) error {
+	signature, err := u.FetchBytes(u.SignatureURL(artifact), 64*1024)
+
+	if err != nil {
+		return err
+	}
+
+	if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature))); err == nil {
+		signature = decoded
+	}
+
+	content, err := os.ReadFile(fileName)
+
+	if err != nil {
+		return err
+	}
+
+	switch key := u.publicKey.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, content, signature) {
+			return &ChecksumError{Subject: "ed25519 signature"}
+		}
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(content)
+
+		if !ecdsa.VerifyASN1(key, digest[:], signature) {
+			return &ChecksumError{Subject: "ECDSA signature"}
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", u.publicKey)
+	}
+
+	return nil
+}
+
+// loadPublicKey reads a PEM encoded PKIX public key, like the cosign.pub file
+// written by `cosign generate-key-pair`.
+func loadPublicKey(fileName string) (crypto.PublicKey, error) {
+	content, err := os.ReadFile(fileName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(content)
+
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM encoded key found", fileName)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+
+	switch key.(type) {
+	case ed25519.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("%s: only ed25519 and ECDSA keys are supported", fileName)
+}
+
+// SaveArchive downloads the artifact archive to the -o path, or to the artifact
+// name with a .zip extension, and leaves it there without extracting.
+func (u updater) SaveArchive(artifact artifact) error {
+	fileName := u.output
+
+	if fileName == "" {
+		fileName = artifact.Name + ".zip"
+	}
+
+	if err := u.Download(artifact, fileName); err != nil {
+		return err
+	}
+
+	if fileName == stdoutFile {
+		fmt.Println("Artifact archive written to standard output")
+	} else {
+		fmt.Printf("Artifact archive saved to %s\n", fileName)
+	}
+
+	return nil
+}
+
+func (u updater) DownloadAndReplace(artifact artifact) error {
+	if u.noExtract {
+		return u.SaveArchive(artifact)
+	}
+
+	if u.reportFile == "" {
+		return u.ReplaceWithArtifact(artifact)
+	}
+
+	record := u.NewDeployRecord(artifact)
+	filesExtracted := u.stats.FilesExtracted
+
+	target := u
+	target.record = record
+	err := target.ReplaceWithArtifact(artifact)
+
+	record.Files = u.stats.FilesExtracted - filesExtracted
+
+	if err != nil {
+		record.Error = err.Error()
+	} else if state, stateErr := u.ReadState(); stateErr == nil {
+		record.Next = &state
+	}
+
+	u.stats.AddDeploy(record)
+
+	return err
+}
+
+// ReplaceWithArtifact downloads the artifact and deploys it into the asset
+// directory, recording the deployed artifact in the state marker.
+func (u updater) ReplaceWithArtifact(artifact artifact) error {
+	if err := u.CheckDirectory(); err != nil {
+		return err
+	}
+
+	// The contents are hashed before the first attempt, as a corrupt archive
+	// may leave a partial extraction behind
+	detectChanges := u.postHookOnlyOnChange || u.events != nil
+	var previous map[string]string
+
+	if detectChanges {
+		hashes, err := u.HashContents()
+
+		if err != nil {
+			return err
+		}
+
+		previous = hashes
+	}
+
+	// No archive is downloaded when the changed files could be patched
+	archive := ""
+	patched, err := u.PatchChangedFiles(artifact)
+
+	if err != nil {
+		return inPhase("download", err)
+	}
+
+	if !patched {
+		archive, err = u.DownloadAndDeploy(artifact)
+
+		defer os.Remove(archive)
+
+		var extractionErr *ExtractionError
+
+		if u.retryCorrupt && errors.As(err, &extractionErr) && !isRejectedPath(err) {
+			fmt.Println(colorBlue, "Archive turned out to be corrupt, downloading it once more:", err, colorReset)
+			os.Remove(archive)
+			archive, err = u.DownloadAndDeploy(artifact)
+
+			defer os.Remove(archive)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if u.record != nil && archive != "" {
+		if checksum, err := fileSHA256(archive); err == nil {
+			u.record.SHA256 = checksum
+		}
+	}
+
+	if err := u.WriteState(u.directory, artifact); err != nil {
+		return err
+	}
+
+	changed := true
+
+	if detectChanges {
+		current, err := u.HashContents()
+
+		if err != nil {
+			return err
+		}
+
+		changed = !diffTrees(previous, current).IsEmpty()
+		u.stats.RecordChange(changed)
+
+		if !changed {
+			fmt.Println("Contents are identical to the ones deployed before")
+		}
+	}
+
+	if u.postHook != "" {
+		if u.postHookOnlyOnChange && !changed {
+			fmt.Println("Skipping post-hook, contents didn't change")
+		} else if err := u.RunPostHook(artifact, changed); err != nil {
+			return inPhase("hook", err)
+		}
+	}
+
+	if u.healthURL != "" {
+		if err := u.CheckHealth(); err != nil {
+			if !u.rollbackOnHealthFail {
+				return inPhase("hook", err)
+			}
+
+			return inPhase("hook", u.RollbackUnhealthy(artifact, err))
+		}
+	}
+
+	if archive == "" {
+		return nil
+	}
+
+	if u.keepArchive {
+		return u.ArchiveDownload(archive, artifact)
+	}
+
+	fmt.Println("Removing archive")
+	removeErr := os.Remove(archive)
+
+	if removeErr != nil {
+		return removeErr
+	}
+
+	return nil
+}
+
+// PatchChangedFiles updates the asset directory file by file from -file-url
+// when the workflow run of the artifact also uploaded the -file-manifest
+// artifact, listing the SHA-256 of every file like sha256sum does. Only the
+// files whose hash differs from the local one are downloaded, and the ones
+// missing from the manifest are removed. The files go through -allow-paths,
+// -confirm, -backup and the mode options like extracted ones. It returns
+// false, leaving the directory alone, when there is no manifest or nothing
+// deployed yet, so that the whole archive is deployed.
+func (u updater) PatchChangedFiles(a artifact) (bool, error) {
+	if u.fileManifest == "" {
+		return false, nil
+	}
+
+	if _, err := os.Stat(u.directory); os.IsNotExist(err) {
+		fmt.Println("Directory doesn't exist, downloading the whole archive")
+		return false, nil
+	}
+
+	manifestArtifact, found, err := u.FindFileManifest(a)
+
+	if err != nil {
+		return false, err
+	}
+
+	if !found {
+		fmt.Printf("No `%s` artifact from the same workflow run, downloading the whole archive\n", u.fileManifest)
+		return false, nil
+	}
+
+	remote, err := u.ReadFileManifest(manifestArtifact)
+
+	if err != nil {
+		return false, err
+	}
+
+	local, err := hashTree(u.directory)
+
+	if err != nil {
+		return false, err
+	}
+
+	diff := diffTrees(local, remote)
+
+	// Merging keeps the files missing from the artifact, unless pruning
+	if u.merge && !u.prune {
+		diff.Removed = nil
+	}
+
+	fmt.Printf("File manifest lists %d files: %d added, %d changed, %d removed\n", len(remote), len(diff.Added), len(diff.Changed), len(diff.Removed))
+
+	if err := u.CheckCount(len(remote)); err != nil {
+		return false, err
+	}
+
+	download := append(diff.Added, diff.Changed...)
+
+	// The manifest gets the same checks as the entries of an archive
+	if len(u.allowPaths) > 0 {
+		for _, relPath := range download {
+			if !matchesPathOrParent(u.allowPaths, relPath) {
+				return false, &DisallowedPathError{Name: relPath}
+			}
+		}
+	}
+
+	if len(diff.Changed) > 0 || len(diff.Removed) > 0 {
+		if err := u.ConfirmChanges(fmt.Sprintf("adds %d, overwrites %d and deletes %d files", len(diff.Added), len(diff.Changed), len(diff.Removed))); err != nil {
+			return false, err
+		}
+	}
+
+	if u.backup {
+		if _, err := u.Backup(); err != nil {
+			return false, err
+		}
+	}
+
+	// Files are downloaded next to the ones they replace, so that moving them
+	// into place is a rename on the same file system
+	staging, err := os.MkdirTemp(u.directory, ".updater-files-")
+
+	if err != nil {
+		return false, err
+	}
+
+	defer os.RemoveAll(staging)
+
+	for i, relPath := range download {
+		fileName := filepath.Join(staging, strconv.Itoa(i))
+
+		if u.verbose {
+			fmt.Printf("Downloading %s\n", relPath)
+		}
+
+		if err := u.DownloadFile(u.FileURL(a, relPath), fileName, 0); err != nil {
+			return false, fmt.Errorf("downloading %s failed, directory was left untouched: %w", relPath, err)
+		}
+
+		checksum, err := fileSHA256(fileName)
+
+		if err != nil {
+			return false, err
+		}
+
+		if checksum != remote[relPath] {
+			return false, &ChecksumError{Subject: relPath, Expected: remote[relPath], Actual: checksum}
+		}
+	}
+
+	targets := make([]string, 0, len(download))
+
+	for i, relPath := range download {
+		target := filepath.Join(u.directory, filepath.FromSlash(relPath))
+
+		// Replaced files keep their mode, new ones get the mode of a zip
+		// entry without one
+		mode := 0644 &^ u.umask
+
+		if info, err := os.Stat(target); err == nil {
+			mode = info.Mode().Perm()
+		}
+
+		if err := os.Chmod(filepath.Join(staging, strconv.Itoa(i)), mode); err != nil {
+			return false, err
+		}
+
+		if err := os.MkdirAll(filepath.Dir(target), 0755&^u.umask); err != nil {
+			return false, err
+		}
+
+		if err := os.Rename(filepath.Join(staging, strconv.Itoa(i)), target); err != nil {
+			return false, err
+		}
+
+		targets = append(targets, target)
+	}
+
+	if err := u.FixPermissions(u.directory, targets); err != nil {
+		return false, err
+	}
+
+	if u.permissionsFrom != "" {
+		if err := u.MirrorPermissions(u.directory, targets); err != nil {
+			return false, err
+		}
+	}
+
+	for _, relPath := range diff.Removed {
+		if u.IsKept(filepath.FromSlash(relPath)) {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(u.directory, filepath.FromSlash(relPath))); err != nil {
+			return false, err
+		}
+
+		removeEmptyParents(u.directory, path.Dir(relPath))
+	}
+
+	fmt.Printf("Patched %d files and removed %d\n", len(download), len(diff.Removed))
+
+	if u.backup && u.keepBackups > 0 {
+		return true, u.PruneBackups()
+	}
+
+	return true, nil
+}
+
+// removeEmptyParents removes the slash separated directory under root and its
+// parents for as long as they are empty.
+func removeEmptyParents(root, dir string) {
+	for ; dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if os.Remove(filepath.Join(root, filepath.FromSlash(dir))) != nil {
+			return
+		}
+	}
+}
+
+// FindFileManifest looks up the -file-manifest artifact uploaded by the same
+// workflow run as the artifact.
+func (u updater) FindFileManifest(a artifact) (artifact, bool, error) {
+	if a.WorkflowRun == nil {
+		return artifact{}, false, nil
+	}
+
+	data, err := u.Artifacts()
+
+	if err != nil {
+		return artifact{}, false, err
+	}
+
+	for _, candidate := range data.Artifacts {
+		if candidate.Name == u.fileManifest && !candidate.IsExpired() && candidate.WorkflowRun != nil && candidate.WorkflowRun.ID == a.WorkflowRun.ID {
+			return candidate, true, nil
+		}
+	}
+
+	return artifact{}, false, nil
+}
+
+// ReadFileManifest downloads the manifest artifact and parses the first file
+// in it, with a `<sha256>  <path>` line for every file of the deploy.
+func (u updater) ReadFileManifest(a artifact) (map[string]string, error) {
+	archive, err := tempArchive()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.Remove(archive)
+
+	if err := u.Download(a, archive); err != nil {
+		return nil, err
+	}
+
+	r, err := zip.OpenReader(archive)
+
+	if err != nil {
+		return nil, &ExtractionError{Archive: archive, Err: err}
+	}
+
+	defer r.Close()
+
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		rc, err := f.Open()
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer rc.Close()
+
+		return parseFileManifest(rc)
+	}
+
+	return nil, fmt.Errorf("%s: the file manifest artifact is empty", a.Name)
+}
+
+// parseFileManifest reads sha256sum output into hashes by slash separated
+// path, rejecting paths that would end up outside the asset directory.
+func parseFileManifest(r io.Reader) (map[string]string, error) {
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(text, " ", 2)
+
+		if len(fields) != 2 || len(fields[0]) != sha256.Size*2 {
+			return nil, fmt.Errorf("file manifest line %d: expected `<sha256>  <path>`", line)
+		}
+
+		// sha256sum marks files read in binary mode with an asterisk
+		name := strings.TrimPrefix(strings.TrimLeft(fields[1], " "), "*")
+		relPath := path.Clean(strings.TrimPrefix(name, "./"))
+
+		if path.IsAbs(relPath) || relPath == "." || relPath == ".." || strings.HasPrefix(relPath, "../") || relPath == stateMarker {
+			return nil, fmt.Errorf("file manifest line %d: illegal file path %s", line, name)
+		}
+
+		hashes[relPath] = strings.ToLower(fields[0])
+	}
+
+	return hashes, scanner.Err()
+}
+
+// FileURL resolves the {path}, {name}, {id} and {sha} placeholders of
+// -file-url for a file of the artifact.
+func (u updater) FileURL(a artifact, relPath string) string {
+	segments := strings.Split(relPath, "/")
+
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+
+	headSHA := ""
+
+	if a.WorkflowRun != nil {
+		headSHA = a.WorkflowRun.HeadSHA
+	}
+
+	return strings.NewReplacer("{path}", strings.Join(segments, "/"), "{name}", a.Name, "{id}", strconv.Itoa(a.ID), "{sha}", headSHA).Replace(u.fileURL)
+}
+
+// verifyDigest checks the archive against the digest GitHub lists for the
+// artifact, like sha256:<hex>. Other algorithms are skipped with a warning.
+func verifyDigest(digest, fileName string) error {
+	algorithm, expected, found := strings.Cut(digest, ":")
+
+	if !found || !strings.EqualFold(algorithm, "sha256") {
+		fmt.Println(colorBlue, "Warning: unsupported artifact digest", digest, "was not verified", colorReset)
+		return nil
+	}
+
+	fmt.Println("Verifying archive digest")
+	checksum, err := fileSHA256(fileName)
+
+	if err != nil {
+		return err
+	}
+
+	if !strings.EqualFold(checksum, expected) {
+		return &ChecksumError{Subject: "artifact digest", Expected: strings.ToLower(expected), Actual: checksum}
+	}
+
+	return nil
+}
+
+// fileSHA256 returns the hex encoded SHA-256 digest of a file.
+func fileSHA256(fileName string) (string, error) {
+	file, err := os.Open(fileName)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer file.Close()
+
+	hash := sha256.New()
+
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// ContentDirectory returns the directory holding the deployed files, which is
+// the release the current symlink points to with -symlink-target.
+func (u updater) ContentDirectory() string {
+	if !u.symlinkTarget {
+		return u.directory
+	}
+
+	return filepath.Join(u.directory, currentSymlink)
+}
+
+// HashContents hashes the deployed files with hashTree, returning no hashes
+// when nothing was deployed yet.
+func (u updater) HashContents() (map[string]string, error) {
+	root, err := filepath.EvalSymlinks(u.ContentDirectory())
+
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return hashTree(root)
+}
+
+// RunPostHook runs -post-hook with sh in the asset directory, passing the
+// artifact and whether the contents changed in the environment.
+func (u updater) RunPostHook(a artifact, changed bool) error {
+	fmt.Println("Running post-hook:", u.postHook)
+
+	cmd := exec.Command("sh", "-c", u.postHook)
+	cmd.Dir = u.directory
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"UPDATER_ARTIFACT_ID="+strconv.Itoa(a.ID),
+		"UPDATER_ARTIFACT_NAME="+a.Name,
+		"UPDATER_DIRECTORY="+u.directory,
+		"UPDATER_CHANGED="+strconv.FormatBool(changed),
+	)
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("post-hook failed, the artifact was deployed: %w", err)
+	}
+
+	return nil
+}
+
+// CheckHealth polls -health-url every -health-interval until it answers with
+// 200, giving up after -health-timeout.
+func (u updater) CheckHealth() error {
+	client := *u.client
+	client.Timeout = u.healthInterval
+	deadline := time.Now().Add(u.healthTimeout)
+
+	for attempt := 1; ; attempt++ {
+		started := time.Now()
+		resp, err := client.Get(u.healthURL)
+		status := ""
+
+		if err == nil {
+			resp.Body.Close()
+			status = resp.Status
+
+			if resp.StatusCode == http.StatusOK {
+				fmt.Printf("Health check attempt %d: %s\n", attempt, status)
+				return nil
+			}
+
+			err = fmt.Errorf("unexpected response %s", status)
+		}
+
+		fmt.Printf("Health check attempt %d failed: %s\n", attempt, err)
+
+		if time.Now().Add(u.healthInterval).After(deadline) {
+			return fmt.Errorf("%s didn't become healthy within %s: %w", u.healthURL, u.healthTimeout, err)
+		}
+
+		time.Sleep(u.healthInterval - time.Since(started))
+	}
+}
+
+// RollbackUnhealthy restores the backup taken before the deploy with
+// -rollback-on-health-fail and runs -post-hook again, so the service is
+// restarted on the previous contents.
+func (u updater) RollbackUnhealthy(a artifact, healthErr error) error {
+	fmt.Println(colorBlue, "Health check failed, rolling back to the previous contents", colorReset)
+
+	if err := u.Rollback(); err != nil {
+		return fmt.Errorf("%w, rollback failed too: %s", healthErr, err)
+	}
+
+	if u.postHook != "" {
+		if err := u.RunPostHook(a, true); err != nil {
+			return fmt.Errorf("%w, rolled back but: %s", healthErr, err)
+		}
+	}
+
+	return fmt.Errorf("%w, rolled back to the previous contents", healthErr)
+}
+
+// CheckFreeSpace refuses to extract the archive when the free space left on
+// the file system of the asset directory afterwards would drop below
+// -min-free-space, or when there aren't enough free inodes for its entries.
+// Space freed by removing the current contents isn't taken into account.
+func (u updater) CheckFreeSpace(archive string) error {
+	projected, err := u.ReportSpace(archive)
+
+	if err != nil {
+		return err
+	}
+
+	if projected.Bytes < u.minFreeSpace {
+		return fmt.Errorf("extracting the archive would leave %s of free space, below the minimum of %s", projected.Bytes.Human(), u.minFreeSpace.Human())
+	}
+
+	return projected.CheckInodes()
+}
+
+// spaceProjection is what ReportSpace expects to be left on the file system
+// after extracting an archive of Size bytes, with Free bytes free before.
+// FreeInodes is negative when the file system doesn't report inode counts.
+type spaceProjection struct {
+	Free       byteSize
+	Size       byteSize
+	Bytes      byteSize
+	FreeInodes int64
+	Entries    int
+}
+
+// CheckInodes fails when the archive has more entries than there are free
+// inodes. It passes when the file system doesn't report them.
+func (p spaceProjection) CheckInodes() error {
+	if p.FreeInodes >= 0 && int64(p.Entries) > p.FreeInodes {
+		return fmt.Errorf("extracting the archive needs %d inodes, only %d are free", p.Entries, p.FreeInodes)
+	}
+
+	return nil
+}
+
+// Print writes the byte headroom and, when the file system reports them, the
+// inode headroom.
+func (p spaceProjection) Print(w io.Writer) {
+	fmt.Fprintf(w, "Free space is %s, %s after extracting %s\n", p.Free.Human(), p.Bytes.Human(), p.Size.Human())
+
+	if p.FreeInodes >= 0 {
+		fmt.Fprintf(w, "Free inodes are %d, %d after extracting %d entries\n", p.FreeInodes, p.FreeInodes-int64(p.Entries), p.Entries)
+	}
+}
+
+// ReportSpace prints the uncompressed size and the entry count of the archive
+// contents, and the free space and inodes on the file system of the asset
+// directory before and after extracting them.
+func (u updater) ReportSpace(archive string) (spaceProjection, error) {
+	extractor, err := extractorFor(archive)
+
+	if err != nil {
+		return spaceProjection{}, err
+	}
+
+	size, entries, err := extractor.Size(archive)
+
+	if err != nil {
+		return spaceProjection{}, err
+	}
+
+	free, inodes, err := freeSpace(u.directory)
+
+	if err != nil {
+		return spaceProjection{}, err
+	}
+
+	projected := spaceProjection{Free: byteSize(free), Size: byteSize(size), Bytes: byteSize(free - size), FreeInodes: inodes, Entries: entries}
+	projected.Print(os.Stdout)
+
+	return projected, nil
+}
+
+// DownloadAndDeploy downloads the artifact into a fresh archive file,
+// validates it and extracts it into place. The archive path is returned even
+// on failure so the caller can clean it up.
+func (u updater) DownloadAndDeploy(artifact artifact) (string, error) {
+	// Every deploy gets its own archive file, so that manifest targets
+	// deployed concurrently don't overwrite each other's downloads
+	archive, err := tempArchive()
+
+	if err != nil {
+		return archive, err
+	}
+
+	err = u.Download(artifact, archive)
+
+	if err != nil {
+		return archive, inPhase("download", err)
+	}
+
+	fmt.Println("Validating archive")
+
+	if err := u.ValidateArchive(archive); err != nil {
+		if isRejectedPath(err) {
+			return archive, inPhase("verify", fmt.Errorf("archive was rejected, directory was left untouched: %w", err))
+		}
+
+		return archive, inPhase("verify", fmt.Errorf("archive is corrupt, directory was left untouched: %w", err))
+	}
+
+	if u.minFreeSpace > 0 {
+		if err := u.CheckFreeSpace(archive); err != nil {
+			return archive, err
+		}
+	} else if u.spaceReport {
+		if _, err := u.ReportSpace(archive); err != nil {
+			fmt.Println(colorBlue, "Warning: unable to report free space:", err, colorReset)
+		}
+	}
+
+	if u.symlinkTarget {
+		return archive, inPhase("extract", u.DeployRelease(archive))
+	}
+
+	return archive, inPhase("extract", u.ReplaceContents(archive))
+}
+
+// tempArchive creates an empty file in the working directory to download an
+// archive into.
+func tempArchive() (string, error) {
+	file, err := os.CreateTemp(".", "dist-*.zip")
+
+	if err != nil {
+		return "", err
+	}
+
+	return file.Name(), file.Close()
+}
+
+// ArchiveDirectory returns where deployed archives are kept with
+// -keep-archive, defaulting to a sibling of the asset directory.
+func (u updater) ArchiveDirectory() string {
+	if u.archiveDir != "" {
+		return u.archiveDir
+	}
+
+	return filepath.Clean(u.directory) + ".archives"
+}
+
+// archiveName matches the names ArchiveDownload gives.
+var archiveName = regexp.MustCompile(`^\d{14}-\d+\.zip$`)
+
+// ArchiveDownload moves the deployed archive into ArchiveDirectory, named
+// after the time and the artifact ID, and prunes the ones beyond
+// -keep-archives.
+func (u updater) ArchiveDownload(archive string, a artifact) error {
+	if err := os.MkdirAll(u.ArchiveDirectory(), 0755); err != nil {
+		return err
+	}
+
+	archivePath := filepath.Join(u.ArchiveDirectory(), fmt.Sprintf("%s-%d.zip", time.Now().UTC().Format("20060102150405"), a.ID))
+
+	// Rename doesn't work across file systems, copy the archive over then
+	if err := os.Rename(archive, archivePath); err != nil {
+		info, statErr := os.Stat(archive)
+
+		if statErr != nil {
+			return statErr
+		}
+
+		if err := copyFile(archive, archivePath, info.Mode().Perm()); err != nil {
+			os.Remove(archivePath)
+			return err
+		}
+
+		if err := os.Remove(archive); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Saved archive to %s\n", archivePath)
+
+	if u.keepArchives > 0 {
+		return pruneOldest(u.ArchiveDirectory(), u.keepArchives, "archive", archiveName)
+	}
+
+	return nil
+}
+
+// stateMarker is the file in the asset directory describing the deployed
+// artifact. It survives clearing and pruning and is left out of diffs.
+const stateMarker = ".updater.json"
+
+// StateFile returns the state marker in the content directory, so with
+// -symlink-target every release carries the state of its own deploy.
+func (u updater) StateFile() string {
+	return filepath.Join(u.ContentDirectory(), stateMarker)
+}
+
+type deployState struct {
+	Repository   string `json:"repository"`
+	ArtifactID   int    `json:"artifact_id"`
+	ArtifactName string `json:"artifact_name"`
+	CreatedAt    string `json:"created_at"`
+	UpdatedAt    string `json:"updated_at"`
+	HeadSHA      string `json:"head_sha,omitempty"`
+	DeployedAt   string `json:"deployed_at"`
+	TreeHash     string `json:"tree_hash,omitempty"`
+}
+
+// WriteState records the deployed artifact in the state marker of dir.
+func (u updater) WriteState(dir string, a artifact) error {
+	state := deployState{
+		Repository:   u.repository,
+		ArtifactID:   a.ID,
+		ArtifactName: a.Name,
+		CreatedAt:    a.CreatedAt,
+		UpdatedAt:    a.UpdatedAt,
+		DeployedAt:   time.Now().UTC().Format(time.RFC3339),
+	}
+
+	if a.WorkflowRun != nil {
+		state.HeadSHA = a.WorkflowRun.HeadSHA
+	}
+
+	// The contents are hashed where they are written, the staging directory
+	// of a group deploy or the asset directory
+	target := u
+	target.directory = dir
+	hashes, err := target.HashContents()
+
+	if err != nil {
+		return err
+	}
+
+	state.TreeHash = treeDigest(hashes)
+	body, err := json.MarshalIndent(state, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(target.StateFile(), append(body, '\n'), 0644)
+}
+
+// IsDeployed tells whether the state marker records the artifact as the
+// deployed one.
+func (u updater) IsDeployed(a artifact) bool {
+	state, err := u.ReadState()
+
+	return err == nil && state.Repository == u.repository && state.ArtifactID == a.ID && state.UpdatedAt == a.UpdatedAt
+}
+
+// LastDeploy returns the state marker of the content directory for
+// -since-last-deploy, or nil when the mode is off, overridden by -force or
+// nothing from the repositories was deployed yet.
+func (u updater) LastDeploy() (*deployState, error) {
+	if !u.sinceLastDeploy || u.force {
+		return nil, nil
+	}
+
+	state, err := u.ReadState()
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the state of the last deploy: %w", err)
+	}
+
+	if state.Repository != u.repository && state.Repository != u.fallbackRepository {
+		return nil, nil
+	}
+
+	return &state, nil
+}
+
+// ReadState returns the state marker of the content directory, the one
+// WriteState records the deploy in.
+func (u updater) ReadState() (deployState, error) {
+	var state deployState
+	body, err := os.ReadFile(u.StateFile())
+
+	if err != nil {
+		return state, err
+	}
+
+	err = json.Unmarshal(body, &state)
+
+	return state, err
+}
+
+// Stage downloads the artifact and extracts it into a fresh staging directory
+// next to the target directory, so it can later be swapped in with a rename.
+func (u updater) Stage(artifact artifact) (string, error) {
+	parent := filepath.Dir(filepath.Clean(u.directory))
+
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return "", err
+	}
+
+	staging, err := os.MkdirTemp(parent, "."+filepath.Base(u.directory)+".staging-")
+
+	if err != nil {
+		return "", err
+	}
+
+	archive := staging + ".zip"
+	defer os.Remove(archive)
+
+	if err := u.Download(artifact, archive); err != nil {
+		os.RemoveAll(staging)
+		return "", err
+	}
+
+	fmt.Printf("Extracting archive contents into %s\n", staging)
+
+	if _, err := u.Extract(archive, staging); err != nil {
+		os.RemoveAll(staging)
+		return "", err
+	}
+
+	if u.ChecksStaged() {
+		if err := u.CheckStaged(staging); err != nil {
+			os.RemoveAll(staging)
+			return "", err
+		}
+	}
+
+	// TempDir creates the directory with 0700
+	if err := os.Chmod(staging, 0755); err != nil {
+		os.RemoveAll(staging)
+		return "", err
+	}
+
+	return staging, nil
+}
+
+// swapDirectory renames staging into place of target, moving the current
+// target aside first. The returned path of the previous contents is empty
+// when the target didn't exist.
+func swapDirectory(staging, target string) (string, error) {
+	previous := ""
+
+	if _, err := os.Stat(target); err == nil {
+		previous = fmt.Sprintf("%s.previous-%d", filepath.Clean(target), time.Now().UnixNano())
+
+		if err := moveDirectory(target, previous); err != nil {
+			return "", err
+		}
+	}
+
+	if err := moveDirectory(staging, target); err != nil {
+		if previous != "" {
+			moveDirectory(previous, target)
+		}
+
+		return "", err
+	}
+
+	return previous, nil
+}
+
+type stagedTarget struct {
+	target   updater
+	staging  string
+	previous string
+}
+
+// DeployGroup deploys several artifacts with all-or-nothing semantics. Every
+// artifact is downloaded and extracted into a staging directory first, and
+// only when all of them succeeded are the staging directories swapped in. A
+// failing swap puts the already swapped directories back.
+func (u updater) DeployGroup(selected []artifact) error {
+	var staged []*stagedTarget
+
+	defer func() {
+		for _, stage := range staged {
+			if stage.staging != "" {
+				os.RemoveAll(stage.staging)
+			}
+		}
+	}()
+
+	fmt.Println("Staging phase: downloading and extracting all artifacts")
+
+	for _, artifact := range selected {
+		target, err := u.ForArtifact(artifact.Name).ForDestination(artifact)
+
+		if err != nil {
+			return err
+		}
+
+		if err := target.CheckDirectory(); err != nil {
+			return err
+		}
+
+		staging, err := target.Stage(artifact)
+
+		if err != nil {
+			return fmt.Errorf("staging of `%s` failed, nothing was replaced: %w", artifact.Name, err)
+		}
+
+		if err := target.WriteState(staging, artifact); err != nil {
+			os.RemoveAll(staging)
+			return err
+		}
+
+		staged = append(staged, &stagedTarget{target: target, staging: staging})
+	}
+
+	fmt.Println("Commit phase: swapping staged directories into place")
+
+	for i, stage := range staged {
+		previous, err := swapDirectory(stage.staging, stage.target.directory)
+
+		if err != nil {
+			for j := i - 1; j >= 0; j-- {
+				rollback := staged[j]
+				os.RemoveAll(rollback.target.directory)
+
+				if rollback.previous != "" {
+					moveDirectory(rollback.previous, rollback.target.directory)
+				}
+			}
+
+			return fmt.Errorf("swapping `%s` into place failed, all targets were restored: %w", stage.target.artifactName, err)
+		}
+
+		stage.staging = ""
+		stage.previous = previous
+		fmt.Printf("Replaced %s\n", stage.target.directory)
+	}
+
+	for _, stage := range staged {
+		if stage.previous != "" {
+			if err := os.RemoveAll(stage.previous); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+type artifact struct {
+	ID                 int          `json:"id"`
+	NodeID             string       `json:"node_id"`
+	Name               string       `json:"name"`
+	SizeInBytes        int          `json:"size_in_bytes"`
+	URL                string       `json:"url"`
+	ArchiveDownloadURL string       `json:"archive_download_url"`
+	Expired            bool         `json:"expired"`
+	CreatedAt          string       `json:"created_at"`
+	UpdatedAt          string       `json:"updated_at"`
+	ExpiresAt          string       `json:"expires_at"`
+	WorkflowRun        *workflowRun `json:"workflow_run,omitempty"`
+	Digest             string       `json:"digest,omitempty"`
+}
+
+type workflowRun struct {
+	ID               int    `json:"id"`
+	RepositoryID     int    `json:"repository_id"`
+	HeadRepositoryID int    `json:"head_repository_id"`
+	HeadBranch       string `json:"head_branch"`
+	HeadSHA          string `json:"head_sha"`
+	Status           string `json:"status,omitempty"`
+	Conclusion       string `json:"conclusion,omitempty"`
+}
+
+// CreatedAtTime returns the parsed creation time, or the zero time if GitHub
+// sent something unexpected.
+func (a artifact) CreatedAtTime() time.Time {
+	createdAt, _ := time.Parse(time.RFC3339, a.CreatedAt)
+	return createdAt
+}
+
+func (a artifact) ExpiresAtTime() (time.Time, error) {
+	return time.Parse(time.RFC3339, a.ExpiresAt)
+}
+
+// IsExpired reports whether GitHub flagged the artifact as expired or its
+// expiration date has already passed, as the listing may be cached.
+func (a artifact) IsExpired() bool {
+	if a.Expired {
+		return true
+	}
+
+	expiresAt, err := a.ExpiresAtTime()
+
+	return err == nil && expiresAt.Before(time.Now())
+}
+
+func (a artifact) Size() (float64, string) {
+	if a.SizeInBytes > 1024 * 1024 * 1024 * 1024 {
+		return float64(a.SizeInBytes) / float64(1024*1024*1024*1024), "terabytes"
+	} else if a.SizeInBytes > 1024 * 1024 * 1024 {
+		return float64(a.SizeInBytes / (1024 * 1024 * 1024)), "gigabytes"
+	} else if a.SizeInBytes > 1024 * 1024 {
+		return float64(a.SizeInBytes) / float64(1024*1024), "megabytes"
+	} else if a.SizeInBytes > 1024 {
+		return float64(a.SizeInBytes) / float64(1024), "kilobytes"
+	}
+
+	return float64(a.SizeInBytes), "bytes"
+}
+
+type artifacts struct {
+	Count     int        `json:"total_count"`
+	Artifacts []artifact `json:"artifacts"`
+}
+
+func (a artifacts) HasArtifacts() bool {
+	return a.Count > 0
+}
+
+// Active returns the listing without the expired artifacts, the ones
+// LatestActiveArtifact never selects.
+func (a artifacts) Active() artifacts {
+	active := artifacts{Artifacts: []artifact{}}
+
+	for _, artifact := range a.Artifacts {
+		if !artifact.Expired {
+			active.Artifacts = append(active.Artifacts, artifact)
+		}
+	}
+
+	active.Count = len(active.Artifacts)
+
+	return active
+}
+
+// Grep returns the listing with only the artifacts whose name contains substr.
+func (a artifacts) Grep(substr string) artifacts {
+	matching := artifacts{Artifacts: []artifact{}}
+
+	for _, artifact := range a.Artifacts {
+		if strings.Contains(artifact.Name, substr) {
+			matching.Artifacts = append(matching.Artifacts, artifact)
+		}
+	}
+
+	matching.Count = len(matching.Artifacts)
+
+	return matching
+}
+
+// Sort orders the listing by name alphabetically, by date newest first or by
+// size largest first. Artifacts that compare equal keep the order of the API.
+func (a artifacts) Sort(key string) {
+	sort.SliceStable(a.Artifacts, func(i, j int) bool {
+		switch key {
+		case "name":
+			return a.Artifacts[i].Name < a.Artifacts[j].Name
+		case "date":
+			return a.Artifacts[i].CreatedAtTime().After(a.Artifacts[j].CreatedAtTime())
+		case "size":
+			return a.Artifacts[i].SizeInBytes > a.Artifacts[j].SizeInBytes
+		}
+
+		return false
+	})
+}
+
+func (a artifacts) Print(w io.Writer, format string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+
+		return encoder.Encode(a)
+	case "csv":
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"id", "name", "size_in_bytes", "expired", "created_at", "expires_at", "archive_download_url"})
+
+		for _, artifact := range a.Artifacts {
+			writer.Write([]string{
+				strconv.Itoa(artifact.ID),
+				artifact.Name,
+				strconv.Itoa(artifact.SizeInBytes),
+				strconv.FormatBool(artifact.Expired),
+				artifact.CreatedAt,
+				artifact.ExpiresAt,
+				artifact.ArchiveDownloadURL,
+			})
+		}
+
+		writer.Flush()
+
+		return writer.Error()
+	case "table":
+		writer := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, "ID\tNAME\tSIZE\tEXPIRED\tCREATED AT\tEXPIRES AT")
+
+		for _, artifact := range a.Artifacts {
+			sizeValue, sizeSuffix := artifact.Size()
+			fmt.Fprintf(writer, "%d\t%s\t%.2f %s\t%t\t%s\t%s\n", artifact.ID, artifact.Name, sizeValue, sizeSuffix, artifact.Expired, artifact.CreatedAt, artifact.ExpiresAt)
+		}
+
+		return writer.Flush()
+	}
+
+	return fmt.Errorf("unknown output format %q", format)
+}
+
+func isValidListFormat(format string) bool {
+	return format == "table" || format == "json" || format == "csv"
+}
+
+func isValidListSort(key string) bool {
+	return key == "" || key == "name" || key == "date" || key == "size"
+}
+
+func isValidSelectPolicy(policy string) bool {
+	return policy == "newest" || policy == "largest" || policy == "smallest"
+}
+
+// LatestActiveArtifact returns the non-expired artifact accepted by matches
+// that the -select policy prefers: the newest one, or the largest or smallest
+// one by size, where the newest of equally sized ones wins.
+func (a artifacts) LatestActiveArtifact(matches func(artifact) bool, policy string) (artifact, error) {
+	var response artifact
+	var err error = errNoSuitableArtifact
+
+	for _, artifact := range a.Artifacts {
+		if artifact.Expired || !matches(artifact) {
+			continue
+		}
+
+		if err != nil || prefers(policy, artifact, response) {
+			response = artifact
+			err = nil
+		}
+	}
+
+	return response, err
+}
+
+// prefers tells whether the policy chooses candidate over current.
+func prefers(policy string, candidate, current artifact) bool {
+	switch {
+	case policy == "largest" && candidate.SizeInBytes != current.SizeInBytes:
+		return candidate.SizeInBytes > current.SizeInBytes
+	case policy == "smallest" && candidate.SizeInBytes != current.SizeInBytes:
+		return candidate.SizeInBytes < current.SizeInBytes
+	}
+
+	return candidate.CreatedAtTime().After(current.CreatedAtTime())
+}
+
+// expandEnv replaces ${VAR} and $VAR in value like os.ExpandEnv, but fails
+// on variables that aren't set instead of leaving them empty.
+func expandEnv(value string) (string, error) {
+	var missing []string
+
+	expanded := os.Expand(value, func(name string) string {
+		variable, ok := os.LookupEnv(name)
+
+		if !ok {
+			missing = append(missing, name)
+		}
+
+		return variable
+	})
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+	}
+
+	return expanded, nil
+}
+
+func exactName(expected string) func(artifact) bool {
+	return func(a artifact) bool {
+		return a.Name == expected
+	}
+}
+
+// Extractor unpacks an archive file into a destination directory, returning
+// the paths of the extracted files and directories. Validate reads the whole
+// archive without writing anything, so a broken download is detected before
+// the destination is touched.
+type Extractor interface {
+	Extract(src, dest string, options extractOptions) ([]string, error)
+	// Validate reads the whole archive and checks its entries against the
+	// options, without writing anything
+	Validate(src, dest string, options extractOptions) error
+	// Size returns the total uncompressed size of the archive contents and
+	// the number of its entries
+	Size(src string) (int64, int, error)
+}
+
+// cleanSubpath normalizes -subpath to the form of zip entry names, without
+// leading or trailing slashes.
+func cleanSubpath(subpath string) string {
+	if subpath == "" {
+		return ""
+	}
+
+	return strings.Trim(path.Clean(filepath.ToSlash(subpath)), "/")
+}
+
+// extractOptions tweak how an Extractor writes files.
+type extractOptions struct {
+	// SkipNewer leaves existing files alone when they were modified after the
+	// archive entry replacing them.
+	SkipNewer bool
+
+	// SkipCurrent leaves existing files alone when their size and
+	// modification time match the archive entry, as left by an interrupted
+	// extraction
+	SkipCurrent bool
+
+	// Subpath limits extraction to the entries under this slash separated
+	// path, which are written relative to it
+	Subpath string
+
+	// BestEffort keeps going past entries that can't be written and reports
+	// all of them at the end
+	BestEffort bool
+
+	// AllowPaths, when set, lists the glob patterns every file entry or one of
+	// its parent directories has to match, relative to the destination
+	AllowPaths []string
+
+	// NormalizeEOL, when set, tells whether CRLF line endings of the entry
+	// with the given name are converted to LF
+	NormalizeEOL func(name string) bool
+
+	// Progress, when set, is called after every archive entry
+	Progress func(current, total int64)
+
+	// Workers is the number of files written at the same time, tuned to the
+	// archive when zero
+	Workers int
+
+	// Verbose prints the number of workers used
+	Verbose bool
+
+	// Umask clears permission bits from the modes of the zip entries and of
+	// the directories created for them
+	Umask os.FileMode
+	// LongPaths writes the files through \\?\ prefixed paths on Windows
+	LongPaths bool
+}
+
+type zipExtractor struct{}
+
+func (zipExtractor) Extract(src, dest string, options extractOptions) ([]string, error) {
+	filenames, err := unzip(src, dest, options)
+
+	if err != nil {
+		return filenames, &ExtractionError{Archive: src, Err: err}
+	}
+
+	return filenames, nil
+}
+
+func (zipExtractor) Size(src string) (int64, int, error) {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer r.Close()
+
+	var size int64
+
+	for _, f := range r.File {
+		size += int64(f.UncompressedSize64)
+	}
+
+	return size, len(r.File), nil
+}
+
+func (zipExtractor) Validate(src, dest string, options extractOptions) error {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err := checkAllowedZipPaths(r.File, options); err != nil {
+		return err
+	}
+
+	if err := checkZipPathLengths(r.File, dest, options); err != nil {
+		return err
+	}
+
+	for _, f := range r.File {
+		filePath := filepath.Join(dest, f.Name)
+
+		if !strings.HasPrefix(filePath, filepath.Clean(dest)+string(os.PathSeparator)) {
+			return fmt.Errorf("%s: illegal file path", filePath)
+		}
+
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+
+		// Reading the entry to the end verifies its checksum
+		_, err = io.Copy(io.Discard, rc)
+
+		if closeErr := rc.Close(); err == nil {
+			err = closeErr
+		}
+
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// tarGzExtractor unpacks gzip compressed tarballs. The stream is read in a
+// single pass, so entries are written one at a time whatever Workers says.
+// Symlinks and hard links have to point inside dest, hard links at an entry
+// extracted before them, which they share the content of.
+type tarGzExtractor struct{}
+
+func (tarGzExtractor) Extract(src, dest string, options extractOptions) ([]string, error) {
+	filenames, err := untar(src, dest, options)
+
+	if err != nil {
+		return filenames, &ExtractionError{Archive: src, Err: err}
+	}
+
+	return filenames, nil
+}
+
+func (tarGzExtractor) Size(src string) (int64, int, error) {
+	var size int64
+	count := 0
+
+	err := walkTarGz(src, func(header *tar.Header, r io.Reader) error {
+		size += header.Size
+		count++
+
+		return nil
+	})
+
+	return size, count, err
+}
+
+func (tarGzExtractor) Validate(src, dest string, options extractOptions) error {
+	_, err := checkTarEntries(src, dest, options)
+
+	return err
+}
+
+// checkTarEntries reads the whole tarball and checks its entries against the
+// options like unzip checks zip entries, the targets of links included. It
+// returns the number of entries.
+func checkTarEntries(src, dest string, options extractOptions) (int, error) {
+	var names []string
+
+	err := walkTarGz(src, func(header *tar.Header, r io.Reader) error {
+		names = append(names, strings.TrimPrefix(header.Name, "./"))
+		name, filePath, err := tarEntryPath(header, dest, options)
+
+		if err != nil || filePath == "" {
+			return err
+		}
+
+		if len(options.AllowPaths) > 0 && header.Typeflag != tar.TypeDir && !matchesPathOrParent(options.AllowPaths, name) {
+			return &DisallowedPathError{Name: header.Name}
+		}
+
+		return checkTarLink(header, filePath, dest, options)
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return len(names), checkPathLengths(names, dest, options)
+}
+
+// tarEntryPath returns the slash separated name of the entry after applying
+// -subpath and the path it is extracted to, both empty when the entry is left
+// out. Paths outside dest are rejected with the ZipSlip check of unzip.
+func tarEntryPath(header *tar.Header, dest string, options extractOptions) (string, string, error) {
+	name := strings.TrimPrefix(header.Name, "./")
+
+	if options.Subpath != "" {
+		if !strings.HasPrefix(name, options.Subpath+"/") {
+			return "", "", nil
+		}
+
+		name = strings.TrimPrefix(name, options.Subpath+"/")
+	}
+
+	if name == "" {
+		return "", "", nil
+	}
+
+	filePath := filepath.Join(dest, name)
+
+	if !strings.HasPrefix(filePath, filepath.Clean(dest)+string(os.PathSeparator)) {
+		return "", "", fmt.Errorf("%s: illegal file path", filePath)
+	}
+
+	return name, filePath, nil
+}
+
+// checkTarLink rejects a symlink whose target, resolved from where the link
+// is, and a hard link whose entry is outside dest or left out by -subpath.
+func checkTarLink(header *tar.Header, filePath, dest string, options extractOptions) error {
+	target := ""
+	root := filepath.Clean(dest)
+
+	switch header.Typeflag {
+	case tar.TypeSymlink:
+		if !filepath.IsAbs(header.Linkname) {
+			target = filepath.Join(filepath.Dir(filePath), filepath.FromSlash(header.Linkname))
+		}
+	case tar.TypeLink:
+		// Hard links name another entry of the archive
+		_, target, _ = tarEntryPath(&tar.Header{Name: header.Linkname}, dest, options)
+	default:
+		return nil
+	}
+
+	if target != root && !strings.HasPrefix(target, root+string(os.PathSeparator)) {
+		return fmt.Errorf("%s: illegal link target %s", filePath, header.Linkname)
+	}
+
+	return nil
+}
+
+// writeTarEntry writes a checked entry to filePath and tells whether it is of
+// a type that gets extracted. Existing files are replaced rather than written
+// through, as they could be hard links of other files.
+func writeTarEntry(header *tar.Header, r io.Reader, name, filePath, dest string, options extractOptions) (bool, error) {
+	target := longPath(filePath, options.LongPaths)
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		return true, os.MkdirAll(target, os.ModePerm)
+	case tar.TypeReg, tar.TypeSymlink, tar.TypeLink:
+	default:
+		return false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return true, err
+	}
+
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return true, err
+	}
+
+	switch header.Typeflag {
+	case tar.TypeSymlink:
+		return true, os.Symlink(header.Linkname, target)
+	case tar.TypeLink:
+		_, linkPath, _ := tarEntryPath(&tar.Header{Name: header.Linkname}, dest, options)
+
+		return true, os.Link(longPath(linkPath, options.LongPaths), target)
+	}
+
+	mode := os.FileMode(header.Mode).Perm()
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+
+	if err != nil {
+		return true, err
+	}
+
+	if options.NormalizeEOL != nil && options.NormalizeEOL(name) {
+		err = copyNormalizedEOL(out, r)
+	} else {
+		_, err = io.Copy(out, r)
+	}
+
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return true, err
+	}
+
+	if options.Umask != 0 {
+		if err := os.Chmod(target, mode&^options.Umask); err != nil {
+			return true, err
+		}
+	}
+
+	return true, os.Chtimes(target, header.ModTime, header.ModTime)
+}
+
+// untar extracts a gzip compressed tarball like unzip does a zip, checking
+// all of its entries before anything is written.
+func untar(src, dest string, options extractOptions) ([]string, error) {
+	var filenames []string
+
+	total, err := checkTarEntries(src, dest, options)
+
+	if err != nil {
+		return filenames, err
+	}
+
+	matched := false
+	skipped := 0
+	var failures []string
+	progress := newExtractProgress(options.Progress, int64(total))
+
+	err = walkTarGz(src, func(header *tar.Header, r io.Reader) error {
+		defer progress.Done()
+
+		name, filePath, err := tarEntryPath(header, dest, options)
+
+		if err != nil || filePath == "" {
+			return err
+		}
+
+		matched = true
+
+		if info, statErr := os.Stat(longPath(filePath, options.LongPaths)); header.Typeflag == tar.TypeReg && statErr == nil {
+			if options.SkipNewer && info.ModTime().After(header.ModTime) {
+				fmt.Printf("Skipping %s, the existing file is newer than the one in the archive\n", header.Name)
+				filenames = append(filenames, filePath)
+				return nil
+			}
+
+			if options.SkipCurrent && info.Mode().IsRegular() && info.Size() == header.Size && info.ModTime().Unix() == header.ModTime.Unix() {
+				skipped++
+				filenames = append(filenames, filePath)
+				return nil
+			}
+		}
+
+		written, err := writeTarEntry(header, r, name, filePath, dest, options)
+
+		if err != nil && options.BestEffort {
+			failures = append(failures, fmt.Sprintf("%s: %s", header.Name, err))
+			return nil
+		}
+
+		if written && err == nil {
+			filenames = append(filenames, filePath)
+		}
+
+		return err
+	})
+
+	progress.Finish()
+
+	if err != nil {
+		return filenames, err
+	}
+
+	if options.SkipCurrent {
+		fmt.Printf("Skipped %d files already current\n", skipped)
+	}
+
+	if options.Umask != 0 {
+		if err := maskDirectories(dest, filenames, options.Umask); err != nil {
+			return filenames, err
+		}
+	}
+
+	if options.Subpath != "" && !matched {
+		return filenames, fmt.Errorf("%s: no such path in the archive", options.Subpath)
+	}
+
+	if len(failures) > 0 {
+		return filenames, fmt.Errorf("%d of %d entries failed to extract:\n  %s", len(failures), total, strings.Join(failures, "\n  "))
+	}
+
+	return filenames, nil
+}
+
+type extractorRegistration struct {
+	extensions []string
+	magic      [][]byte
+	extractor  Extractor
+}
+
+// extractors lists the known archive formats. The first registration is the
+// default, used when neither the content nor the file name gives the format
+// away.
+var extractors = []extractorRegistration{
+	{
+		extensions: []string{".zip"},
+		magic:      [][]byte{[]byte("PK\x03\x04"), []byte("PK\x05\x06")},
+		extractor:  zipExtractor{},
+	},
+	{
+		extensions: []string{".tar.gz", ".tgz"},
+		magic:      [][]byte{[]byte("\x1f\x8b")},
+		extractor:  tarGzExtractor{},
+	},
+}
+
+func registerExtractor(extensions []string, magic [][]byte, extractor Extractor) {
+	extractors = append(extractors, extractorRegistration{extensions, magic, extractor})
+}
+
+// extractorFor picks the extractor for an archive by its leading magic bytes,
+// then by file extension, falling back to the default one.
+func extractorFor(fileName string) (Extractor, error) {
+	file, err := os.Open(fileName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	header := make([]byte, 512)
+	n, err := io.ReadFull(file, header)
+
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+
+	header = header[:n]
+
+	for _, registration := range extractors {
+		for _, magic := range registration.magic {
+			if bytes.HasPrefix(header, magic) {
+				return registration.extractor, nil
+			}
+		}
+	}
+
+	for _, registration := range extractors {
+		for _, extension := range registration.extensions {
+			if strings.HasSuffix(strings.ToLower(fileName), extension) {
+				return registration.extractor, nil
+			}
+		}
+	}
+
+	return extractors[0].extractor, nil
+}
+
+// Source: https://golangcode.com/unzip-files-in-go/
+// Unzip will decompress a zip archive, moving all files and folders
+// within the zip file (parameter 1) to an output directory (parameter 2).
+func unzip(src string, dest string, options extractOptions) ([]string, error) {
+
+	var filenames []string
+
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return filenames, err
+	}
+	defer r.Close()
+
+	// Nothing is written when any entry is outside the allowlist or its path
+	// would be too long
+	if err := checkAllowedZipPaths(r.File, options); err != nil {
+		return filenames, err
+	}
+
+	if err := checkZipPathLengths(r.File, dest, options); err != nil {
+		return filenames, err
+	}
+
+	matched := false
+	skipped := 0
+	total := int64(len(r.File))
+	var jobs []zipJob
+
+	// Paths are checked and directories created up front, only file contents
+	// are written by the workers
+	extracted := make([]string, len(r.File))
+	errs := make([]error, len(r.File))
+	progress := newExtractProgress(options.Progress, total)
+
+	for i, f := range r.File {
+		name := f.Name
+
+		if options.Subpath != "" {
+			if !strings.HasPrefix(name, options.Subpath+"/") {
+				progress.Done()
+				continue
+			}
+
+			matched = true
+			name = strings.TrimPrefix(name, options.Subpath+"/")
+
+			if name == "" {
+				progress.Done()
+				continue
+			}
+		}
+
+		// Store filename/path for returning and using later on
+		filePath := filepath.Join(dest, name)
+
+		// Check for ZipSlip. More Info: http://bit.ly/2MsjAWE
+		if !strings.HasPrefix(filePath, filepath.Clean(dest)+string(os.PathSeparator)) {
+			return filenames, fmt.Errorf("%s: illegal file path", filePath)
+		}
+
+		if f.FileInfo().IsDir() {
+			// Make Folder, even when no files end up in it
+			errs[i] = os.MkdirAll(longPath(filePath, options.LongPaths), os.ModePerm)
+			extracted[i] = filePath
+			progress.Done()
+		} else if info, statErr := os.Stat(longPath(filePath, options.LongPaths)); options.SkipNewer && statErr == nil && info.ModTime().After(f.Modified) {
+			fmt.Printf("Skipping %s, the existing file is newer than the one in the archive\n", f.Name)
+			extracted[i] = filePath
+			progress.Done()
+		} else if options.SkipCurrent && statErr == nil && isCurrentFile(info, f) {
+			skipped++
+			extracted[i] = filePath
+			progress.Done()
+		} else {
+			jobs = append(jobs, zipJob{index: i, f: f, filePath: filePath, normalizeEOL: options.NormalizeEOL != nil && options.NormalizeEOL(name), umask: options.Umask, longPaths: options.LongPaths})
+		}
+
+		if errs[i] != nil && !options.BestEffort {
+			break
+		}
+	}
+
+	workers := options.Workers
+
+	if workers <= 0 {
+		workers = tuneWorkers(jobs)
+	}
+
+	if options.Verbose {
+		fmt.Printf("Extracting %d files with %d workers\n", len(jobs), workers)
+	}
+
+	if options.SkipCurrent {
+		fmt.Printf("Skipped %d files already current\n", skipped)
+	}
+
+	writeZipJobs(jobs, workers, options.BestEffort, extracted, errs, progress)
+	progress.Finish()
+
+	if options.Umask != 0 {
+		if err := maskDirectories(dest, extracted, options.Umask); err != nil {
+			return filenames, err
+		}
+	}
+
+	var failures []string
+
+	for i, f := range r.File {
+		if errs[i] != nil && options.BestEffort {
+			failures = append(failures, fmt.Sprintf("%s: %s", f.Name, errs[i]))
+			continue
+		}
+
+		if errs[i] != nil {
+			return filenames, errs[i]
+		}
+
+		if extracted[i] != "" {
+			filenames = append(filenames, extracted[i])
+		}
+	}
+
+	if options.Subpath != "" && !matched {
+		return filenames, fmt.Errorf("%s: no such path in the archive", options.Subpath)
+	}
+
+	if len(failures) > 0 {
+		return filenames, fmt.Errorf("%d of %d entries failed to extract:\n  %s", len(failures), len(r.File), strings.Join(failures, "\n  "))
+	}
+
+	return filenames, nil
+}
+
+// maskDirectories gives the directories holding the extracted paths, up to
+// dest, the mode mkdir would create them with under umask.
+func maskDirectories(dest string, extracted []string, umask os.FileMode) error {
+	root := filepath.Clean(dest)
+	masked := make(map[string]bool)
+
+	for _, filePath := range extracted {
+		if filePath == "" {
+			continue
+		}
+
+		dir := filePath
+
+		if info, err := os.Lstat(filePath); err != nil || !info.IsDir() {
+			dir = filepath.Dir(filePath)
+		}
+
+		for ; dir != root && !masked[dir] && strings.HasPrefix(dir, root+string(os.PathSeparator)); dir = filepath.Dir(dir) {
+			if err := os.Chmod(dir, 0777&^umask); err != nil {
+				return err
+			}
+
+			masked[dir] = true
+		}
+	}
+
+	return nil
+}
+
+// isCurrentFile tells whether the existing file has the size and modification
+// time of the archive entry. The time is only set once the contents are
+// completely written, so a file cut short by an interruption never matches.
+func isCurrentFile(info os.FileInfo, f *zip.File) bool {
+	return info.Mode().IsRegular() && !f.Modified.IsZero() && info.Size() == int64(f.UncompressedSize64) && info.ModTime().Unix() == f.Modified.Unix()
+}
+
+// checkAllowedZipPaths rejects the first file entry, after applying
+// -subpath, that doesn't match -allow-paths. Absolute names never match.
+func checkAllowedZipPaths(files []*zip.File, options extractOptions) error {
+	if len(options.AllowPaths) == 0 {
+		return nil
+	}
+
+	for _, f := range files {
+		name := f.Name
+
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		if options.Subpath != "" {
+			if !strings.HasPrefix(name, options.Subpath+"/") {
+				continue
+			}
+
+			name = strings.TrimPrefix(name, options.Subpath+"/")
+		}
+
+		if !matchesPathOrParent(options.AllowPaths, name) {
+			return &DisallowedPathError{Name: f.Name}
+		}
+	}
+
+	return nil
+}
+
+// Path limits checked by checkZipPathLengths. Windows counts UTF-16 code
+// units and keeps one of MAX_PATH for the terminating null, \\?\ prefixed
+// paths may be much longer.
+const (
+	maxPathLength        int = 4095
+	maxWindowsPath       int = 259
+	maxWindowsLongPath   int = 32767
+	maxPathElementLength int = 255
+)
+
+// checkZipPathLengths rejects the first entry, after applying -subpath, whose
+// path under dest would exceed the limits of the platform, before anything
+// is written.
+func checkZipPathLengths(files []*zip.File, dest string, options extractOptions) error {
+	names := make([]string, len(files))
+
+	for i, f := range files {
+		names[i] = f.Name
+	}
+
+	return checkPathLengths(names, dest, options)
+}
+
+// checkPathLengths does the checks of checkZipPathLengths for the entry names
+// of any archive.
+func checkPathLengths(names []string, dest string, options extractOptions) error {
+	root, err := filepath.Abs(dest)
+
+	if err != nil {
+		return err
+	}
+
+	limit, hint := maxPathLength, ""
+
+	if runtime.GOOS == "windows" && options.LongPaths {
+		limit = maxWindowsLongPath
+	} else if runtime.GOOS == "windows" {
+		limit, hint = maxWindowsPath, ", use -long-paths to extract it anyway"
+	}
+
+	for _, entryName := range names {
+		name := entryName
+
+		if options.Subpath != "" {
+			if !strings.HasPrefix(name, options.Subpath+"/") {
+				continue
+			}
+
+			name = strings.TrimPrefix(name, options.Subpath+"/")
+		}
+
+		for _, element := range strings.Split(name, "/") {
+			if pathLength(element) > maxPathElementLength {
+				return &PathTooLongError{Name: entryName, Element: element, Length: pathLength(element), Limit: maxPathElementLength}
+			}
+		}
+
+		filePath := filepath.Join(root, name)
+
+		if length := pathLength(filePath); length > limit {
+			return &PathTooLongError{Name: entryName, Length: length, Limit: limit, Hint: hint}
+		}
+	}
+
+	return nil
+}
+
+// pathLength measures the path the way the platform limits it, in UTF-16
+// code units on Windows and in bytes elsewhere.
+func pathLength(filePath string) int {
+	if runtime.GOOS == "windows" {
+		return len(utf16.Encode([]rune(filePath)))
+	}
+
+	return len(filePath)
+}
+
+// longPath returns the \\?\ prefixed form of the path on Windows, which
+// isn't subject to MAX_PATH, when enabled.
+func longPath(filePath string, enabled bool) string {
+	if !enabled || runtime.GOOS != "windows" || strings.HasPrefix(filePath, `\\?\`) {
+		return filePath
+	}
+
+	abs, err := filepath.Abs(filePath)
+
+	if err != nil {
+		return filePath
+	}
+
+	if strings.HasPrefix(abs, `\\`) {
+		return `\\?\UNC\` + abs[2:]
+	}
+
+	return `\\?\` + abs
+}
+
+// matchesPathOrParent reports whether the slash separated path or one of its
+// parent directories matches one of the patterns, so that a pattern like
+// `web` allows everything under it.
+func matchesPathOrParent(patterns []string, name string) bool {
+	if path.IsAbs(name) {
+		return false
+	}
+
+	for current := path.Clean(name); current != "." && current != "/" && current != ".."; current = path.Dir(current) {
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, current); matched {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// zipJob is a file entry of the archive waiting to be written.
+type zipJob struct {
+	index        int
+	f            *zip.File
+	filePath     string
+	normalizeEOL bool
+	umask        os.FileMode
+	longPaths    bool
+}
+
+// writeZipJobs writes the file entries with the given number of workers,
+// recording the path or the error of each entry by its index in the archive.
+// Unless bestEffort is set, no new entries are started after a failure.
+func writeZipJobs(jobs []zipJob, workers int, bestEffort bool, extracted []string, errs []error, progress *extractProgress) {
+	queue := make(chan zipJob)
+	var failed int32
+	var wg sync.WaitGroup
+
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for job := range queue {
+				if err := writeZipEntry(job.f, longPath(job.filePath, job.longPaths), job.normalizeEOL, job.umask); err != nil {
+					errs[job.index] = err
+					atomic.StoreInt32(&failed, 1)
+				} else {
+					extracted[job.index] = job.filePath
+				}
+
+				progress.Done()
+			}
+		}()
+	}
+
+	for _, job := range jobs {
+		if !bestEffort && atomic.LoadInt32(&failed) != 0 {
+			break
+		}
+
+		queue <- job
+	}
+
+	close(queue)
+	wg.Wait()
+}
+
+// Bounds of the archive profile used by tuneWorkers, see its comment.
+const (
+	tuneMinFiles     int   = 16
+	tuneLargeFile    int64 = 1024 * 1024
+	tuneLargeWorkers int   = 2
+)
+
+// tuneWorkers picks the number of extraction workers for -extract-workers-auto
+// from the file count and average uncompressed size. Small files spend most
+// of the time creating files and setting their times, which overlaps well,
+// so they get one worker per GOMAXPROCS. Large files are bound by inflating
+// and disk throughput, where more workers mostly compete for the same disk.
+// A handful of files isn't worth the goroutines.
+func tuneWorkers(jobs []zipJob) int {
+	if len(jobs) < tuneMinFiles {
+		return 1
+	}
+
+	var size int64
+
+	for _, job := range jobs {
+		size += int64(job.f.UncompressedSize64)
+	}
+
+	workers := runtime.GOMAXPROCS(0)
+
+	if size/int64(len(jobs)) >= tuneLargeFile && workers > tuneLargeWorkers {
+		workers = tuneLargeWorkers
+	}
+
+	return workers
+}
+
+// extractProgress counts finished archive entries for extractOptions.Progress,
+// which workers report concurrently.
+type extractProgress struct {
+	mu     sync.Mutex
+	report func(current, total int64)
+	done   int64
+	total  int64
+}
+
+func newExtractProgress(report func(current, total int64), total int64) *extractProgress {
+	return &extractProgress{report: report, total: total}
+}
+
+func (p *extractProgress) Done() {
+	if p.report == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done++
+	p.report(p.done, p.total)
+}
+
+// Finish reports all entries as done, including the ones skipped after a
+// failure.
+func (p *extractProgress) Finish() {
+	if p.report != nil {
+		p.report(p.total, p.total)
+	}
+}
+
+// writeZipEntry writes the contents of a file entry to filePath, creating the
+// parent directories as needed. With normalizeEOL, CRLF line endings of text
+// files are converted to LF. The umask bits are cleared from the mode of the
+// entry.
+func writeZipEntry(f *zip.File, filePath string, normalizeEOL bool, umask os.FileMode) error {
+	// Make File
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return err
+	}
+
+	outFile, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
+	if err != nil {
+		return err
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		outFile.Close()
+		return err
+	}
+
+	if normalizeEOL {
+		err = copyNormalizedEOL(outFile, rc)
+	} else {
+		_, err = io.Copy(outFile, rc)
+	}
+
+	// Close the file without defer to close before the modification time is
+	// set. A checksum mismatch of the entry comes from the last Read as
+	// zip.ErrChecksum, errors of closing the reader count too
+	closeErr := rc.Close()
+
+	if err == nil {
+		err = closeErr
+	}
+
+	if closeErr = outFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// The mode passed when creating the file is subject to the umask of the
+	// process and doesn't apply to existing files
+	if umask != 0 {
+		if err := os.Chmod(filePath, f.Mode().Perm()&^umask); err != nil {
+			return err
+		}
+	}
+
+	// Keep the modification time from the archive so that later runs can
+	// tell local edits apart
+	if !f.Modified.IsZero() {
+		return os.Chtimes(filePath, f.Modified, f.Modified)
+	}
+
+	return nil
+}
+
+// copyNormalizedEOL copies r to w converting CRLF to LF, unless the content
+// looks binary, which like git is decided by a NUL byte in the first 8000
+// bytes.
+func copyNormalizedEOL(w io.Writer, r io.Reader) error {
+	content, err := io.ReadAll(r)
+
+	if err != nil {
+		return err
+	}
+
+	head := content
+
+	if len(head) > 8000 {
+		head = head[:8000]
+	}
+
+	if !bytes.Contains(head, []byte{0}) {
+		content = bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+	}
+
+	_, err = w.Write(content)
+
+	return err
+}
+
+// matchesGlob reports whether the slash separated path or its base name
+// matches one of the patterns.
+func matchesGlob(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+
+		if matched, _ := path.Match(pattern, path.Base(name)); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolveToken picks the authentication token from the first available source,
+// in order of precedence: standard input (only when requested with
+// -token-stdin, so nothing blocks waiting for input), -token-file, -t and
+// finally the GITHUB_TOKEN environment variable.
+func resolveToken(flagToken, tokenFile string, fromStdin bool, stdin io.Reader) (string, error) {
+	if fromStdin {
+		return readTokenLine(stdin)
+	}
+
+	if tokenFile != "" {
+		file, err := os.Open(tokenFile)
+
+		if err != nil {
+			return "", err
+		}
+
+		defer file.Close()
+
+		return readTokenLine(file)
+	}
+
+	if flagToken != "" {
+		return flagToken, nil
+	}
+
+	return os.Getenv("GITHUB_TOKEN"), nil
+}
+
+func readTokenLine(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	token := strings.TrimSpace(line)
+
+	if token == "" {
+		return "", errors.New("token is empty")
+	}
+
+	return token, nil
+}
+
+var errNoArtifacts = &NotFoundError{Message: "no artifacts found"}
+var errNoSuitableArtifact = &NotFoundError{Message: "no suitable artifacts found"}
+
+// FindArtifact downloads the artifacts listing and selects the artifact to
+// deploy from it.
+func (u updater) FindArtifact() (artifact, error) {
+	fmt.Printf("Downloading artifacts data of %s, please wait ...\n", u.repository)
+	data, err := u.Artifacts()
+
+	if err != nil {
+		return artifact{}, inPhase("list", err)
+	}
+
+	if !data.HasArtifacts() && u.runID != 0 {
+		return artifact{}, inPhase("select", fmt.Errorf("workflow run %d has no artifacts: %w", u.runID, errNoArtifacts))
+	}
+
+	if !data.HasArtifacts() {
+		return artifact{}, inPhase("select", errNoArtifacts)
+	}
+
+	artifact, err := data.LatestActiveArtifact(u.Accepts, u.selectPolicy)
+
+	if err != nil && u.commit != "" {
+		err = fmt.Errorf("no active artifact found for commit %s: %w", u.commit, err)
+	} else if err != nil && u.runID != 0 {
+		err = fmt.Errorf("no active artifact found in workflow run %d: %w", u.runID, err)
+	}
+
+	return artifact, inPhase("select", err)
+}
+
+// Accepts tells whether the artifact is a candidate for deployment: its name
+// matches, it was created after -since and its workflow run matches
+// MatchesRun.
+func (u updater) Accepts(a artifact) bool {
+	if !u.since.IsZero() && !a.CreatedAtTime().After(u.since) {
+		return false
+	}
+
+	return u.MatchesName(a.Name) && u.MatchesRun(a)
+}
+
+// MatchesRun tells whether the workflow run that produced the artifact was
+// for -commit and concluded with -require-conclusion, when given.
+func (u updater) MatchesRun(a artifact) bool {
+	return u.MatchesCommit(a) && u.HasConclusion(a)
+}
+
+// MatchesCommit tells whether the artifact was built from -commit, which may
+// be abbreviated. The head SHA comes with the listing, the run is only looked
+// up when it's missing there.
+func (u updater) MatchesCommit(a artifact) bool {
+	if u.commit == "" {
+		return true
+	}
+
+	if a.WorkflowRun == nil {
+		return false
+	}
+
+	headSHA := a.WorkflowRun.HeadSHA
+
+	if headSHA == "" {
+		run, err := u.runs.Run(u, a.WorkflowRun.ID)
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping artifact %d, unable to look up workflow run %d: %s\n", a.ID, a.WorkflowRun.ID, err)
+			return false
+		}
+
+		headSHA = run.HeadSHA
+	}
+
+	return strings.HasPrefix(strings.ToLower(headSHA), strings.ToLower(u.commit))
+}
+
+// HasConclusion tells whether the workflow run that produced the artifact
+// concluded with -require-conclusion. Runs are looked up once per ID.
+func (u updater) HasConclusion(a artifact) bool {
+	if u.requireConclusion == "" {
+		return true
+	}
+
+	if a.WorkflowRun == nil {
+		fmt.Fprintf(os.Stderr, "Skipping artifact %d, GitHub didn't say which workflow run produced it\n", a.ID)
+		return false
+	}
+
+	run, err := u.runs.Run(u, a.WorkflowRun.ID)
+	conclusion := run.Conclusion
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Skipping artifact %d, unable to look up workflow run %d: %s\n", a.ID, a.WorkflowRun.ID, err)
+		return false
+	}
+
+	if conclusion != u.requireConclusion {
+		fmt.Fprintf(os.Stderr, "Skipping artifact %d, workflow run %d concluded with %q\n", a.ID, a.WorkflowRun.ID, conclusion)
+		return false
+	}
+
+	return true
+}
+
+type repositoryInfo struct {
+	FullName   string `json:"full_name"`
+	Private    bool   `json:"private"`
+	Visibility string `json:"visibility"`
+}
+
+// IsPublic falls back to the private flag for GitHub Enterprise versions that
+// don't report the visibility.
+func (r repositoryInfo) IsPublic() bool {
+	if r.Visibility != "" {
+		return r.Visibility == "public"
+	}
+
+	return !r.Private
+}
+
+// repoCache remembers looked up repositories, shared between the copies of an
+// updater.
+type repoCache struct {
+	mu           sync.Mutex
+	repositories map[string]repositoryInfo
+}
+
+func (c *repoCache) Repository(u updater) (repositoryInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if info, ok := c.repositories[u.repository]; ok {
+		return info, nil
+	}
+
+	var info repositoryInfo
+
+	if _, err := u.fetchJSON(u.RepositoryInfoURL(), &info, nil, ""); err != nil {
+		return info, err
+	}
+
+	c.repositories[u.repository] = info
+
+	return info, nil
+}
+
+// WarnIfPublic prints a warning with -warn-public when the artifacts come
+// from a public repository, where they may be downloadable by anyone. The
+// check is informational and never fails the deploy.
+func (u updater) WarnIfPublic() {
+	if !u.warnPublic {
+		return
+	}
+
+	info, err := u.repositories.Repository(u)
+
+	if err != nil {
+		fmt.Println(colorBlue, "Warning: unable to check the visibility of repository", u.repository+":", err, colorReset)
+		return
+	}
+
+	if info.IsPublic() {
+		fmt.Println(colorBlue, "Warning: repository", u.repository, "is public and its artifacts may be accessible to anyone, make sure it's the intended source", colorReset)
+	}
+}
+
+// runCache remembers looked up workflow runs, shared between the copies of an
+// updater.
+type runCache struct {
+	mu   sync.Mutex
+	runs map[int]workflowRun
+}
+
+// Run returns the workflow run, fetching it again until it completed, as runs
+// in progress have no conclusion yet.
+func (c *runCache) Run(u updater, runID int) (workflowRun, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if run, ok := c.runs[runID]; ok && run.Status == "completed" {
+		return run, nil
+	}
+
+	var run workflowRun
+
+	if _, err := u.fetchJSON(u.RunURL(runID), &run, nil, ""); err != nil {
+		return run, err
+	}
+
+	c.runs[runID] = run
+
+	return run, nil
+}
+
+// WaitForArtifact polls the artifacts listing until an accepted artifact shows
+// up or -wait-timeout elapses. When GitHub reports the rate limit as used up,
+// the next poll waits for it to reset.
+func (u updater) WaitForArtifact() (artifact, error) {
+	deadline := time.Now().Add(u.waitTimeout)
+	poller := u
+	poller.refresh = true
+
+	for {
+		artifact, err := poller.FindArtifact()
+
+		if err == nil {
+			return artifact, nil
+		}
+
+		if !errors.Is(err, errNoArtifacts) && !errors.Is(err, errNoSuitableArtifact) && exitCode(err) != exitHTTPError {
+			return artifact, err
+		}
+
+		delay := u.pollInterval
+
+		if u.stats.RateLimitRemaining == 0 && time.Until(u.stats.RateLimitReset) > delay {
+			delay = time.Until(u.stats.RateLimitReset)
+			fmt.Printf("Rate limit used up, waiting until %s\n", u.stats.RateLimitReset.Format(time.RFC3339))
+		}
+
+		if time.Now().Add(delay).After(deadline) {
+			return artifact, &NotFoundError{Message: fmt.Sprintf("no suitable artifact appeared within %s", u.waitTimeout)}
+		}
+
+		fmt.Printf("No suitable artifact yet (%s), checking again in %s\n", err, delay.Round(time.Second))
+		time.Sleep(delay)
+	}
+}
+
+// MatchesName tells whether an artifact name is the one to deploy, using the
+// -name-regexp or -name-prefix when given and the exact -a name otherwise.
+// With -channel the -a name has to be followed by -channel-separator and the
+// channel, like app@stable, so names without a channel suffix never match.
+func (u updater) MatchesName(name string) bool {
+	if u.nameRegexp != nil {
+		return u.nameRegexp.MatchString(name)
+	}
+
+	if u.namePrefix != "" {
+		return strings.HasPrefix(name, u.namePrefix)
+	}
+
+	if u.channel != "" {
+		return name == u.artifactName+u.channelSeparator+u.channel
+	}
+
+	return name == u.artifactName
+}
+
+// Fallback returns an updater for the -fallback-repo repository, sharing the
+// rest of the settings. The cache file is left to the primary repository,
+// -cache-dir has an entry for each repository anyway.
+func (u updater) Fallback() updater {
+	fallback := u
+	fallback.repository = u.fallbackRepository
+	fallback.fallbackRepository = ""
+	fallback.cacheFile = ""
+
+	return fallback
+}
+
+// ForArtifact returns an updater for one artifact of a multi-artifact run,
+// extracting into the directory -artifact-dir maps it to, or a subdirectory
+// of the asset directory named after it.
+func (u updater) ForArtifact(name string) updater {
+	target := u
+	target.artifactName = name
+	target.artifactNames = nil
+	target.directory = filepath.Join(u.directory, name)
+
+	if directory, ok := u.artifactDirs[name]; ok {
+		target.directory = directory
+	}
+
+	return target
+}
+
+// parseArtifactDirs turns `name=directory` strings into a map by artifact
+// name.
+func parseArtifactDirs(values []string) (map[string]string, error) {
+	dirs := make(map[string]string)
+
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, errors.New("invalid -artifact-dir value, expected `name=directory`")
+		}
+
+		dirs[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return dirs, nil
+}
+
+// ForDestination returns a copy of the updater deploying into the subdirectory
+// of the asset directory given by -dest-template, with {name}, {id} and {date}
+// replaced by the artifact name, ID and the UTC date it was last updated.
+func (u updater) ForDestination(a artifact) (updater, error) {
+	if u.destTemplate == "" {
+		return u, nil
+	}
+
+	updatedAt, _ := time.Parse(time.RFC3339, a.UpdatedAt)
+	dest := strings.NewReplacer(
+		"{name}", sanitizePathElement(a.Name),
+		"{id}", strconv.Itoa(a.ID),
+		"{date}", updatedAt.UTC().Format("2006-01-02"),
+	).Replace(u.destTemplate)
+
+	base := filepath.Clean(u.directory)
+	directory := filepath.Join(base, filepath.FromSlash(dest))
+
+	if !strings.HasPrefix(directory, base+string(os.PathSeparator)) {
+		return u, fmt.Errorf("-dest-template resolves to %s outside of %s", directory, base)
+	}
+
+	target := u
+	target.directory = directory
+
+	return target, nil
+}
+
+// sanitizePathElement makes a value safe to use as a single path element,
+// replacing anything besides letters, digits, dots, dashes and underscores.
+func sanitizePathElement(value string) string {
+	sanitized := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+
+		return '_'
+	}, value)
+
+	if strings.Trim(sanitized, ".") == "" {
+		return strings.Repeat("_", len(sanitized)+1)
+	}
+
+	return sanitized
+}
+
+// UpdateAll deploys every artifact given with -a from a single listing, each
+// into its own subdirectory of the asset directory.
+func (u updater) UpdateAll() error {
+	fmt.Printf("Downloading artifacts data of %s, please wait ...\n", u.repository)
+	data, err := u.Artifacts()
+
+	if err != nil {
+		return inPhase("list", err)
+	}
+
+	var selected []artifact
+	failures := make(map[string]error)
+	skipped := make(map[string]bool)
+
+	for _, name := range u.artifactNames {
+		if _, ok := u.artifactDirs[name]; len(u.artifactDirs) > 0 && !ok {
+			if u.strict {
+				return inPhase("select", fmt.Errorf("%s: no directory given with -artifact-dir", name))
+			}
+
+			fmt.Println(colorBlue, "Warning: skipping", name, "without a directory given with -artifact-dir", colorReset)
+			skipped[name] = true
+			continue
+		}
+
+		artifact, err := data.LatestActiveArtifact(func(a artifact) bool {
+			return exactName(name)(a) && u.MatchesRun(a)
+		}, u.selectPolicy)
+
+		if err != nil && u.keepGoing {
+			failures[name] = inPhase("select", err)
+			continue
+		}
+
+		if err != nil {
+			return inPhase("select", fmt.Errorf("%s: %w", name, err))
+		}
+
+		selected = append(selected, artifact)
+	}
+
+	u.WarnIfPublic()
+
+	if u.atomicGroup {
+		return u.DeployGroup(selected)
+	}
+
+	for _, artifact := range selected {
+		base := u.ForArtifact(artifact.Name)
+		target, err := base.ForDestination(artifact)
+
+		if err == nil {
+			err = base.CheckLatestSymlink()
+		}
+
+		if err == nil {
+			err = target.DownloadAndReplace(artifact)
+		}
+
+		if err == nil {
+			err = base.UpdateLatestSymlink(target.directory)
+		}
+
+		if err != nil && !u.keepGoing {
+			return fmt.Errorf("%s: %w", artifact.Name, err)
+		}
+
+		if err != nil {
+			failures[artifact.Name] = err
+		}
+	}
+
+	if !u.keepGoing {
+		return nil
+	}
+
+	var results []targetResult
+
+	for _, name := range u.artifactNames {
+		if skipped[name] {
+			results = append(results, targetResult{Target: name, Status: "skipped"})
+		} else {
+			results = append(results, newTargetResult(name, failures[name]))
+		}
+	}
+
+	return u.ReportTargets("artifacts", results)
+}
+
+// targetResult is the outcome of a single manifest target or -a artifact in
+// the summary printed at the end of the run.
+type targetResult struct {
+	Target string `json:"target"`
+	Status string `json:"status"`
+	Phase  string `json:"phase,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func newTargetResult(target string, err error) targetResult {
+	if err == nil {
+		return targetResult{Target: target, Status: "done"}
+	}
+
+	return targetResult{Target: target, Status: "failed", Phase: failedPhase(err), Error: err.Error()}
+}
+
+type targetsEvent struct {
+	Event   string         `json:"event"`
+	Failed  int            `json:"failed"`
+	Targets []targetResult `json:"targets"`
+}
+
+// ReportTargets prints which phase failed for each target and emits the
+// summary as a targets event for -json. The error tells how many of the
+// targets failed.
+func (u updater) ReportTargets(noun string, results []targetResult) error {
+	failed := 0
+
+	fmt.Println("Summary:")
+
+	for _, result := range results {
+		switch result.Status {
+		case "failed":
+			failed++
+			fmt.Println(colorRed, result.Target, "failed in "+result.Phase+":", result.Error, colorReset)
+		default:
+			fmt.Println(colorGreen, result.Target, result.Status, colorReset)
+		}
+	}
+
+	u.events.Emit(targetsEvent{Event: "targets", Failed: failed, Targets: results})
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d %s failed", failed, len(results), noun)
+	}
+
+	return nil
+}
+
+// Update selects the artifact to deploy, falling back to the -fallback-repo
+// repository when the primary one has nothing suitable, and replaces the
+// directory contents with it.
+func (u updater) Update() error {
+	if len(u.artifactNames) > 1 {
+		return u.UpdateAll()
+	}
+
+	previous, err := u.LastDeploy()
+
+	if err != nil {
+		return err
+	}
+
+	if previous != nil {
+		fmt.Printf("Previously deployed artifact %d was created at %s\n", previous.ArtifactID, previous.CreatedAt)
+
+		if createdAt, err := time.Parse(time.RFC3339, previous.CreatedAt); err == nil && createdAt.After(u.since) {
+			u.since = createdAt
+		}
+	}
+
+	source := u
+	var artifact artifact
+
+	if u.waitForArtifact {
+		artifact, err = u.WaitForArtifact()
+	} else {
+		artifact, err = u.FindArtifact()
+	}
+
+	if u.fallbackRepository != "" && (errors.Is(err, errNoArtifacts) || errors.Is(err, errNoSuitableArtifact)) {
+		fmt.Printf("No suitable artifacts in %s, trying fallback repository %s\n", u.repository, u.fallbackRepository)
+		source = u.Fallback()
+		artifact, err = source.FindArtifact()
+	}
+
+	if errors.Is(err, errNoArtifacts) {
+		fmt.Println(colorBlue, "No artifacts found!", colorReset)
+		return nil
+	}
+
+	if previous != nil && errors.Is(err, errNoSuitableArtifact) {
+		fmt.Printf("No artifact newer than the deployed artifact %d, nothing to do\n", previous.ArtifactID)
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if previous != nil {
+		fmt.Printf("Selected artifact %d created at %s to replace artifact %d\n", artifact.ID, artifact.CreatedAt, previous.ArtifactID)
+	}
+
+	if u.stats.ListingNotModified && source.IsDeployed(artifact) {
+		fmt.Printf("Artifacts didn't change and artifact %d is already deployed, nothing to do\n", artifact.ID)
+		return nil
+	}
+
+	target, err := source.ForDestination(artifact)
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Using artifact %d from repository %s\n", artifact.ID, target.repository)
+	target.WarnIfPublic()
+
+	if err := source.CheckLatestSymlink(); err != nil {
+		return err
+	}
+
+	if err := target.DownloadAndReplace(artifact); err != nil {
+		return err
+	}
+
+	return source.UpdateLatestSymlink(target.directory)
+}
+
+// CheckLatestSymlink makes sure the -update-latest-symlink can be replaced
+// before anything is deployed.
+func (u updater) CheckLatestSymlink() error {
+	if u.latestSymlink == "" {
+		return nil
+	}
+
+	link := filepath.Join(u.directory, u.latestSymlink)
+
+	if info, err := os.Lstat(link); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		return fmt.Errorf("%s: exists and is not a symlink, remove it or pick another -update-latest-symlink name", link)
+	}
+
+	return nil
+}
+
+// UpdateLatestSymlink atomically points the -update-latest-symlink of the
+// asset directory to dest, the -dest-template directory deployed into.
+func (u updater) UpdateLatestSymlink(dest string) error {
+	if u.latestSymlink == "" {
+		return nil
+	}
+
+	relPath, err := filepath.Rel(u.directory, dest)
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Pointing `%s` to %s\n", u.latestSymlink, filepath.ToSlash(relPath))
+
+	if err := swapSymlink(relPath, filepath.Join(u.directory, u.latestSymlink)); err != nil {
+		return fmt.Errorf("unable to update the `%s` symlink: %w", u.latestSymlink, err)
+	}
+
+	return nil
+}
+
+// manifestTarget is one deployment described in a -manifest-file.
+type manifestTarget struct {
+	Repository         string `json:"repository"`
+	Artifact           string `json:"artifact"`
+	Directory          string `json:"directory"`
+	FallbackRepository string `json:"fallback_repository"`
+	APIURL             string `json:"api_url"`
+	Merge              bool   `json:"merge"`
+	Prune              bool   `json:"prune"`
+	SymlinkTarget      bool   `json:"symlink_target"`
+}
+
+// Validate reports the first problem with the target, mirroring the checks
+// done for the command line flags.
+func (t manifestTarget) Validate() error {
+	switch {
+	case t.Repository == "" || t.Directory == "":
+		return errors.New("repository and directory are required")
+	case t.Prune && !t.Merge:
+		return errors.New("prune can only be used together with merge")
+	case t.SymlinkTarget && t.Merge:
+		return errors.New("symlink_target can't be used together with merge")
+	}
+
+	return nil
+}
+
+func (t manifestTarget) String() string {
+	return fmt.Sprintf("%s/%s -> %s", t.Repository, t.Artifact, t.Directory)
+}
+
+// readManifest parses a -manifest-file. Files ending in .csv need a header
+// row naming the columns, anything else is read as a JSON array of targets.
+// Targets without an artifact name use the default one.
+func readManifest(fileName, defaultArtifact string) ([]manifestTarget, error) {
+	file, err := os.Open(fileName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var targets []manifestTarget
+
+	if strings.EqualFold(filepath.Ext(fileName), ".csv") {
+		targets, err = readManifestCSV(file)
+	} else {
+		err = json.NewDecoder(file).Decode(&targets)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse manifest %s: %w", fileName, err)
+	}
+
+	for i := range targets {
+		if targets[i].Artifact == "" {
+			targets[i].Artifact = defaultArtifact
+		}
+
+		if err := targets[i].Validate(); err != nil {
+			return nil, fmt.Errorf("manifest entry %d: %w", i+1, err)
+		}
+	}
+
+	return targets, nil
+}
+
+func readManifestCSV(r io.Reader) ([]manifestTarget, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	var targets []manifestTarget
+	header := records[0]
+
+	for line, record := range records[1:] {
+		var target manifestTarget
+
+		for i, column := range header {
+			value := record[i]
+			var err error
+
+			switch strings.TrimSpace(column) {
+			case "repository":
+				target.Repository = value
+			case "artifact":
+				target.Artifact = value
+			case "directory":
+				target.Directory = value
+			case "fallback_repository":
+				target.FallbackRepository = value
+			case "api_url":
+				target.APIURL = value
+			case "merge":
+				target.Merge, err = parseManifestBool(value)
+			case "prune":
+				target.Prune, err = parseManifestBool(value)
+			case "symlink_target":
+				target.SymlinkTarget, err = parseManifestBool(value)
+			default:
+				err = fmt.Errorf("unknown column %q", column)
+			}
+
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line+2, err)
+			}
+		}
+
+		targets = append(targets, target)
+	}
+
+	return targets, nil
+}
+
+func parseManifestBool(value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+
+	return strconv.ParseBool(value)
+}
+
+// ForTarget returns a copy of the updater configured for a manifest target.
+// Every target gets its own stats so that they can run concurrently.
+func (u updater) ForTarget(t manifestTarget) updater {
+	target := u
+	target.repository = t.Repository
+	target.fallbackRepository = t.FallbackRepository
+
+	if t.APIURL != "" {
+		target.apiURL = t.APIURL
+	}
+	target.directory = t.Directory
+	target.artifactName = t.Artifact
+	target.artifactNames = []string{t.Artifact}
+	target.merge = t.Merge
+	target.prune = t.Prune
+	target.symlinkTarget = t.SymlinkTarget
+	target.stats = &runStats{RateLimitRemaining: -1}
+
+	return target
+}
+
+// UpdateManifest runs Update for every target, at most -concurrency of them
+// at a time, and prints the result of each once all of them are done.
+func (u updater) UpdateManifest(targets []manifestTarget) error {
+	results := make([]error, len(targets))
+	skipped := make([]bool, len(targets))
+	slots := make(chan struct{}, u.concurrency)
+	var wg sync.WaitGroup
+	var checkpointMu sync.Mutex
+
+	progress := newCheckpoint(targets)
+
+	if u.checkpointFile != "" && u.resume {
+		previous, err := readCheckpoint(u.checkpointFile)
+
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if err == nil {
+			if !previous.Matches(progress) {
+				fmt.Println(colorBlue, "Warning: the manifest targets changed since the checkpoint was written", colorReset)
+			}
+
+			if !u.force {
+				for key, completedAt := range previous.Completed {
+					if progress.Has(key) {
+						progress.Completed[key] = completedAt
+					}
+				}
+			}
+		}
+	}
+
+	for i, target := range targets {
+		if completedAt, ok := progress.Completed[target.String()]; ok {
+			fmt.Printf("Skipping %s, completed at %s\n", target, completedAt.Format(time.RFC3339))
+			skipped[i] = true
+			continue
+		}
+
+		wg.Add(1)
+		slots <- struct{}{}
+
+		go func(i int, target manifestTarget) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			fmt.Printf("Updating %s\n", target)
+			targetUpdater := u.ForTarget(target)
+			results[i] = targetUpdater.Update()
+			u.stats.Merge(targetUpdater.stats)
+
+			if results[i] == nil && u.checkpointFile != "" {
+				checkpointMu.Lock()
+				defer checkpointMu.Unlock()
+
+				progress.Completed[target.String()] = time.Now().UTC()
+
+				if err := progress.Write(u.checkpointFile); err != nil {
+					fmt.Println(colorRed, "Unable to write checkpoint:", err, colorReset)
+				}
+			}
+		}(i, target)
+	}
+
+	wg.Wait()
+
+	summary := make([]targetResult, len(targets))
+
+	for i, target := range targets {
+		if skipped[i] {
+			summary[i] = targetResult{Target: target.String(), Status: "skipped"}
+		} else {
+			summary[i] = newTargetResult(target.String(), results[i])
+		}
+	}
+
+	return u.ReportTargets("manifest targets", summary)
+}
+
+// checkpoint records which manifest targets completed, so an interrupted run
+// can be resumed with -resume.
+type checkpoint struct {
+	Targets   []string             `json:"targets"`
+	Completed map[string]time.Time `json:"completed"`
+}
+
+func newCheckpoint(targets []manifestTarget) *checkpoint {
+	progress := &checkpoint{Completed: make(map[string]time.Time)}
+
+	for _, target := range targets {
+		progress.Targets = append(progress.Targets, target.String())
+	}
+
+	return progress
+}
+
+func readCheckpoint(fileName string) (*checkpoint, error) {
+	body, err := os.ReadFile(fileName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var progress checkpoint
+
+	if err := json.Unmarshal(body, &progress); err != nil {
+		return nil, fmt.Errorf("unable to parse checkpoint %s: %w", fileName, err)
+	}
+
+	return &progress, nil
+}
+
+// Has tells whether the target is part of the checkpointed manifest.
+func (c *checkpoint) Has(key string) bool {
+	for _, target := range c.Targets {
+		if target == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Matches tells whether both checkpoints were made for the same targets.
+func (c *checkpoint) Matches(other *checkpoint) bool {
+	if len(c.Targets) != len(other.Targets) {
+		return false
+	}
+
+	for _, target := range c.Targets {
+		if !other.Has(target) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *checkpoint) Write(fileName string) error {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+
+	if err := encoder.Encode(c); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(fileName, buffer.Bytes(), 0644)
+}
+
+// eventWriter writes newline delimited JSON events for -json. Progress events
+// of a phase are limited to ten per second, apart from the final one.
+type eventWriter struct {
+	mu       sync.Mutex
+	encoder  *json.Encoder
+	reported map[string]time.Time
+}
+
+func newEventWriter(w io.Writer) *eventWriter {
+	return &eventWriter{encoder: json.NewEncoder(w), reported: make(map[string]time.Time)}
+}
+
+type progressEvent struct {
+	Event   string `json:"event"`
+	Phase   string `json:"phase"`
+	Current int64  `json:"current"`
+	Total   int64  `json:"total"`
+}
+
+type errorEvent struct {
+	Event    string `json:"event"`
+	Code     string `json:"code"`
+	ExitCode int    `json:"exit_code"`
+	Message  string `json:"message"`
+}
+
+type summaryEvent struct {
+	Event           string  `json:"event"`
+	Success         bool    `json:"success"`
+	Error           string  `json:"error,omitempty"`
+	BytesDownloaded int64   `json:"bytes_downloaded"`
+	FilesExtracted  int     `json:"files_extracted"`
+	Changed         *bool   `json:"changed,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// Emit writes a single event. It does nothing on a nil writer, so callers
+// don't have to check whether -json is in use.
+func (e *eventWriter) Emit(event interface{}) {
+	if e == nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.encoder.Encode(event)
+}
+
+func (e *eventWriter) Progress(phase string, current, total int64) {
+	if e == nil {
+		return
+	}
+
+	e.mu.Lock()
+	last := e.reported[phase]
+	done := total > 0 && current >= total
+
+	if !done && time.Since(last) < 100*time.Millisecond {
+		e.mu.Unlock()
+		return
+	}
+
+	e.reported[phase] = time.Now()
+	e.mu.Unlock()
+
+	e.Emit(progressEvent{Event: "progress", Phase: phase, Current: current, Total: total})
+}
+
+// ReportsProgress tells whether progress goes to -json events or the
+// -progress-file.
+func (u updater) ReportsProgress() bool {
+	return u.events != nil || u.progress != nil
+}
+
+func (u updater) ReportProgress(phase string, current, total int64) {
+	u.events.Progress(phase, current, total)
+	u.progress.Write(phase, current, total)
+}
+
+func (u updater) ExtractProgress(current, total int64) {
+	u.ReportProgress("extract", current, total)
+}
+
+// progressFile keeps the -progress-file up to date for supervisors polling
+// it. Writes are limited to one per second, apart from the final one of a
+// phase, and replace the file atomically.
+type progressFile struct {
+	mu       sync.Mutex
+	fileName string
+	keep     bool
+	written  time.Time
+}
+
+func newProgressFile(fileName string, keep bool) *progressFile {
+	if fileName == "" {
+		return nil
+	}
+
+	return &progressFile{fileName: fileName, keep: keep}
+}
+
+type progressState struct {
+	Phase     string `json:"phase"`
+	Current   int64  `json:"current"`
+	Total     int64  `json:"total"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+type progressSummary struct {
+	Phase           string `json:"phase"`
+	Success         bool   `json:"success"`
+	Error           string `json:"error,omitempty"`
+	BytesDownloaded int64  `json:"bytes_downloaded"`
+	FilesExtracted  int    `json:"files_extracted"`
+	UpdatedAt       string `json:"updated_at"`
+}
+
+// Write records the progress of a phase. It does nothing on a nil
+// progressFile, like the eventWriter.
+func (p *progressFile) Write(phase string, current, total int64) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	done := total > 0 && current >= total
+
+	if !done && time.Since(p.written) < time.Second {
+		return
+	}
+
+	p.written = time.Now()
+	p.write(progressState{Phase: phase, Current: current, Total: total, UpdatedAt: p.written.UTC().Format(time.RFC3339)})
+}
+
+// Finish removes the file at the end of the run or, with
+// -keep-progress-file, replaces it with a summary of the run.
+func (p *progressFile) Finish(stats *runStats, err error) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.keep {
+		os.Remove(p.fileName)
+		return
+	}
+
+	summary := progressSummary{
+		Phase:           "done",
+		Success:         err == nil,
+		BytesDownloaded: stats.BytesDownloaded,
+		FilesExtracted:  stats.FilesExtracted,
+		UpdatedAt:       time.Now().UTC().Format(time.RFC3339),
+	}
+
+	if err != nil {
+		summary.Error = err.Error()
+	}
+
+	p.write(summary)
+}
+
+func (p *progressFile) write(state interface{}) {
+	body, err := json.Marshal(state)
+
+	if err == nil {
+		err = writeFileAtomic(p.fileName, append(body, '\n'), 0644)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write the progress file: %s\n", err)
+	}
+}
+
+// Error writes the event of the error the run failed with, after the summary.
+func (e *eventWriter) Error(err error) {
+	e.Emit(errorEvent{Event: "error", Code: errorCode(err), ExitCode: exitCode(err), Message: err.Error()})
+}
+
+// Summary writes the event closing the run, which fail follows with an error
+// event.
+func (e *eventWriter) Summary(stats *runStats, started time.Time, err error) {
+	event := summaryEvent{
+		Event:           "summary",
+		Success:         err == nil,
+		BytesDownloaded: stats.BytesDownloaded,
+		FilesExtracted:  stats.FilesExtracted,
+		Changed:         stats.Changed,
+		DurationSeconds: time.Since(started).Seconds(),
+	}
+
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	e.Emit(event)
+}
+
+type runStats struct {
+	BytesDownloaded int64
+	FilesExtracted  int
+
+	RateLimitRemaining int
+	RateLimitReset     time.Time
+
+	// ListingNotModified is set when the artifacts listing came back as 304
+	ListingNotModified bool
+
+	// Changed tells whether the deployed contents differ from the previous
+	// ones, it stays nil when they weren't compared
+	Changed *bool
+
+	// Deploys are recorded for -report-file only
+	Deploys []*deployRecord
+
+	// mu guards the stats while manifest targets merge theirs concurrently
+	mu sync.Mutex
+}
+
+func (s *runStats) AddDeploy(records ...*deployRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Deploys = append(s.Deploys, records...)
+}
+
+// Merge adds the stats of a manifest target to the ones of the whole run.
+// The rate limit of the target with the fewest requests left is kept, the
+// listing state stays per target.
+func (s *runStats) Merge(target *runStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.BytesDownloaded += target.BytesDownloaded
+	s.FilesExtracted += target.FilesExtracted
+	s.Deploys = append(s.Deploys, target.Deploys...)
+
+	if target.Changed != nil {
+		s.RecordChange(*target.Changed)
+	}
+
+	if target.RateLimitRemaining >= 0 && (s.RateLimitRemaining < 0 || target.RateLimitRemaining < s.RateLimitRemaining) {
+		s.RateLimitRemaining = target.RateLimitRemaining
+		s.RateLimitReset = target.RateLimitReset
+	}
+}
+
+// RecordChange remembers whether a deploy changed the contents, any changed
+// deploy marking the whole run as changed.
+func (s *runStats) RecordChange(changed bool) {
+	if s.Changed == nil || changed {
+		s.Changed = &changed
+	}
+}
+
+// RecordRateLimit remembers the rate limit state GitHub reported with the
+// response. RateLimitRemaining stays -1 when the headers are missing.
+func (s *runStats) RecordRateLimit(resp *http.Response) {
+	s.RateLimitRemaining = -1
+
+	if remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining")); err == nil {
+		s.RateLimitRemaining = remaining
+	}
+
+	if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		s.RateLimitReset = time.Unix(reset, 0)
+	}
+}
+
+const exitNoArtifact int = 2
+const exitStaleArtifact int = 3
+
+// Probe checks whether a matching artifact exists using only the artifacts
+// listing and prints a single line about it. It returns the exit code: 0 when
+// an artifact was found, exitNoArtifact when there is none and
+// exitStaleArtifact when it is older than -max-age. Combined with -cache-file
+// it is cheap enough to run every minute.
+func (u updater) Probe() (int, error) {
+	data, err := u.Artifacts()
+
+	if err != nil {
+		return 1, err
+	}
+
+	rateLimit := ""
+
+	if u.stats.RateLimitRemaining >= 0 {
+		rateLimit = fmt.Sprintf(" rate_limit_remaining=%d", u.stats.RateLimitRemaining)
+
+		if u.stats.RateLimitRemaining < 10 {
+			fmt.Fprintf(os.Stderr, "Warning: only %d API requests left until %s, poll less frequently or use -cache-file\n", u.stats.RateLimitRemaining, u.stats.RateLimitReset.Format(time.RFC3339))
+		}
+	}
+
+	artifact, err := data.LatestActiveArtifact(u.Accepts, u.selectPolicy)
+
+	if err != nil {
+		fmt.Printf("missing%s\n", rateLimit)
+		return exitNoArtifact, nil
+	}
+
+	age := time.Since(artifact.CreatedAtTime()).Round(time.Second)
+	status := "found"
+	code := 0
+
+	if u.maxAge > 0 && age > u.maxAge {
+		status = "stale"
+		code = exitStaleArtifact
+	}
+
+	fmt.Printf("%s name=%s id=%d created_at=%s age=%s%s\n", status, artifact.Name, artifact.ID, artifact.CreatedAt, age, rateLimit)
+
+	return code, nil
+}
+
+// CompareRemote compares the artifact recorded in the state marker with the
+// latest one in the artifacts listing without downloading anything else. It
+// returns the exit code: 0 when the deployed artifact is the latest,
+// exitNoArtifact when there is nothing to deploy and exitStaleArtifact when
+// a different or updated artifact is available or nothing was deployed yet.
+func (u updater) CompareRemote() (int, error) {
+	state, err := u.ReadState()
+
+	if err != nil && !os.IsNotExist(err) {
+		return 1, err
+	}
+
+	if err == nil {
+		fmt.Printf("deployed name=%s id=%d updated_at=%s\n", state.ArtifactName, state.ArtifactID, state.UpdatedAt)
+	} else {
+		fmt.Println("deployed none")
+	}
+
+	data, err := u.Artifacts()
+
+	if err != nil {
+		return 1, err
+	}
+
+	latest, err := data.LatestActiveArtifact(u.Accepts, u.selectPolicy)
+
+	if err != nil {
+		fmt.Println("available none")
+		return exitNoArtifact, nil
+	}
+
+	fmt.Printf("available name=%s id=%d updated_at=%s\n", latest.Name, latest.ID, latest.UpdatedAt)
+
+	if state.ArtifactID != latest.ID || state.UpdatedAt != latest.UpdatedAt {
+		fmt.Println("stale")
+		return exitStaleArtifact, nil
+	}
+
+	fmt.Println("current")
+
+	return 0, nil
+}
+
+// VerifyDeployment hashes the deployed files and compares them with the tree
+// hash recorded in the state marker, without contacting the API. It returns 0
+// when they match, exitChecksumError when they don't and exitNoArtifact when
+// there is no marker or it records no tree hash.
+func (u updater) VerifyDeployment() (int, error) {
+	state, err := u.ReadState()
+
+	if os.IsNotExist(err) {
+		fmt.Printf("No deployment to verify, %s has no state marker\n", u.directory)
+		return exitNoArtifact, nil
+	}
+
+	if err != nil {
+		return 1, fmt.Errorf("unable to read the state marker: %w", err)
+	}
+
+	fmt.Printf("Deployed artifact %s (%d) of %s at %s\n", state.ArtifactName, state.ArtifactID, state.Repository, state.DeployedAt)
+
+	if state.TreeHash == "" {
+		fmt.Println("The state marker records no tree hash, deploy again to record one")
+		return exitNoArtifact, nil
+	}
+
+	hashes, err := u.HashContents()
+
+	if err != nil {
+		return 1, err
+	}
+
+	if digest := treeDigest(hashes); digest != state.TreeHash {
+		fmt.Println(colorRed, "Deployed files don't match, recorded tree hash", state.TreeHash, "but found", digest, colorReset)
+		return exitChecksumError, nil
+	}
+
+	fmt.Println(colorGreen, "Deployed files match the recorded tree hash", colorReset)
+
+	return 0, nil
+}
+
+// DiffExitCode extracts the latest artifact into a temporary directory and
+// compares its files with the deployed ones, leaving the asset directory
+// alone. Like git diff --exit-code it returns 0 when they match and 1 when
+// they differ. Files kept with -keep don't count as removed.
+func (u updater) DiffExitCode() (int, error) {
+	artifact, err := u.FindArtifact()
+
+	if err != nil {
+		return 1, err
+	}
+
+	archive, err := tempArchive()
+
+	if err != nil {
+		return 1, err
+	}
+
+	defer os.Remove(archive)
+
+	if err := u.Download(artifact, archive); err != nil {
+		return 1, err
+	}
+
+	if err := u.ValidateArchive(archive); err != nil {
+		return 1, err
+	}
+
+	extracted, err := os.MkdirTemp("", "updater-diff-")
+
+	if err != nil {
+		return 1, err
+	}
+
+	defer os.RemoveAll(extracted)
+
+	if _, err := u.Extract(archive, extracted); err != nil {
+		return 1, err
+	}
+
+	remote, err := hashTree(extracted)
+
+	if err != nil {
+		return 1, err
+	}
+
+	local, err := u.HashContents()
+
+	if err != nil {
+		return 1, err
+	}
+
+	diff := diffTrees(local, remote)
+	removed := diff.Removed[:0]
+
+	for _, relPath := range diff.Removed {
+		if !u.IsKept(filepath.FromSlash(relPath)) {
+			removed = append(removed, relPath)
+		}
+	}
+
+	diff.Removed = removed
+	fmt.Printf("Comparing %s with artifact %d\n", u.ContentDirectory(), artifact.ID)
+
+	if diff.IsEmpty() {
+		fmt.Println("No differences")
+		return 0, nil
+	}
+
+	u.PrintTreeDiff(diff)
+
+	return 1, nil
+}
+
+const metricLastSuccess string = "updater_last_success_timestamp_seconds"
+
+// WriteMetrics writes the run results in the node_exporter textfile collector
+// format. The last success timestamp is carried over from the previous file
+// when the run failed, so it keeps pointing at the last good deploy.
+func (u updater) WriteMetrics(fileName string, started time.Time, success bool) error {
+	var lastSuccess int64
+	successValue := 0
+
+	if success {
+		lastSuccess = time.Now().Unix()
+		successValue = 1
+	} else if previous, err := os.ReadFile(fileName); err == nil {
+		for _, line := range strings.Split(string(previous), "\n") {
+			if strings.HasPrefix(line, metricLastSuccess+" ") {
+				lastSuccess, _ = strconv.ParseInt(strings.TrimPrefix(line, metricLastSuccess+" "), 10, 64)
+			}
+		}
+	}
+
+	var buffer bytes.Buffer
+	metric := func(name, help string, value interface{}) {
+		fmt.Fprintf(&buffer, "# HELP %s %s\n# TYPE %s gauge\n%s %v\n", name, help, name, name, value)
+	}
+
+	metric("updater_last_run_success", "Whether the last run succeeded.", successValue)
+	metric("updater_last_run_timestamp_seconds", "Unix time of the last run.", started.Unix())
+	metric("updater_last_run_duration_seconds", "Duration of the last run in seconds.", time.Since(started).Seconds())
+	metric("updater_last_run_downloaded_bytes", "Bytes downloaded during the last run.", u.stats.BytesDownloaded)
+	metric("updater_last_run_extracted_files", "Files extracted during the last run.", u.stats.FilesExtracted)
+
+	if lastSuccess > 0 {
+		metric(metricLastSuccess, "Unix time of the last successful run.", lastSuccess)
+	}
+
+	return writeFileAtomic(fileName, buffer.Bytes(), 0644)
+}
+
+// version is set at build time, like -ldflags "-X main.version=1.2.3".
+var version = "dev"
+
+type runReport struct {
+	RunID           string          `json:"run_id"`
+	Version         string          `json:"version"`
+	StartedAt       time.Time       `json:"started_at"`
+	FinishedAt      time.Time       `json:"finished_at"`
+	DurationSeconds float64         `json:"duration_seconds"`
+	Success         bool            `json:"success"`
+	Error           string          `json:"error,omitempty"`
+	BytesDownloaded int64           `json:"bytes_downloaded"`
+	Deploys         []*deployRecord `json:"deploys"`
+}
+
+// deployRecord describes one deployed artifact in the -report-file, with the
+// state markers of the directory before and after.
+type deployRecord struct {
+	Repository string       `json:"repository"`
+	Directory  string       `json:"directory"`
+	Artifact   artifact     `json:"artifact"`
+	SHA256     string       `json:"sha256,omitempty"`
+	Files      int          `json:"files"`
+	Error      string       `json:"error,omitempty"`
+	Previous   *deployState `json:"previous_state"`
+	Next       *deployState `json:"next_state"`
+}
+
+// NewDeployRecord starts the record of a deploy into the asset directory.
+func (u updater) NewDeployRecord(a artifact) *deployRecord {
+	record := &deployRecord{Repository: u.repository, Directory: u.directory, Artifact: a}
+
+	if state, err := u.ReadState(); err == nil {
+		record.Previous = &state
+	}
+
+	return record
+}
+
+// WriteReport writes the -report-file of the run.
+func (u updater) WriteReport(fileName, runID string, started time.Time, runErr error) error {
+	report := runReport{
+		RunID:           runID,
+		Version:         version,
+		StartedAt:       started.UTC(),
+		FinishedAt:      time.Now().UTC(),
+		DurationSeconds: time.Since(started).Seconds(),
+		Success:         runErr == nil,
+		BytesDownloaded: u.stats.BytesDownloaded,
+		Deploys:         u.stats.Deploys,
+	}
+
+	if runErr != nil {
+		report.Error = runErr.Error()
+	}
+
+	if report.Deploys == nil {
+		report.Deploys = []*deployRecord{}
+	}
+
+	body, err := json.MarshalIndent(report, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(fileName, append(body, '\n'), 0644)
+}
+
+// newRunID returns a random version 4 UUID.
+func newRunID() (string, error) {
+	id := make([]byte, 16)
+
+	if _, err := cryptorand.Read(id); err != nil {
+		return "", err
+	}
+
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:]), nil
+}
+
+// config holds the effective settings of a run as resolved from the command
+// line flags and the environment.
+type config struct {
+	Repository           string     `json:"repository"`
+	FallbackRepository   string     `json:"fallback_repository"`
+	APIURL               string     `json:"api_url"`
+	Token                string     `json:"token"`
+	TokenFile            string     `json:"token_file"`
+	Tokens               stringList `json:"tokens"`
+	Netrc                string     `json:"netrc"`
+	TokenStdin           bool       `json:"token_stdin"`
+	TokenCmd             string     `json:"token_cmd"`
+	Directory            string     `json:"directory"`
+	ArtifactNames        stringList `json:"artifacts"`
+	ArtifactDirs         stringList `json:"artifact_dirs"`
+	Strict               bool       `json:"strict"`
+	NamePrefix           string     `json:"name_prefix"`
+	Channel              string     `json:"channel"`
+	ChannelSeparator     string     `json:"channel_separator"`
+	NameRegexp           string     `json:"name_regexp"`
+	AtomicGroup          bool       `json:"atomic_group"`
+	KeepGoing            bool       `json:"keep_going"`
+	NoExtract            bool       `json:"no_extract"`
+	Output               string     `json:"output"`
+	List                 bool       `json:"list"`
+	Format               string     `json:"format"`
+	OnlyActive           bool       `json:"only_active"`
+	Grep                 string     `json:"grep"`
+	Sort                 string     `json:"sort"`
+	Merge                bool       `json:"merge"`
+	Prune                bool       `json:"prune"`
+	RequireEmpty         bool       `json:"require_empty"`
+	DestOwnerCheck       bool       `json:"dest_owner_check"`
+	DestOwner            string     `json:"dest_owner"`
+	IKnowWhatImDoing     bool       `json:"i_know_what_im_doing"`
+	Force                bool       `json:"force"`
+	Confirm              bool       `json:"confirm"`
+	Yes                  bool       `json:"yes"`
+	SkipNewer            bool       `json:"skip_newer"`
+	ResumeExtract        bool       `json:"resume_extract"`
+	NormalizeEOL         bool       `json:"normalize_eol"`
+	Umask                string     `json:"umask"`
+	LongPaths            bool       `json:"long_paths"`
+	TextGlobs            stringList `json:"text_globs"`
+	BestEffort           bool       `json:"best_effort"`
+	AllowPaths           stringList `json:"allow_paths"`
+	ExtractWorkers       int        `json:"extract_workers"`
+	ExtractWorkersAuto   bool       `json:"extract_workers_auto"`
+	ExpectMinFiles       int        `json:"expect_min_files"`
+	ExpectMaxFiles       int        `json:"expect_max_files"`
+	Keep                 stringList `json:"keep"`
+	EnsureDirs           stringList `json:"ensure_dirs"`
+	PermissionsFrom      string     `json:"permissions_from"`
+	Fsync                bool       `json:"fsync"`
+	Subpath              string     `json:"subpath"`
+	DestTemplate         string     `json:"dest_template"`
+	LatestSymlink        string     `json:"update_latest_symlink"`
+	CacheFile            string     `json:"cache_file"`
+	Cache                bool       `json:"cache"`
+	CacheDir             string     `json:"cache_dir"`
+	CacheTTL             duration   `json:"cache_ttl"`
+	Refresh              bool       `json:"refresh"`
+	SymlinkTarget        bool       `json:"symlink_target"`
+	KeepReleases         int        `json:"keep_releases"`
+	ChmodExec            stringList `json:"chmod_exec"`
+	MetricsFile          string     `json:"metrics_file"`
+	ReportFile           string     `json:"report_file"`
+	ProgressFile         string     `json:"progress_file"`
+	KeepProgressFile     bool       `json:"keep_progress_file"`
+	FailOnExpired        bool       `json:"fail_on_expired"`
+	WithLogs             bool       `json:"with_logs"`
+	FromLatestRun        bool       `json:"from_latest_run"`
+	RunID                int        `json:"run_id"`
+	RequireConclusion    string     `json:"require_conclusion"`
+	WarnPublic           bool       `json:"warn_public"`
+	Commit               string     `json:"commit"`
+	Workflow             string     `json:"workflow"`
+	MaxDownloadSize      byteSize   `json:"max_download_size"`
+	MaxResponseSize      byteSize   `json:"max_response_size"`
+	DownloadChunks       int        `json:"download_chunks"`
+	MinFreeSpace         byteSize   `json:"min_free_space"`
+	SpaceReport          bool       `json:"space_report"`
+	MaxBandwidth         bandwidth  `json:"max_bandwidth"`
+	Retries              int        `json:"retries"`
+	RetryBackoff         duration   `json:"retry_backoff"`
+	RetryJitter          bool       `json:"retry_jitter"`
+	RateLimit            int        `json:"rate_limit"`
+	RateBurst            int        `json:"rate_burst"`
+	Resolver             string     `json:"resolver"`
+	HTTP1                bool       `json:"http1"`
+	RetryCorrupt         bool       `json:"retry_corrupt"`
+	SignatureURL         string     `json:"sig_url"`
+	PublicKey            string     `json:"public_key"`
+	HeadOnly             bool       `json:"head_only"`
+	CompareRemote        bool       `json:"compare_remote"`
+	DiffExitCode         bool       `json:"-"`
+	MaxAge               duration   `json:"max_age"`
+	Headers              stringList `json:"headers"`
+	DumpResponse         string     `json:"dump_response"`
+	DumpHeaders          bool       `json:"dump_headers"`
+	Trace                bool       `json:"trace"`
+	Since                string     `json:"since"`
+	SinceLastDeploy      bool       `json:"since_last_deploy"`
+	Select               string     `json:"select"`
+	WaitForArtifact      bool       `json:"wait_for_artifact"`
+	WaitTimeout          duration   `json:"wait_timeout"`
+	PollInterval         duration   `json:"poll_interval"`
+	Backup               bool       `json:"backup"`
+	BackupDir            string     `json:"backup_dir"`
+	Reversible           bool       `json:"reversible"`
+	PatchDir             string     `json:"patch_dir"`
+	KeepBackups          int        `json:"keep_backups"`
+	CompressBackups      bool       `json:"compress_backups"`
+	KeepArchive          bool       `json:"keep_archive"`
+	ArchiveDir           string     `json:"archive_dir"`
+	KeepArchives         int        `json:"keep_archives"`
+	Rollback             bool       `json:"-"`
+	Revert               string     `json:"-"`
+	VerifyDeployment     bool       `json:"-"`
+	DiffSummary          bool       `json:"diff_summary"`
+	PostHook             string     `json:"post_hook"`
+	PostHookOnlyOnChange bool       `json:"post_hook_only_on_change"`
+	FileManifest         string     `json:"file_manifest"`
+	FileURL              string     `json:"file_url"`
+	ValidateCmd          string     `json:"validate_cmd"`
+	ScanCmd              string     `json:"scan_cmd"`
+	QuarantineDir        string     `json:"quarantine_dir"`
+	HealthURL            string     `json:"health_url"`
+	HealthTimeout        duration   `json:"health_timeout"`
+	HealthInterval       duration   `json:"health_interval"`
+	RollbackOnHealthFail bool       `json:"rollback_on_health_fail"`
+	Verbose              bool       `json:"verbose"`
+	JSON                 bool       `json:"json"`
+	ManifestFile         string     `json:"manifest_file"`
+	Concurrency          int        `json:"concurrency"`
+	CheckpointFile       string     `json:"checkpoint_file"`
+	Resume               bool       `json:"resume"`
+	PrintConfig          bool       `json:"-"`
+}
+
+// duration is a time.Duration that reads and writes itself as text like `5m`.
+type duration struct {
+	time.Duration
+}
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	value, err := time.ParseDuration(string(text))
+
+	if err != nil {
+		return err
+	}
+
+	d.Duration = value
+	return nil
+}
+
+func (b byteSize) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+func (c *config) RegisterFlags(flags *flag.FlagSet) {
+	c.CacheTTL = duration{5 * time.Minute}
+	c.RetryBackoff = duration{time.Second}
+	c.WaitTimeout = duration{30 * time.Minute}
+	c.PollInterval = duration{30 * time.Second}
+	c.HealthTimeout = duration{time.Minute}
+	c.HealthInterval = duration{2 * time.Second}
+	c.MaxResponseSize = 16 * 1024 * 1024
+
+	flags.StringVar(&c.Repository, "r", "pjotrsavitski/sherpa-helper", "Specify GitHub repository. Default is `pjotrsavitski/sherpa-helper`")
+	flags.StringVar(&c.FallbackRepository, "fallback-repo", "", "Specify a GitHub `repository` to look for the artifact in when the primary one has no suitable artifact, like the upstream of a fork")
+	flags.StringVar(&c.Token, "t", "", "Specify authentication token. Default value is an empty string, in which case the GITHUB_TOKEN environment variable is used")
+	flags.StringVar(&c.TokenFile, "token-file", "", "Read the authentication token from the first line of a `file`. Takes precedence over -t")
+	flags.Var(&c.Tokens, "token", "Specify the authentication token for an API host, like ghe.example.com=TOKEN, for runs across several hosts. Could be repeated, hosts without one use -t")
+	flags.StringVar(&c.Netrc, "netrc", "", "Read the authentication tokens of API hosts from the passwords of a netrc `file`, -token entries take precedence")
+	flags.BoolVar(&c.TokenStdin, "token-stdin", false, "Read the authentication token from the first line of standard input. Takes precedence over -token-file and -t")
+	flags.StringVar(&c.TokenCmd, "token-cmd", "", "Specify a `command` printing the authentication token, run with sh at startup and again when a request is rejected as unauthorized, for short-lived tokens of a secrets broker. Takes precedence over -t")
+	flags.StringVar(&c.Directory, "d", "sherpa4selfie", "Specify asset directory. Default value is `sherpa4selfie` and could also be a fully qualified path")
+	flags.Var(&c.ArtifactNames, "a", "Specify artifact `name`, ${VAR} placeholders are expanded from the environment. Default value is sherpa4selfie. Could be repeated to deploy several artifacts, each into a subdirectory of the asset directory named after it")
+	flags.Var(&c.ArtifactDirs, "artifact-dir", "Specify the directory to deploy an artifact of several -a into, like frontend=/var/www, instead of a subdirectory of the asset directory. Could be repeated, artifacts without one are skipped with a warning")
+	flags.BoolVar(&c.Strict, "strict", false, "Fail instead of skipping artifacts that -artifact-dir doesn't give a directory for")
+	flags.StringVar(&c.NamePrefix, "name-prefix", "", "Select the newest artifact whose name starts with `prefix`, like app-build- for names with a commit suffix. Can't be combined with -a or -name-regexp")
+	flags.StringVar(&c.Channel, "channel", "", "Specify the release `channel` to deploy, selecting the newest artifact named after -a, -channel-separator and the channel, like app@stable. Artifacts without a channel suffix are ignored then")
+	flags.StringVar(&c.ChannelSeparator, "channel-separator", "@", "Specify the `separator` between the artifact name and the -channel")
+	flags.StringVar(&c.NameRegexp, "name-regexp", "", "Select the newest artifact whose name matches the regular `expression`. Can't be combined with -a or -name-prefix")
+	flags.BoolVar(&c.AtomicGroup, "atomic-group", false, "When deploying several artifacts, stage all of them first and replace the directories only if every one of them succeeded")
+	flags.BoolVar(&c.KeepGoing, "keep-going", false, "When deploying several artifacts, carry on after one of them failed and print which phase failed for each of them at the end")
+	flags.BoolVar(&c.NoExtract, "no-extract", false, "Only download the artifact archive, leaving the asset directory untouched")
+	flags.StringVar(&c.Output, "o", "", "Specify the `file` the archive is saved to in -no-extract mode, - writes it to standard output and moves all messages to standard error. Default value is the artifact name with a .zip extension")
+	flags.BoolVar(&c.List, "list", false, "List available artifacts instead of downloading the latest one")
+	flags.BoolVar(&c.OnlyActive, "only-active", false, "Leave expired artifacts out of -list, showing only the ones that can still be downloaded")
+	flags.StringVar(&c.Grep, "grep", "", "Specify a `substring` the artifact names listed by -list have to contain")
+	flags.StringVar(&c.Sort, "sort", "", "Specify the `key` to order -list by: name, date for the newest first or size for the largest first. Default value is the order of the API")
+	flags.StringVar(&c.Format, "format", "table", "Specify output format of the artifact listing, one of table, json or csv. Default value is `table`")
+	flags.BoolVar(&c.Merge, "merge", false, "Extract the artifact over existing directory contents instead of removing them first")
+	flags.BoolVar(&c.BestEffort, "best-effort", false, "Keep extracting past files that can't be written and report all of them at the end, instead of stopping at the first one")
+	flags.Var(&c.AllowPaths, "allow-paths", "Specify a glob `pattern` of paths, relative to the asset directory, the artifact may write files to, like bin/* or a whole directory like web. Archives with other files are rejected before anything is written. Could be repeated")
+	flags.IntVar(&c.ExtractWorkers, "extract-workers", 0, "Specify how many files are extracted at the same time, overriding -extract-workers-auto. Default value is `1`")
+	flags.BoolVar(&c.ExtractWorkersAuto, "extract-workers-auto", false, "Choose the number of extraction workers from the file count and average size of the archive, up to GOMAXPROCS. Printed with -verbose")
+	flags.IntVar(&c.ExpectMinFiles, "expect-min-files", 0, "Fail when the artifact extracts fewer files, directories not counted. Checked before the files go live with -symlink-target or -atomic-group. Disabled by default")
+	flags.IntVar(&c.ExpectMaxFiles, "expect-max-files", 0, "Fail when the artifact extracts more files, directories not counted. Checked like -expect-min-files. Disabled by default")
+	flags.BoolVar(&c.NormalizeEOL, "normalize-eol", false, "Convert CRLF line endings to LF in extracted files matched by -text-glob, leaving files that look binary alone")
+	flags.StringVar(&c.Umask, "umask", "", "Specify an octal `mask` of permission bits to clear from the modes of extracted zip entries and the directories created for them, like 022 to strip the group and other write bits. Modes are kept as in the archive, less the umask of the process, by default")
+	flags.BoolVar(&c.LongPaths, "long-paths", false, "On Windows, write the extracted files through \\\\?\\ prefixed paths, so ones over the 260 character limit can be created without long path support enabled. Ignored on other platforms")
+	flags.Var(&c.TextGlobs, "text-glob", "Specify a glob `pattern` of text files for -normalize-eol, like *.sh, matched against the path in the artifact or base name. Could be repeated")
+	flags.BoolVar(&c.SkipNewer, "skip-newer", false, "In merge mode, don't overwrite files that were modified after the ones in the artifact")
+	flags.BoolVar(&c.ResumeExtract, "resume-extract", false, "In merge mode, skip the files of a zip archive whose size and modification time already match, so that an interrupted extraction only writes the remaining files")
+	flags.BoolVar(&c.RequireEmpty, "require-empty", false, "Refuse to replace a directory that has contents but wasn't deployed by updater before, guarding against a wrong -d")
+	flags.BoolVar(&c.DestOwnerCheck, "dest-owner-check", false, "Refuse to replace an existing directory that isn't owned by the current user, or -dest-owner. Overridden by -force")
+	flags.StringVar(&c.DestOwner, "dest-owner", "", "Specify the `user`, by name or uid, that has to own an existing directory before it is replaced. Implies -dest-owner-check")
+	flags.BoolVar(&c.IKnowWhatImDoing, "i-know-what-im-doing", false, "Allow replacing the protected directories: the file system root, /bin, /boot, /dev, /etc, /home, /lib, /lib64, /proc, /root, /sbin, /sys and /usr themselves, the home directory and the working directory")
+	flags.BoolVar(&c.Force, "force", false, "Replace the directory even when -require-empty or -dest-owner-check would refuse it. With -resume, deploy the targets completed before again, with -since-last-deploy the newest artifact")
+	flags.BoolVar(&c.Confirm, "confirm", false, "Show the directory and the number of files about to be deleted and ask to type yes before clearing it. Without a terminal the run fails instead of asking, unless -yes is given")
+	flags.BoolVar(&c.Yes, "yes", false, "Answer yes to -confirm without asking, for non-interactive runs")
+	flags.BoolVar(&c.Prune, "prune", false, "In merge mode, remove files that are not present in the artifact (except the ones matched by -keep)")
+	flags.StringVar(&c.DestTemplate, "dest-template", "", "Specify a `template` of the subdirectory of the asset directory to deploy into, {name}, {id} and {date} are replaced with artifact name, ID and date it was updated, like {date}/{id}")
+	flags.StringVar(&c.LatestSymlink, "update-latest-symlink", "", "Specify the `name` of a symlink in the asset directory to point to the -dest-template directory of the newest deploy, like latest")
+	flags.StringVar(&c.Subpath, "subpath", "", "Specify a `path` inside the artifact, like web, to extract only the entries under it into the asset directory")
+	flags.StringVar(&c.PermissionsFrom, "permissions-from", "", "Specify a reference `file` whose mode and owner are applied to every extracted file, adding execute bits for directories and executables. Not supported on Windows")
+	flags.BoolVar(&c.Fsync, "fsync", false, "Flush every extracted file and directory to disk before reporting success, so that a power loss can't leave a partial deploy behind. Slows the extraction down")
+	flags.Var(&c.EnsureDirs, "ensure-dir", "Specify a `directory`, relative to the asset directory, to create after extraction when the artifact doesn't contain it. Could be repeated")
+	flags.Var(&c.Keep, "keep", "Specify a glob `pattern` of files to preserve in the directory, matched against relative path or base name. Could be repeated")
+	flags.StringVar(&c.APIURL, "api-url", "https://api.github.com", "Specify GitHub API base URL. Default value is `https://api.github.com`")
+	flags.StringVar(&c.CacheFile, "cache-file", "", "Specify a `file` to cache the artifacts listing in. Caching is disabled by default")
+	flags.BoolVar(&c.Cache, "cache", false, "Cache the artifacts listing of every repository across runs for -cache-ttl, keyed by repository and API URL, and remove expired entries on startup")
+	flags.StringVar(&c.CacheDir, "cache-dir", "", "Specify the `directory` -cache keeps its entries in, implies -cache. Default value is updater in XDG_CACHE_HOME or ~/.cache")
+	flags.TextVar(&c.CacheTTL, "cache-ttl", c.CacheTTL, "Specify how long the cached artifacts listing is used. Default value is `5m`")
+	flags.BoolVar(&c.Refresh, "refresh", false, "Ignore the cached artifacts listing and fetch a fresh one")
+	flags.BoolVar(&c.SymlinkTarget, "symlink-target", false, "Extract into a timestamped directory under releases/ of the asset directory and atomically point the current symlink to it")
+	flags.IntVar(&c.KeepReleases, "keep-releases", 0, "Specify how many releases to keep in symlink target mode. Default value is 0 which keeps all of them")
+	flags.Var(&c.ChmodExec, "chmod-exec", "Specify a glob `pattern` of extracted files, relative to the asset directory, to make executable. Could be repeated")
+	flags.StringVar(&c.MetricsFile, "metrics-file", "", "Specify a `file` to write Prometheus textfile collector metrics of the run to. Disabled by default")
+	flags.StringVar(&c.ReportFile, "report-file", "", "Specify a `file` to write a JSON report of the run to, with a run ID, the version, the deployed artifacts with their checksums and file counts and the state markers before and after. Disabled by default")
+	flags.StringVar(&c.ProgressFile, "progress-file", "", "Specify a `file` to keep the current phase and downloaded or extracted amount in as JSON, replaced at most once a second, for a supervisor to poll. Removed when the run ends")
+	flags.BoolVar(&c.KeepProgressFile, "keep-progress-file", false, "Leave a summary of the run in -progress-file when it ends instead of removing it")
+	flags.BoolVar(&c.FailOnExpired, "fail-on-expired", true, "Abort with an error when the selected artifact has expired. Use -fail-on-expired=false to attempt the download anyway")
+	flags.BoolVar(&c.FromLatestRun, "from-latest-run", false, "Select the artifacts from the latest successful run of -workflow instead of the newest ones of the repository, so that several -a come from the same build")
+	flags.IntVar(&c.RunID, "run-id", 0, "Specify the `id` of a workflow run to select the artifacts from, like an upstream step reported it, instead of the newest ones of the repository")
+	flags.StringVar(&c.Workflow, "workflow", "", "Specify the workflow `file` name (like build.yml) or ID used by -from-latest-run")
+	flags.StringVar(&c.Commit, "commit", "", "Only use artifacts built from the commit `SHA`, which may be abbreviated, for deploys pinned to a commit")
+	flags.StringVar(&c.RequireConclusion, "require-conclusion", "", "Only use artifacts whose workflow run completed with the `conclusion`, like success, looking each run up once")
+	flags.BoolVar(&c.WarnPublic, "warn-public", false, "Print a warning when the artifact comes from a public repository, where it may be accessible to anyone")
+	flags.BoolVar(&c.WithLogs, "with-logs", false, "Also download the logs of the workflow run that produced the artifact next to the asset directory")
+	flags.Var(&c.MaxDownloadSize, "max-download-size", "Specify the maximum `size` of a download, like 500MB or 2GB. Unlimited by default")
+	flags.Var(&c.MaxResponseSize, "max-response-size", "Specify the maximum `size` of an API response, like the artifacts listing, read into memory, 0 disables the limit")
+	flags.IntVar(&c.DownloadChunks, "download-chunks", 0, "Specify the `number` of byte ranges to download an archive in concurrently, when the storage host supports range requests. Not used with -max-bandwidth or -o -. Default value is a single stream")
+	flags.Var(&c.MinFreeSpace, "min-free-space", "Specify the `size` of free space, like 2GB, that has to be left on the file system of the asset directory after extraction, which also needs a free inode per archive entry. Disabled by default")
+	flags.BoolVar(&c.SpaceReport, "space-report", false, "Print the uncompressed size of the artifact and the free space on the file system of the asset directory before and after extracting it, without refusing the deploy")
+	flags.Var(&c.MaxBandwidth, "max-bandwidth", "Specify the approximate maximum download `rate`, like 5MB/s. Unlimited by default")
+	flags.IntVar(&c.Retries, "retries", 2, "Specify how many times failed requests are retried. Default value is `2`")
+	flags.TextVar(&c.RetryBackoff, "retry-backoff", c.RetryBackoff, "Specify the initial delay between retries, doubled with each retry. Default value is `1s`")
+	flags.BoolVar(&c.RetryJitter, "retry-jitter", true, "Randomize retry delays between zero and the backoff. Use -retry-jitter=false for deterministic delays")
+	flags.IntVar(&c.RateLimit, "rate-limit", 5000, "Specify how many requests an hour all targets of the run may send together, 0 disables the limit. Default value is `5000`, the limit of GitHub for a token")
+	flags.IntVar(&c.RateBurst, "rate-burst", 100, "Specify how many requests may be sent at once before -rate-limit spaces them out. Default value is `100`")
+	flags.StringVar(&c.Resolver, "resolver", "", "Specify the `ip:port` of a DNS server to resolve the API and download host names with, like 10.0.0.53:53 or [fd00::53]:53 for IPv6. The system resolver is used by default")
+	flags.BoolVar(&c.HTTP1, "http1", false, "Force HTTP/1.1 instead of negotiating HTTP/2 with TLS servers. Use it behind proxies that stall or break large downloads over HTTP/2")
+	flags.BoolVar(&c.RetryCorrupt, "retry-corrupt", false, "Download the artifact once more when its archive turns out to be corrupt during validation or extraction")
+	flags.StringVar(&c.SignatureURL, "sig-url", "", "Optional. Specify the `URL` of a detached signature of the artifact archive, {name} and {id} are replaced with artifact name and ID. Requires -public-key")
+	flags.StringVar(&c.PublicKey, "public-key", "", "Optional. Specify a PEM encoded ed25519 or ECDSA public key `file` to verify the archive signature with before extracting. Deploys with a missing or bad signature are aborted")
+	flags.BoolVar(&c.CompareRemote, "compare-remote", false, "Only compare the deployed artifact recorded in the directory with the latest available one, without downloading it. Exits with 0 when current, 2 when nothing is available and 3 when outdated")
+	flags.BoolVar(&c.DiffExitCode, "diff-exit-code", false, "Only compare the deployed files with the ones of the latest artifact, without changing the directory. Exits with 0 when they match and 1 when they differ, like git diff --exit-code")
+	flags.BoolVar(&c.HeadOnly, "head-only", false, "Only check whether a matching artifact exists, without downloading it. Prints a single line and exits with 0 when found, 2 when missing and 3 when older than -max-age")
+	flags.TextVar(&c.MaxAge, "max-age", c.MaxAge, "Specify the `age` after which -head-only reports the artifact as stale, like 2h. Disabled by default")
+	flags.Var(&c.Headers, "header", "Specify an extra `header` like \"X-Api-Key: value\" sent with every request, for example to pass an API gateway. Could be repeated")
+	flags.StringVar(&c.DumpResponse, "dump-response", "", "Specify a `file` to write the raw artifacts listing response to, for debugging")
+	flags.BoolVar(&c.DumpHeaders, "dump-headers", false, "Also write the request and response headers to the -dump-response file, without the Authorization header")
+	flags.BoolVar(&c.Trace, "trace", false, "Log connection reuse, DNS, connect and TLS timings and the time to the first byte of every request to standard error, without headers or query strings")
+	flags.StringVar(&c.Since, "since", "", "Only consider artifacts created after the RFC 3339 `time`, like 2024-06-01T12:00:00Z")
+	flags.BoolVar(&c.SinceLastDeploy, "since-last-deploy", false, "Only deploy an artifact created after the one recorded in the asset directory, so that repeated runs do nothing until a newer build exists. Overridden by -force")
+	flags.StringVar(&c.Select, "select", "newest", "Specify which of several matching artifacts to use, one of newest, largest or smallest, where the newest of equally sized ones is used. Default value is `newest`")
+	flags.BoolVar(&c.WaitForArtifact, "wait-for-artifact", false, "Poll the artifacts listing until a suitable artifact appears, then deploy it. Exits with an error after -wait-timeout")
+	flags.TextVar(&c.WaitTimeout, "wait-timeout", c.WaitTimeout, "Specify how long -wait-for-artifact waits. Default value is `30m`")
+	flags.TextVar(&c.PollInterval, "poll-interval", c.PollInterval, "Specify the delay between polls of -wait-for-artifact. Default value is `30s`")
+	flags.BoolVar(&c.Backup, "backup", false, "Copy the current directory contents into a timestamped backup before replacing them")
+	flags.StringVar(&c.BackupDir, "backup-dir", "", "Specify the `directory` backups are kept in. Default value is the asset directory with a .backups suffix")
+	flags.BoolVar(&c.Reversible, "reversible", false, "Instead of clearing the directory, apply only the file creations, overwrites and deletions needed to reach the artifact contents, recording them with the previous files in a patch that -revert can undo")
+	flags.StringVar(&c.PatchDir, "patch-dir", "", "Specify the `directory` the patches of -reversible are kept in. Default value is the asset directory with a .patches suffix")
+	flags.IntVar(&c.KeepBackups, "keep-backups", 0, "Specify how many backups to keep. Default value is 0 which keeps all of them")
+	flags.BoolVar(&c.CompressBackups, "compress-backups", false, "Store backups as .tar.gz files instead of plain directory copies")
+	flags.BoolVar(&c.KeepArchive, "keep-archive", false, "Move the deployed archive into the archive directory instead of removing it")
+	flags.StringVar(&c.ArchiveDir, "archive-dir", "", "Specify the `directory` kept archives are moved to. Default value is the asset directory with a .archives suffix")
+	flags.IntVar(&c.KeepArchives, "keep-archives", 0, "Specify how many kept archives to keep. Default value is 0 which keeps all of them")
+	flags.BoolVar(&c.Rollback, "rollback", false, "Restore the directory contents from the most recent backup, raw or compressed, instead of downloading an artifact")
+	flags.StringVar(&c.Revert, "revert", "", "Undo the file operations recorded in the patch `file` of a -reversible deploy instead of downloading an artifact")
+	flags.BoolVar(&c.VerifyDeployment, "verify-deployment", false, "Check the deployed files against the tree hash recorded in the state marker and exit, downloading nothing")
+	flags.BoolVar(&c.DiffSummary, "diff-summary", false, "Print how many files were added, changed and removed compared to the backup, requires -backup. Lists the files with -verbose")
+	flags.StringVar(&c.PostHook, "post-hook", "", "Specify a shell `command` to run in the asset directory after each deployed artifact, with UPDATER_ARTIFACT_ID, UPDATER_ARTIFACT_NAME, UPDATER_DIRECTORY and UPDATER_CHANGED set")
+	flags.BoolVar(&c.PostHookOnlyOnChange, "post-hook-only-on-change", false, "Only run -post-hook when the deployed contents differ from the previous ones, compared by hashing every file")
+	flags.StringVar(&c.FileManifest, "file-manifest", "", "Specify the `name` of an artifact uploaded by the same workflow run, holding sha256sum output of every file, to download only the changed files from -file-url instead of the whole archive")
+	flags.StringVar(&c.FileURL, "file-url", "", "Specify the `URL` of a single file of the artifact for -file-manifest, {path}, {name}, {id} and {sha} are replaced with the file path, artifact name, ID and commit")
+	flags.StringVar(&c.ValidateCmd, "validate-cmd", "", "Specify a `command` to run with sh in the directory holding the extracted contents before they are deployed, a non-zero exit status aborts the deploy. Without -symlink-target or -atomic-group the contents are prepared in a copy of the directory")
+	flags.StringVar(&c.ScanCmd, "scan-cmd", "", "Specify a `command`, like a virus scanner, to run with sh in the directory holding the extracted contents before they are deployed. A non-zero exit status aborts the deploy and moves the contents into -quarantine-dir")
+	flags.StringVar(&c.QuarantineDir, "quarantine-dir", "", "Specify the `directory` to move the contents failing -scan-cmd into. Default value is a sibling of the asset directory with the .quarantine suffix")
+	flags.StringVar(&c.HealthURL, "health-url", "", "Specify a `URL`, like http://localhost:8080/health, polled after the deploy and -post-hook until it answers with 200. The deploy fails when it doesn't within -health-timeout")
+	flags.TextVar(&c.HealthTimeout, "health-timeout", c.HealthTimeout, "Specify how long -health-url is polled. Default value is `1m`")
+	flags.TextVar(&c.HealthInterval, "health-interval", c.HealthInterval, "Specify the delay between -health-url attempts, also used as their timeout. Default value is `2s`")
+	flags.BoolVar(&c.RollbackOnHealthFail, "rollback-on-health-fail", false, "Restore the backup taken by -backup when the -health-url check fails and run -post-hook again")
+	flags.BoolVar(&c.JSON, "json", false, "Write download and extraction progress and a final summary as newline delimited JSON events to standard output, moving all other messages to standard error")
+	flags.BoolVar(&c.Verbose, "verbose", false, "Print more details about what is done")
+	flags.StringVar(&c.ManifestFile, "manifest-file", "", "Specify a CSV or JSON `file` listing the targets to deploy, each with its repository, artifact, directory, options and optionally API URL. Replaces -r and -d")
+	flags.IntVar(&c.Concurrency, "concurrency", 1, "Specify how many manifest targets are deployed at the same time. Default value is `1`")
+	flags.StringVar(&c.CheckpointFile, "checkpoint", "", "Specify a `file` recording the manifest targets that completed, updated after each of them")
+	flags.BoolVar(&c.Resume, "resume", false, "Skip the manifest targets the -checkpoint file records as completed, unless -force is given")
+	flags.BoolVar(&c.PrintConfig, "print-config", false, "Print the effective configuration as JSON, with the tokens and header values redacted, and exit")
+}
+
+// Print writes the configuration as JSON, never revealing the tokens or the
+// values of the extra headers, which often carry credentials too.
+func (c config) Print(w io.Writer) error {
+	if c.Token != "" {
+		c.Token = "[redacted]"
+	}
+
+	redacted := make(stringList, len(c.Tokens))
+
+	for i, value := range c.Tokens {
+		redacted[i] = strings.SplitN(value, "=", 2)[0] + "=[redacted]"
+	}
+
+	c.Tokens = redacted
+	headers := make(stringList, len(c.Headers))
+
+	for i, value := range c.Headers {
+		headers[i] = strings.SplitN(value, ":", 2)[0] + ": [redacted]"
+	}
+
+	c.Headers = headers
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(c)
+}
+
+func (c config) Updater() (updater, error) {
+	var nameRegexp *regexp.Regexp
+
+	if c.NameRegexp != "" {
+		compiled, err := regexp.Compile(c.NameRegexp)
+
+		if err != nil {
+			return updater{}, fmt.Errorf("invalid -name-regexp: %w", err)
+		}
+
+		nameRegexp = compiled
+	}
+
+	headers, err := parseHeaders(c.Headers)
+
+	if err != nil {
+		return updater{}, err
+	}
+
+	var umask os.FileMode
+
+	if c.Umask != "" {
+		mask, err := strconv.ParseUint(c.Umask, 8, 32)
+
+		if err != nil || mask > 0777 {
+			return updater{}, fmt.Errorf("invalid -umask %q, expected an octal mask like 022", c.Umask)
+		}
+
+		umask = os.FileMode(mask)
+	}
+
+	client, err := newHTTPClient(c.Resolver, c.HTTP1)
+
+	if err != nil {
+		return updater{}, err
+	}
+
+	extractWorkers := c.ExtractWorkers
+
+	if extractWorkers == 0 && !c.ExtractWorkersAuto {
+		extractWorkers = 1
+	}
+
+	hostTokens := make(map[string]string)
+
+	if c.Netrc != "" {
+		if err := readNetrc(c.Netrc, hostTokens); err != nil {
+			return updater{}, fmt.Errorf("unable to read -netrc: %w", err)
+		}
+	}
+
+	if err := parseHostTokens(c.Tokens, hostTokens); err != nil {
+		return updater{}, err
+	}
+
+	artifactDirs, err := parseArtifactDirs(c.ArtifactDirs)
+
+	if err != nil {
+		return updater{}, err
+	}
+
+	cacheDir := c.CacheDir
+
+	if c.Cache && cacheDir == "" {
+		userCacheDir, err := os.UserCacheDir()
+
+		if err != nil {
+			return updater{}, fmt.Errorf("unable to locate the cache directory, use -cache-dir: %w", err)
+		}
+
+		cacheDir = filepath.Join(userCacheDir, "updater")
+	}
+
+	var events *eventWriter
+
+	if c.JSON {
+		events = newEventWriter(os.Stdout)
+	}
+
+	var artifactNames []string
+
+	for _, name := range c.ArtifactNames {
+		expanded, err := expandEnv(name)
+
+		if err != nil {
+			return updater{}, fmt.Errorf("invalid -a %s: %w", name, err)
+		}
+
+		artifactNames = append(artifactNames, expanded)
+	}
+
+	var since time.Time
+
+	if c.Since != "" {
+		parsed, err := time.Parse(time.RFC3339, c.Since)
+
+		if err != nil {
+			return updater{}, fmt.Errorf("invalid -since: %w", err)
+		}
+
+		since = parsed
+	}
+
+	var publicKey crypto.PublicKey
+
+	if c.PublicKey != "" {
+		key, err := loadPublicKey(c.PublicKey)
+
+		if err != nil {
+			return updater{}, fmt.Errorf("invalid -public-key: %w", err)
+		}
+
+		publicKey = key
+	}
+
+	return updater{
+		repository:       c.Repository,
+		token:            c.Token,
+		hostTokens:       hostTokens,
+		directory:        c.Directory,
+		artifactName:     artifactNames[0],
+		artifactNames:    artifactNames,
+		namePrefix:       c.NamePrefix,
+		channel:          c.Channel,
+		channelSeparator: c.ChannelSeparator,
+		nameRegexp:       nameRegexp,
+		atomicGroup:      c.AtomicGroup,
+		keepGoing:        c.KeepGoing,
+		artifactDirs:     artifactDirs,
+		strict:           c.Strict,
+		noExtract:        c.NoExtract,
+		output:           c.Output,
+		merge:            c.Merge,
+		prune:            c.Prune,
+		requireEmpty:     c.RequireEmpty,
+		destOwnerCheck:   c.DestOwnerCheck,
+		destOwner:        c.DestOwner,
+		retryCorrupt:     c.RetryCorrupt,
+		allowProtected:   c.IKnowWhatImDoing,
+		force:            c.Force,
+		confirm:          c.Confirm,
+		assumeYes:        c.Yes,
+		skipNewer:        c.SkipNewer,
+		resumeExtract:    c.ResumeExtract,
+		normalizeEOL:     c.NormalizeEOL,
+		umask:            umask,
+		longPaths:        c.LongPaths,
+		textGlobs:        c.TextGlobs,
+		bestEffort:       c.BestEffort,
+		allowPaths:       c.AllowPaths,
+		extractWorkers:   extractWorkers,
+		expectMinFiles:   c.ExpectMinFiles,
+		expectMaxFiles:   c.ExpectMaxFiles,
+		keep:             c.Keep,
+		ensureDirs:       c.EnsureDirs,
+		permissionsFrom:  c.PermissionsFrom,
+		fsync:            c.Fsync,
+		subpath:          cleanSubpath(c.Subpath),
+		destTemplate:     c.DestTemplate,
+		latestSymlink:    c.LatestSymlink,
+		apiURL:           c.APIURL,
+		cacheFile:        c.CacheFile,
+		cacheDir:         cacheDir,
+		cacheTTL:         c.CacheTTL.Duration,
+		refresh:          c.Refresh,
+
+		symlinkTarget: c.SymlinkTarget,
+		keepReleases:  c.KeepReleases,
+
+		chmodExec:         c.ChmodExec,
+		failOnExpired:     c.FailOnExpired,
+		withLogs:          c.WithLogs,
+		fromLatestRun:     c.FromLatestRun,
+		runID:             c.RunID,
+		requireConclusion: c.RequireConclusion,
+		warnPublic:        c.WarnPublic,
+		commit:            c.Commit,
+		runs:              &runCache{runs: make(map[int]workflowRun)},
+		repositories:      &repoCache{repositories: make(map[string]repositoryInfo)},
+		tokenCmd:          newTokenCommand(c.TokenCmd, c.Token),
+		workflow:          c.Workflow,
+
+		maxDownloadSize: c.MaxDownloadSize,
+		maxResponseSize: c.MaxResponseSize,
+		downloadChunks:  c.DownloadChunks,
+		minFreeSpace:    c.MinFreeSpace,
+		spaceReport:     c.SpaceReport,
+		maxBandwidth:    c.MaxBandwidth,
+		retry: retryPolicy{
+			retries: c.Retries,
+			backoff: c.RetryBackoff.Duration,
+			jitter:  c.RetryJitter,
+			rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		},
+
+		fallbackRepository: c.FallbackRepository,
+
+		signatureURL: c.SignatureURL,
+		publicKey:    publicKey,
+
+		maxAge:  c.MaxAge.Duration,
+		headers: headers,
+
+		since:           since,
+		sinceLastDeploy: c.SinceLastDeploy,
+		selectPolicy:    c.Select,
+		waitForArtifact: c.WaitForArtifact,
+		waitTimeout:     c.WaitTimeout.Duration,
+		pollInterval:    c.PollInterval.Duration,
+
+		backup:               c.Backup,
+		backupDir:            c.BackupDir,
+		reversible:           c.Reversible,
+		patchDir:             c.PatchDir,
+		keepBackups:          c.KeepBackups,
+		keepArchive:          c.KeepArchive,
+		archiveDir:           c.ArchiveDir,
+		keepArchives:         c.KeepArchives,
+		compressBackups:      c.CompressBackups,
+		diffSummary:          c.DiffSummary,
+		postHook:             c.PostHook,
+		postHookOnlyOnChange: c.PostHookOnlyOnChange,
+		fileManifest:         c.FileManifest,
+		fileURL:              c.FileURL,
+		validateCmd:          c.ValidateCmd,
+		scanCmd:              c.ScanCmd,
+		quarantineDir:        c.QuarantineDir,
+		healthURL:            c.HealthURL,
+		healthTimeout:        c.HealthTimeout.Duration,
+		healthInterval:       c.HealthInterval.Duration,
+		rollbackOnHealthFail: c.RollbackOnHealthFail,
+		verbose:              c.Verbose,
+
+		concurrency:    c.Concurrency,
+		checkpointFile: c.CheckpointFile,
+		resume:         c.Resume,
+		client:         client,
+		limiter:        newRateLimiter(c.RateLimit, c.RateBurst),
+		dumpResponse:   c.DumpResponse,
+		dumpHeaders:    c.DumpHeaders,
+		trace:          c.Trace,
+		events:         events,
+		reportFile:     c.ReportFile,
+		progress:       newProgressFile(c.ProgressFile, c.KeepProgressFile),
+		stdout:         os.Stdout,
+		stdin:          os.Stdin,
+		interactive:    isTerminal(os.Stdin),
+
+		stats: &runStats{RateLimitRemaining: -1},
+	}, nil
+}
+
+// fail reports the error, also as an error event with -json, and exits with
+// the code mapped from its type.
+func fail(events *eventWriter, err error) {
+	events.Error(err)
+	log.Print(colorRed, err, colorReset)
+	os.Exit(exitCode(err))
+}
+
+func main() {
+	var cfg config
+
+	cfg.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	token, err := resolveToken(cfg.Token, cfg.TokenFile, cfg.TokenStdin, os.Stdin)
+
+	if err != nil {
+		fmt.Println(colorRed, "Unable to read the authentication token:", err, colorReset)
+		return
+	}
+
+	cfg.Token = token
+
+	if cfg.TokenCmd != "" && (cfg.TokenStdin || cfg.TokenFile != "") {
+		fmt.Println(colorRed, "The -token-cmd option can't be used together with -token-stdin or -token-file!", colorReset)
+		return
+	}
+
+	if cfg.TokenCmd != "" {
+		token, err := runTokenCommand(cfg.TokenCmd)
+
+		if err != nil {
+			fmt.Println(colorRed, "Unable to read the authentication token:", err, colorReset)
+			return
+		}
+
+		cfg.Token = token
+	}
+
+	if (len(cfg.ArtifactNames) > 0 && (cfg.NamePrefix != "" || cfg.NameRegexp != "")) || (cfg.NamePrefix != "" && cfg.NameRegexp != "") {
+		fmt.Println(colorRed, "Only one of -a, -name-prefix and -name-regexp can be used!", colorReset)
+		return
+	}
+
+	if len(cfg.ArtifactNames) == 0 {
+		cfg.ArtifactNames = stringList{"sherpa4selfie"}
+	}
+
+	if cfg.Channel != "" && (cfg.NamePrefix != "" || cfg.NameRegexp != "") {
+		fmt.Println(colorRed, "The -channel option only applies to -a names, not to -name-prefix or -name-regexp!", colorReset)
+		return
+	}
+
+	if cfg.Channel != "" && cfg.ChannelSeparator == "" {
+		fmt.Println(colorRed, "The -channel-separator option can't be empty!", colorReset)
+		return
+	}
+
+	if cfg.PrintConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			fail(nil, err)
+		}
+
+		return
+	}
+
+	if cfg.Rollback {
+		if cfg.Directory == "" {
+			fmt.Println(colorRed, "The -rollback option needs the directory to restore!", colorReset)
+			return
+		}
+	} else if cfg.Revert != "" {
+		if cfg.Directory == "" {
+			fmt.Println(colorRed, "The -revert option needs the directory to revert!", colorReset)
+			return
+		}
+	} else if cfg.VerifyDeployment {
+		if cfg.Directory == "" {
+			fmt.Println(colorRed, "The -verify-deployment option needs the directory to verify!", colorReset)
+			return
+		}
+	} else if (cfg.Token == "" && len(cfg.Tokens) == 0 && cfg.Netrc == "") || (cfg.ManifestFile == "" && (cfg.Repository == "" || (cfg.Directory == "" && len(cfg.ArtifactDirs) == 0))) {
+		fmt.Println(colorRed, "At least one of the parameters is missing!", colorReset)
+		return
+	}
+
+	if cfg.ManifestFile != "" && (cfg.List || cfg.HeadOnly || cfg.CompareRemote || cfg.DiffExitCode || cfg.NoExtract || len(cfg.ArtifactNames) > 1) {
+		fmt.Println(colorRed, "The -manifest-file option can't be used together with -list, -head-only, -compare-remote, -diff-exit-code, -no-extract or several -a!", colorReset)
+		return
+	}
+
+	if cfg.ManifestFile != "" && cfg.CacheFile != "" {
+		fmt.Println(colorRed, "The -cache-file option can't be used together with -manifest-file, use -cache-dir to cache the listing of every target!", colorReset)
+		return
+	}
+
+	if (cfg.CheckpointFile != "" || cfg.Resume) && cfg.ManifestFile == "" {
+		fmt.Println(colorRed, "The -checkpoint and -resume options can only be used together with -manifest-file!", colorReset)
+		return
+	}
+
+	if cfg.Resume && cfg.CheckpointFile == "" {
+		fmt.Println(colorRed, "The -resume option needs the -checkpoint file to resume from!", colorReset)
+		return
+	}
+
+	if cfg.Concurrency < 1 {
+		fmt.Println(colorRed, "The -concurrency option has to be at least 1!", colorReset)
+		return
+	}
+
+	if !isValidSelectPolicy(cfg.Select) {
+		fmt.Println(colorRed, "Unknown selection policy, use one of newest, largest or smallest!", colorReset)
+		return
+	}
+
+	if cfg.KeepProgressFile && cfg.ProgressFile == "" {
+		fmt.Println(colorRed, "The -keep-progress-file option needs the -progress-file to keep!", colorReset)
+		return
+	}
+
+	if cfg.OnlyActive && !cfg.List {
+		fmt.Println(colorRed, "The -only-active option only applies to -list!", colorReset)
+		return
+	}
+
+	if (cfg.Grep != "" || cfg.Sort != "") && !cfg.List {
+		fmt.Println(colorRed, "The -grep and -sort options only apply to -list!", colorReset)
+		return
+	}
+
+	if !isValidListSort(cfg.Sort) {
+		fmt.Println(colorRed, "The -sort option has to be one of name, date or size!", colorReset)
+		return
+	}
+
+	if cfg.List && !isValidListFormat(cfg.Format) {
+		fmt.Println(colorRed, "Unknown output format, use one of table, json or csv!", colorReset)
+		return
+	}
+
+	if (cfg.SignatureURL == "") != (cfg.PublicKey == "") {
+		fmt.Println(colorRed, "The -sig-url and -public-key options have to be used together!", colorReset)
+		return
+	}
+
+	if cfg.Output != "" && !cfg.NoExtract {
+		fmt.Println(colorRed, "The -o option can only be used together with -no-extract!", colorReset)
+		return
+	}
+
+	if cfg.Output == stdoutFile && (cfg.JSON || cfg.PublicKey != "") {
+		fmt.Println(colorRed, "The -o - option can't be used together with -json or -public-key!", colorReset)
+		return
+	}
+
+	if cfg.Output != "" && len(cfg.ArtifactNames) > 1 {
+		fmt.Println(colorRed, "The -o option can't be used when downloading several artifacts!", colorReset)
+		return
+	}
+
+	if cfg.NoExtract && (cfg.AtomicGroup || cfg.Merge || cfg.SymlinkTarget) {
+		fmt.Println(colorRed, "The -no-extract option can't be used together with -atomic-group, -merge or -symlink-target!", colorReset)
+		return
+	}
+
+	if len(cfg.ArtifactDirs) > 0 && (len(cfg.ArtifactNames) < 2 || cfg.ManifestFile != "") {
+		fmt.Println(colorRed, "The -artifact-dir option needs several -a and can't be used together with -manifest-file!", colorReset)
+		return
+	}
+
+	if cfg.Strict && len(cfg.ArtifactDirs) == 0 {
+		fmt.Println(colorRed, "The -strict option needs -artifact-dir!", colorReset)
+		return
+	}
+
+	if cfg.Confirm && cfg.TokenStdin {
+		fmt.Println(colorRed, "The -confirm option can't be used together with -token-stdin, the answer is read from standard input too!", colorReset)
+		return
+	}
+
+	if cfg.KeepGoing && cfg.AtomicGroup {
+		fmt.Println(colorRed, "The -keep-going option can't be used together with -atomic-group!", colorReset)
+		return
+	}
+
+	if cfg.AtomicGroup && (cfg.Merge || cfg.SymlinkTarget) {
+		fmt.Println(colorRed, "The -atomic-group option can't be used together with -merge or -symlink-target!", colorReset)
+		return
+	}
+
+	if cfg.FromLatestRun && cfg.Workflow == "" {
+		fmt.Println(colorRed, "The -from-latest-run option needs the -workflow to look at!", colorReset)
+		return
+	}
+
+	if cfg.FromLatestRun && (cfg.CacheFile != "" || cfg.Cache || cfg.CacheDir != "") {
+		fmt.Println(colorRed, "The -from-latest-run option can't be used together with -cache-file, -cache or -cache-dir!", colorReset)
+		return
+	}
+
+	if cfg.DownloadChunks < 0 {
+		fmt.Println(colorRed, "The -download-chunks option can't be negative!", colorReset)
+		return
+	}
+
+	if cfg.RunID < 0 {
+		fmt.Println(colorRed, "The -run-id option has to be a workflow run ID!", colorReset)
+		return
+	}
+
+	if cfg.RunID != 0 && cfg.FromLatestRun {
+		fmt.Println(colorRed, "The -run-id option can't be used together with -from-latest-run!", colorReset)
+		return
+	}
+
+	if cfg.RunID != 0 && (cfg.CacheFile != "" || cfg.Cache || cfg.CacheDir != "") {
+		fmt.Println(colorRed, "The -run-id option can't be used together with -cache-file, -cache or -cache-dir!", colorReset)
+		return
+	}
+
+	if cfg.Subpath != "" && (filepath.IsAbs(cfg.Subpath) || strings.HasPrefix(path.Clean(filepath.ToSlash(cfg.Subpath)), "..")) {
+		fmt.Println(colorRed, "The -subpath option has to be a path inside the artifact!", colorReset)
+		return
+	}
+
+	for _, dir := range cfg.EnsureDirs {
+		if filepath.IsAbs(dir) || strings.HasPrefix(filepath.Clean(dir), "..") {
+			fmt.Println(colorRed, "The -ensure-dir directories have to be inside the asset directory!", colorReset)
+			return
+		}
+	}
+
+	if cfg.NormalizeEOL && len(cfg.TextGlobs) == 0 {
+		fmt.Println(colorRed, "The -normalize-eol option needs at least one -text-glob!", colorReset)
+		return
+	}
+
+	if cfg.LatestSymlink != "" && cfg.DestTemplate == "" {
+		fmt.Println(colorRed, "The -update-latest-symlink option needs the -dest-template directories to point to!", colorReset)
+		return
+	}
+
+	if cfg.LatestSymlink != "" && (cfg.LatestSymlink != filepath.Base(cfg.LatestSymlink) || cfg.LatestSymlink == "." || cfg.LatestSymlink == "..") {
+		fmt.Println(colorRed, "The -update-latest-symlink option has to be a plain name!", colorReset)
+		return
+	}
+
+	if cfg.SinceLastDeploy && (cfg.DestTemplate != "" || len(cfg.ArtifactNames) > 1) {
+		fmt.Println(colorRed, "The -since-last-deploy option can't be used together with -dest-template or several -a!", colorReset)
+		return
+	}
+
+	if cfg.ExpectMinFiles < 0 || cfg.ExpectMaxFiles < 0 || (cfg.ExpectMaxFiles > 0 && cfg.ExpectMinFiles > cfg.ExpectMaxFiles) {
+		fmt.Println(colorRed, "The -expect-min-files and -expect-max-files options need a range of positive numbers!", colorReset)
+		return
+	}
+
+	if cfg.ExtractWorkers < 0 {
+		fmt.Println(colorRed, "The -extract-workers option has to be a positive number!", colorReset)
+		return
+	}
+
+	if cfg.Reversible && (cfg.Merge || cfg.SymlinkTarget || cfg.AtomicGroup || cfg.NoExtract || cfg.FileManifest != "") {
+		fmt.Println(colorRed, "The -reversible option can't be used together with -merge, -symlink-target, -atomic-group, -no-extract or -file-manifest!", colorReset)
+		return
+	}
+
+	if cfg.RollbackOnHealthFail && (cfg.HealthURL == "" || !cfg.Backup || cfg.SymlinkTarget) {
+		fmt.Println(colorRed, "The -rollback-on-health-fail option needs -health-url and -backup, and can't be used together with -symlink-target!", colorReset)
+		return
+	}
+
+	if cfg.PostHookOnlyOnChange && cfg.PostHook == "" {
+		fmt.Println(colorRed, "The -post-hook-only-on-change option can only be used together with -post-hook!", colorReset)
+		return
+	}
+
+	if cfg.SkipNewer && !cfg.Merge {
+		fmt.Println(colorRed, "The -skip-newer option can only be used together with -merge!", colorReset)
+		return
+	}
+
+	if (cfg.FileManifest == "") != (cfg.FileURL == "") {
+		fmt.Println(colorRed, "The -file-manifest and -file-url options have to be used together!", colorReset)
+		return
+	}
+
+	if cfg.FileManifest != "" && (cfg.SymlinkTarget || cfg.AtomicGroup || cfg.NoExtract || cfg.Subpath != "" || len(cfg.ArtifactNames) > 1 || cfg.ValidateCmd != "" || cfg.ScanCmd != "") {
+		fmt.Println(colorRed, "The -file-manifest option can't be used together with -symlink-target, -atomic-group, -no-extract, -subpath, -validate-cmd, -scan-cmd or several -a!", colorReset)
+		return
+	}
+
+	if cfg.ResumeExtract && !cfg.Merge {
+		fmt.Println(colorRed, "The -resume-extract option can only be used together with -merge!", colorReset)
+		return
+	}
+
+	if cfg.Prune && !cfg.Merge {
+		fmt.Println(colorRed, "The -prune option can only be used together with -merge!", colorReset)
+		return
+	}
+
+	if cfg.SymlinkTarget && cfg.Merge {
+		fmt.Println(colorRed, "The -symlink-target option can't be used together with -merge!", colorReset)
+		return
+	}
+
+	if cfg.SymlinkTarget && runtime.GOOS == "windows" {
+		fmt.Println(colorRed, "The -symlink-target option relies on atomic rename of symlinks which is not available on Windows!", colorReset)
+		return
+	}
+
+	updater, err := cfg.Updater()
+
+	if err != nil {
+		fmt.Println(colorRed, err, colorReset)
+		return
+	}
+
+	if updater.cacheDir != "" {
+		if err := updater.EvictCache(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to evict expired cache entries: %s\n", err)
+		}
+	}
+
+	if cfg.VerifyDeployment {
+		code, err := updater.VerifyDeployment()
+
+		if err != nil {
+			fail(updater.events, err)
+		}
+
+		os.Exit(code)
+	}
+
+	if cfg.Rollback {
+		if err := updater.Rollback(); err != nil {
+			fail(updater.events, err)
+		}
+
+		fmt.Println(colorGreen, "All done", colorReset)
+		return
+	}
+
+	if cfg.Revert != "" {
+		if err := updater.Revert(cfg.Revert); err != nil {
+			fail(updater.events, err)
+		}
+
+		fmt.Println(colorGreen, "All done", colorReset)
+		return
+	}
+
+	if cfg.List {
+		data, err := updater.Artifacts()
+
+		if err != nil {
+			fail(updater.events, err)
+		}
+
+		if cfg.OnlyActive {
+			data = data.Active()
+		}
+
+		if cfg.Grep != "" {
+			data = data.Grep(cfg.Grep)
+		}
+
+		data.Sort(cfg.Sort)
+
+		if err := data.Print(os.Stdout, cfg.Format); err != nil {
+			fail(updater.events, err)
+		}
+
+		return
+	}
+
+	if cfg.DiffExitCode {
+		code, err := updater.DiffExitCode()
+
+		if err != nil {
+			fail(updater.events, err)
+		}
+
+		os.Exit(code)
+	}
+
+	if cfg.CompareRemote {
+		code, err := updater.CompareRemote()
+
+		if err != nil {
+			fail(updater.events, err)
+		}
+
+		os.Exit(code)
+	}
+
+	if cfg.HeadOnly {
+		code, err := updater.Probe()
+
+		if err != nil {
+			fail(updater.events, err)
+		}
+
+		os.Exit(code)
+	}
+
+	started := time.Now()
+	runID, err := newRunID()
+
+	if err != nil {
+		fail(updater.events, err)
+	}
+
+	if cfg.JSON || cfg.Output == stdoutFile {
+		// The event writer and -o - hold on to the real standard output,
+		// everything else printed from here on goes to standard error
+		os.Stdout = os.Stderr
+	}
+
+	if cfg.ManifestFile != "" {
+		var targets []manifestTarget
+		targets, err = readManifest(cfg.ManifestFile, updater.artifactName)
+
+		if err == nil {
+			err = updater.UpdateManifest(targets)
+		}
+	} else {
+		err = updater.Update()
+	}
+
+	if cfg.ReportFile != "" {
+		if reportErr := updater.WriteReport(cfg.ReportFile, runID, started, err); reportErr != nil {
+			fmt.Println(colorRed, "Unable to write report:", reportErr, colorReset)
+		}
+	}
+
+	if cfg.MetricsFile != "" {
+		if metricsErr := updater.WriteMetrics(cfg.MetricsFile, started, err == nil); metricsErr != nil {
+			fmt.Println(colorRed, "Unable to write metrics:", metricsErr, colorReset)
+		}
+	}
+
+	updater.events.Summary(updater.stats, started, err)
+	updater.progress.Finish(updater.stats, err)
+
+	if err != nil {
+		fail(updater.events, err)
 	}
 
 	fmt.Println(colorGreen, "All done", colorReset)
@@ -0,0 +1,3286 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExtractProgressReachesTotal(t *testing.T) {
+	var reported [][2]int64
+	progress := newExtractProgress(func(current, total int64) {
+		reported = append(reported, [2]int64{current, total})
+	}, 3)
+
+	for i := 0; i < 3; i++ {
+		progress.Done()
+	}
+
+	want := [][2]int64{{1, 3}, {2, 3}, {3, 3}}
+
+	if len(reported) != len(want) {
+		t.Fatalf("got %d reports, want %d", len(reported), len(want))
+	}
+
+	for i := range want {
+		if reported[i] != want[i] {
+			t.Errorf("report %d is %v, want %v", i, reported[i], want[i])
+		}
+	}
+}
+
+func TestWriteZipEntryChecksumMismatch(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "tampered.zip")
+	file, err := os.Create(archive)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("tampered contents")
+	w := zip.NewWriter(file)
+	fw, err := w.CreateRaw(&zip.FileHeader{
+		Name:               "index.html",
+		Method:             zip.Store,
+		CRC32:              crc32.ChecksumIEEE(content) + 1,
+		CompressedSize64:   uint64(len(content)),
+		UncompressedSize64: uint64(len(content)),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fw.Write(content)
+	w.Close()
+	file.Close()
+
+	r, err := zip.OpenReader(archive)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+
+	dest := t.TempDir()
+
+	if err := writeZipEntry(r.File[0], filepath.Join(dest, "index.html"), false, 0); !errors.Is(err, zip.ErrChecksum) {
+		t.Errorf("writeZipEntry returned %v, want %v", err, zip.ErrChecksum)
+	}
+
+	if err := (zipExtractor{}).Validate(archive, dest, extractOptions{}); !errors.Is(err, zip.ErrChecksum) {
+		t.Errorf("Validate returned %v, want %v", err, zip.ErrChecksum)
+	}
+}
+
+func TestRetryDelayJitterBounds(t *testing.T) {
+	base := 100 * time.Millisecond
+	jittered := retryPolicy{retries: 5, backoff: base, jitter: true, rand: rand.New(rand.NewSource(1))}
+	plain := retryPolicy{retries: 5, backoff: base}
+	varied := false
+
+	for attempt := 0; attempt < 5; attempt++ {
+		limit := base << uint(attempt)
+
+		if delay := plain.Delay(attempt); delay != limit {
+			t.Errorf("attempt %d: delay without jitter is %s, want %s", attempt, delay, limit)
+		}
+
+		for i := 0; i < 100; i++ {
+			delay := jittered.Delay(attempt)
+
+			if delay < 0 || delay > limit {
+				t.Fatalf("attempt %d: delay %s outside of [0, %s]", attempt, delay, limit)
+			}
+
+			varied = varied || delay != limit
+		}
+	}
+
+	if !varied {
+		t.Error("jitter never changed the delay")
+	}
+}
+
+// writeSizedZip writes an archive of count files of size bytes each, with
+// contents that compress a little, for the extraction benchmarks.
+func writeSizedZip(b *testing.B, count, size int) string {
+	b.Helper()
+
+	archive := filepath.Join(b.TempDir(), "bench.zip")
+	file, err := os.Create(archive)
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	defer file.Close()
+
+	random := rand.New(rand.NewSource(int64(count*size + 1)))
+	content := make([]byte, size)
+	w := zip.NewWriter(file)
+
+	for i := 0; i < count; i++ {
+		for j := range content {
+			content[j] = byte('a' + random.Intn(16))
+		}
+
+		fw, err := w.Create(fmt.Sprintf("dir%d/file%d.bin", i%10, i))
+
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		fw.Write(content)
+	}
+
+	if err := w.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	return archive
+}
+
+// BenchmarkExtract compares fixed worker counts against the choice of
+// tuneWorkers, reported as workers=0, for the archive profiles it tells
+// apart: a handful of files, many small files and fewer large ones.
+func BenchmarkExtract(b *testing.B) {
+	mixes := []struct {
+		name  string
+		count int
+		size  int
+	}{
+		{"few-small", 8, 4 << 10},
+		{"many-small", 2000, 4 << 10},
+		{"large", 16, 4 << 20},
+	}
+
+	for _, mix := range mixes {
+		archive := writeSizedZip(b, mix.count, mix.size)
+
+		for _, workers := range []int{0, 1, 2, 4, 8} {
+			b.Run(fmt.Sprintf("%s/workers=%d", mix.name, workers), func(b *testing.B) {
+				b.SetBytes(int64(mix.count * mix.size))
+
+				for i := 0; i < b.N; i++ {
+					dest := filepath.Join(b.TempDir(), "out")
+
+					if _, err := unzip(archive, dest, extractOptions{Workers: workers}); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestRunStatsMerge(t *testing.T) {
+	changed, unchanged := true, false
+	reset := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name          string
+		targets       []*runStats
+		wantBytes     int64
+		wantFiles     int
+		wantDeploys   int
+		wantChanged   *bool
+		wantRemaining int
+	}{
+		{"no targets", nil, 0, 0, 0, nil, -1},
+		{"counters add up", []*runStats{
+			{BytesDownloaded: 10, FilesExtracted: 2, RateLimitRemaining: -1, Deploys: []*deployRecord{{}}},
+			{BytesDownloaded: 5, FilesExtracted: 3, RateLimitRemaining: -1, Deploys: []*deployRecord{{}, {}}},
+		}, 15, 5, 3, nil, -1},
+		{"any change marks the run", []*runStats{
+			{Changed: &unchanged, RateLimitRemaining: -1},
+			{Changed: &changed, RateLimitRemaining: -1},
+			{Changed: &unchanged, RateLimitRemaining: -1},
+		}, 0, 0, 0, &changed, -1},
+		{"unchanged stays unchanged", []*runStats{
+			{Changed: &unchanged, RateLimitRemaining: -1},
+			{RateLimitRemaining: -1},
+		}, 0, 0, 0, &unchanged, -1},
+		{"fewest requests left win", []*runStats{
+			{RateLimitRemaining: 40},
+			{RateLimitRemaining: 7, RateLimitReset: reset},
+			{RateLimitRemaining: -1},
+		}, 0, 0, 0, nil, 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := &runStats{RateLimitRemaining: -1}
+
+			for _, target := range tt.targets {
+				stats.Merge(target)
+			}
+
+			if stats.BytesDownloaded != tt.wantBytes || stats.FilesExtracted != tt.wantFiles || len(stats.Deploys) != tt.wantDeploys {
+				t.Errorf("got %d bytes, %d files, %d deploys, want %d, %d, %d", stats.BytesDownloaded, stats.FilesExtracted, len(stats.Deploys), tt.wantBytes, tt.wantFiles, tt.wantDeploys)
+			}
+
+			if (stats.Changed == nil) != (tt.wantChanged == nil) || (stats.Changed != nil && *stats.Changed != *tt.wantChanged) {
+				t.Errorf("Changed = %v, want %v", stats.Changed, tt.wantChanged)
+			}
+
+			if stats.RateLimitRemaining != tt.wantRemaining {
+				t.Errorf("RateLimitRemaining = %d, want %d", stats.RateLimitRemaining, tt.wantRemaining)
+			}
+
+			if tt.wantRemaining == 7 && !stats.RateLimitReset.Equal(reset) {
+				t.Errorf("RateLimitReset = %s, want %s", stats.RateLimitReset, reset)
+			}
+		})
+	}
+}
+
+func TestLastDeployReadsContentDirectory(t *testing.T) {
+	deployed := artifact{ID: 42, Name: "dist", CreatedAt: "2024-05-01T10:00:00Z", UpdatedAt: "2024-05-01T10:00:00Z"}
+
+	tests := []struct {
+		name          string
+		symlinkTarget bool
+		repository    string
+		force         bool
+		wantID        int
+	}{
+		{"plain directory", false, "owner/repo", false, 42},
+		{"symlink target", true, "owner/repo", false, 42},
+		{"other repository", false, "owner/other", false, 0},
+		{"forced", true, "owner/repo", true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			u := updater{directory: dir, repository: "owner/repo", symlinkTarget: tt.symlinkTarget, sinceLastDeploy: true, force: tt.force}
+
+			if tt.symlinkTarget {
+				release := filepath.Join(dir, releasesDirectory, "20240501100000")
+
+				if err := os.MkdirAll(release, 0755); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := os.Symlink(filepath.Join(releasesDirectory, "20240501100000"), filepath.Join(dir, currentSymlink)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := u.WriteState(dir, deployed); err != nil {
+				t.Fatal(err)
+			}
+
+			u.repository = tt.repository
+			state, err := u.LastDeploy()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			id := 0
+
+			if state != nil {
+				id = state.ArtifactID
+			}
+
+			if id != tt.wantID {
+				t.Errorf("LastDeploy() returned artifact %d, want %d", id, tt.wantID)
+			}
+		})
+	}
+}
+
+// writeTestZip writes an archive with the given file contents by name and
+// returns its path.
+func writeTestZip(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	archive := filepath.Join(t.TempDir(), "test.zip")
+	file, err := os.Create(archive)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer file.Close()
+
+	names := make([]string, 0, len(files))
+
+	for name := range files {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	w := zip.NewWriter(file)
+
+	for _, name := range names {
+		fw, err := w.Create(name)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := fw.Write([]byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return archive
+}
+
+// newTestUpdater configures an updater from command line arguments the way
+// main does.
+func newTestUpdater(t testing.TB, args ...string) updater {
+	t.Helper()
+
+	var cfg config
+	flags := flag.NewFlagSet("updater", flag.ContinueOnError)
+	cfg.RegisterFlags(flags)
+
+	if err := flags.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.ArtifactNames) == 0 {
+		cfg.ArtifactNames = stringList{"dist"}
+	}
+
+	u, err := cfg.Updater()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return u
+}
+
+// writeTestTree creates the files with the given contents by slash separated
+// path under dir.
+func writeTestTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, contents := range files {
+		fileName := filepath.Join(dir, filepath.FromSlash(name))
+
+		if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(fileName, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readTestTree returns the contents of the regular files under dir by slash
+// separated path, leaving out the state marker.
+func readTestTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		relPath, err := filepath.Rel(dir, filePath)
+
+		if err != nil || relPath == stateMarker {
+			return err
+		}
+
+		contents, err := os.ReadFile(filePath)
+		files[filepath.ToSlash(relPath)] = string(contents)
+
+		return err
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return files
+}
+
+func TestPatchChangedFiles(t *testing.T) {
+	local := map[string]string{"index.html": "old", "gone.txt": "gone"}
+	remote := map[string]string{"index.html": "new", "bin/run.sh": "#!/bin/sh\n"}
+
+	tests := []struct {
+		name        string
+		args        []string
+		served      map[string]string
+		wantPatched bool
+		want        map[string]string
+		wantErr     interface{}
+	}{
+		{"adds, changes and removes", nil, remote, true, remote, nil},
+		{"checksum mismatch", nil, map[string]string{"index.html": "tampered", "bin/run.sh": "#!/bin/sh\n"}, false, local, &ChecksumError{}},
+		{"disallowed path", []string{"-allow-paths", "index.html"}, remote, false, local, &DisallowedPathError{}},
+		{"too many files", []string{"-expect-max-files", "1"}, remote, false, local, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sums strings.Builder
+
+			for _, name := range []string{"bin/run.sh", "index.html"} {
+				checksum := sha256.Sum256([]byte(remote[name]))
+				fmt.Fprintf(&sums, "%s  %s\n", hex.EncodeToString(checksum[:]), name)
+			}
+
+			manifest := writeTestZip(t, map[string]string{"SHA256SUMS": sums.String()})
+			mux := http.NewServeMux()
+			server := httptest.NewServer(mux)
+			defer server.Close()
+
+			mux.HandleFunc("/repos/owner/repo/actions/artifacts", func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(artifacts{Count: 1, Artifacts: []artifact{{ID: 2, Name: "files", ArchiveDownloadURL: server.URL + "/manifest.zip", WorkflowRun: &workflowRun{ID: 7}}}})
+			})
+			mux.HandleFunc("/manifest.zip", func(w http.ResponseWriter, r *http.Request) {
+				http.ServeFile(w, r, manifest)
+			})
+			mux.HandleFunc("/files/", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, tt.served[strings.TrimPrefix(r.URL.Path, "/files/")])
+			})
+
+			dir := filepath.Join(t.TempDir(), "site")
+			writeTestTree(t, dir, local)
+			args := append([]string{"-r", "owner/repo", "-t", "token", "-d", dir, "-api-url", server.URL, "-file-manifest", "files", "-file-url", server.URL + "/files/{path}", "-backup", "-chmod-exec", "bin/*", "-umask", "022"}, tt.args...)
+			u := newTestUpdater(t, args...)
+
+			patched, err := u.PatchChangedFiles(artifact{ID: 1, Name: "dist", WorkflowRun: &workflowRun{ID: 7}})
+
+			if tt.wantPatched {
+				if err != nil || !patched {
+					t.Fatalf("PatchChangedFiles() = %v, %v, want true, nil", patched, err)
+				}
+
+				if info, err := os.Stat(filepath.Join(dir, "bin", "run.sh")); err != nil || info.Mode().Perm() != 0755 {
+					t.Errorf("bin/run.sh has mode %v, %v, want 0755", info.Mode().Perm(), err)
+				}
+
+				if _, err := u.LatestBackup(); err != nil {
+					t.Errorf("no backup of the patched directory: %v", err)
+				}
+			} else if err == nil {
+				t.Fatal("PatchChangedFiles() succeeded, want an error")
+			}
+
+			switch tt.wantErr.(type) {
+			case *ChecksumError:
+				var checksumErr *ChecksumError
+
+				if !errors.As(err, &checksumErr) {
+					t.Errorf("error %v is not a ChecksumError", err)
+				}
+			case *DisallowedPathError:
+				var disallowedErr *DisallowedPathError
+
+				if !errors.As(err, &disallowedErr) {
+					t.Errorf("error %v is not a DisallowedPathError", err)
+				}
+			}
+
+			if got := readTestTree(t, dir); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("directory holds %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReversibleDeployRoundTrip(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "site")
+	writeTestTree(t, dir, map[string]string{"index.html": "v1", "old/gone.txt": "gone", "data/keep.db": "keep"})
+
+	if err := os.Mkdir(filepath.Join(dir, "cache"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := writeTestZip(t, map[string]string{"index.html": "v2", "js/app.js": "app", "assets/": ""})
+	u := newTestUpdater(t, "-r", "owner/repo", "-t", "token", "-d", dir, "-reversible", "-ensure-dir", "logs", "-keep", "data/*")
+
+	wantFiles := readTestTree(t, dir)
+	wantDirs, err := listDirectories(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := u.ReplaceContents(archive); err != nil {
+		t.Fatal(err)
+	}
+
+	deployed := readTestTree(t, dir)
+
+	if fmt.Sprint(deployed) != fmt.Sprint(map[string]string{"index.html": "v2", "js/app.js": "app", "data/keep.db": "keep"}) {
+		t.Errorf("deployed %v", deployed)
+	}
+
+	for _, name := range []string{"assets", "logs"} {
+		if info, err := os.Stat(filepath.Join(dir, name)); err != nil || !info.IsDir() {
+			t.Errorf("%s wasn't created: %v", name, err)
+		}
+	}
+
+	for _, name := range []string{"cache", "old"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s wasn't removed: %v", name, err)
+		}
+	}
+
+	patches, err := filepath.Glob(filepath.Join(u.PatchDirectory(), "*"+patchSuffix))
+
+	if err != nil || len(patches) != 1 {
+		t.Fatalf("found patches %v, %v, want one", patches, err)
+	}
+
+	other := u
+	other.directory = t.TempDir()
+
+	if err := other.Revert(patches[0]); err == nil || !strings.Contains(err.Error(), "was recorded for") {
+		t.Errorf("Revert() into another directory returned %v, want a refusal", err)
+	}
+
+	if err := u.Revert(patches[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readTestTree(t, dir); fmt.Sprint(got) != fmt.Sprint(wantFiles) {
+		t.Errorf("reverted files %v, want %v", got, wantFiles)
+	}
+
+	if got, err := listDirectories(dir); err != nil || fmt.Sprint(got) != fmt.Sprint(wantDirs) {
+		t.Errorf("reverted directories %v, %v, want %v", got, err, wantDirs)
+	}
+}
+
+func TestReversibleDeployConfirmsPlannedChanges(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "site")
+	writeTestTree(t, dir, map[string]string{"index.html": "v1", "gone.txt": "gone"})
+	archive := writeTestZip(t, map[string]string{"index.html": "v2", "a.js": "a", "b.js": "b"})
+
+	u := newTestUpdater(t, "-r", "owner/repo", "-t", "token", "-d", dir, "-reversible", "-confirm")
+	u.interactive = false
+	err := u.ReplaceContents(archive)
+
+	if err == nil || !strings.Contains(err.Error(), "creates 2, overwrites 1 and deletes 1 files") {
+		t.Errorf("ReplaceContents() returned %v, want the planned changes", err)
+	}
+
+	if got := readTestTree(t, dir); got["index.html"] != "v1" || got["gone.txt"] != "gone" {
+		t.Errorf("directory changed without confirmation: %v", got)
+	}
+}
+
+// writeTestTarGz writes a gzip compressed tarball of the headers, regular
+// files getting their contents from bodies by name, and returns its path.
+func writeTestTarGz(t *testing.T, headers []tar.Header, bodies map[string]string) string {
+	t.Helper()
+
+	archive := filepath.Join(t.TempDir(), "test.tar.gz")
+	file, err := os.Create(archive)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer file.Close()
+
+	gzipWriter := gzip.NewWriter(file)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	for _, header := range headers {
+		header.Size = int64(len(bodies[header.Name]))
+
+		if err := tarWriter.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := tarWriter.Write([]byte(bodies[header.Name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, closer := range []io.Closer{tarWriter, gzipWriter} {
+		if err := closer.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return archive
+}
+
+func TestTarGzExtractorLinks(t *testing.T) {
+	file := tar.Header{Name: "a.txt", Typeflag: tar.TypeReg, Mode: 0644}
+	bodies := map[string]string{"a.txt": "content"}
+
+	tests := []struct {
+		name    string
+		link    tar.Header
+		wantErr bool
+	}{
+		{"hard link", tar.Header{Name: "dir/b.txt", Typeflag: tar.TypeLink, Linkname: "a.txt"}, false},
+		{"symlink", tar.Header{Name: "dir/c.txt", Typeflag: tar.TypeSymlink, Linkname: "../a.txt"}, false},
+		{"symlink to dest", tar.Header{Name: "dir/root", Typeflag: tar.TypeSymlink, Linkname: ".."}, false},
+		{"hard link outside", tar.Header{Name: "dir/b.txt", Typeflag: tar.TypeLink, Linkname: "../outside.txt"}, true},
+		{"symlink outside", tar.Header{Name: "dir/c.txt", Typeflag: tar.TypeSymlink, Linkname: "../../outside.txt"}, true},
+		{"absolute symlink", tar.Header{Name: "dir/c.txt", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive := writeTestTarGz(t, []tar.Header{file, tt.link}, bodies)
+			extractor, err := extractorFor(archive)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, ok := extractor.(tarGzExtractor); !ok {
+				t.Fatalf("extractorFor() picked %T for a tarball", extractor)
+			}
+
+			dest := t.TempDir()
+			_, err = extractor.Extract(archive, dest, extractOptions{})
+			restoreErr := extractTarGz(archive, t.TempDir())
+
+			if tt.wantErr {
+				if err == nil || restoreErr == nil {
+					t.Fatalf("Extract() = %v, extractTarGz() = %v, want illegal link target errors", err, restoreErr)
+				}
+
+				if entries, _ := os.ReadDir(dest); len(entries) != 0 {
+					t.Errorf("rejected tarball wrote %d entries", len(entries))
+				}
+
+				return
+			}
+
+			if err != nil || restoreErr != nil {
+				t.Fatalf("Extract() = %v, extractTarGz() = %v", err, restoreErr)
+			}
+
+			linkPath := filepath.Join(dest, filepath.FromSlash(tt.link.Name))
+
+			switch tt.link.Typeflag {
+			case tar.TypeLink:
+				original, _ := os.Stat(filepath.Join(dest, "a.txt"))
+
+				if linked, err := os.Stat(linkPath); err != nil || !os.SameFile(original, linked) {
+					t.Errorf("%s isn't a hard link of a.txt: %v", tt.link.Name, err)
+				}
+			case tar.TypeSymlink:
+				if target, err := os.Readlink(linkPath); err != nil || target != tt.link.Linkname {
+					t.Errorf("%s links to %q, %v, want %q", tt.link.Name, target, err, tt.link.Linkname)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckDirectory(t *testing.T) {
+	root := t.TempDir()
+	writeTestTree(t, root, map[string]string{"file": "not a directory"})
+
+	tests := []struct {
+		name    string
+		target  string
+		wantErr string
+	}{
+		{"missing", filepath.Join(root, "missing"), ""},
+		{"directory", root, ""},
+		{"file", filepath.Join(root, "file"), "target exists and is not a directory"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := updater{directory: tt.target}.CheckDirectory()
+
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("CheckDirectory() = %v, want nil", err)
+			}
+
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("CheckDirectory() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestChmodExec(t *testing.T) {
+	archive := writeTestZip(t, map[string]string{"bin/tool": "\x7fELF", "bin/tool.sh": "#!/bin/sh\n", "README.md": "readme"})
+
+	tests := []struct {
+		name     string
+		patterns []string
+		wantExec map[string]bool
+	}{
+		{"no patterns", nil, map[string]bool{"bin/tool": false, "bin/tool.sh": false, "README.md": false}},
+		{"directory glob", []string{"bin/*"}, map[string]bool{"bin/tool": true, "bin/tool.sh": true, "README.md": false}},
+		{"single file", []string{"bin/tool"}, map[string]bool{"bin/tool": true, "bin/tool.sh": false, "README.md": false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := t.TempDir()
+			u := updater{chmodExec: tt.patterns, stats: &runStats{}}
+
+			if _, err := u.Extract(archive, dest); err != nil {
+				t.Fatal(err)
+			}
+
+			for name, wantExec := range tt.wantExec {
+				info, err := os.Stat(filepath.Join(dest, filepath.FromSlash(name)))
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if exec := info.Mode().Perm()&0111 != 0; exec != wantExec {
+					t.Errorf("%s has mode %v, want executable %v", name, info.Mode().Perm(), wantExec)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveToken(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+
+	if err := os.WriteFile(tokenFile, []byte("  from-file \n second line\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		flagToken string
+		tokenFile string
+		fromStdin bool
+		stdin     string
+		env       string
+		want      string
+		wantErr   bool
+	}{
+		{"stdin first line trimmed", "from-flag", tokenFile, true, "\tfrom-stdin  \r\nignored\n", "from-env", "from-stdin", false},
+		{"stdin without newline", "", "", true, "from-stdin", "", "from-stdin", false},
+		{"empty stdin", "from-flag", "", true, "\n", "", "", true},
+		{"file over flag", "from-flag", tokenFile, false, "", "from-env", "from-file", false},
+		{"flag over environment", "from-flag", "", false, "", "from-env", "from-flag", false},
+		{"environment", "", "", false, "", "from-env", "from-env", false},
+		{"missing file", "", filepath.Join(t.TempDir(), "missing"), false, "", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GITHUB_TOKEN", tt.env)
+			token, err := resolveToken(tt.flagToken, tt.tokenFile, tt.fromStdin, strings.NewReader(tt.stdin))
+
+			if (err != nil) != tt.wantErr || token != tt.want {
+				t.Errorf("resolveToken() = %q, %v, want %q, error %v", token, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDownloadFileSizeMismatch(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		contentLength string
+		expectedSize  int64
+		wantErr       bool
+	}{
+		{"complete", "0123456789", "", 10, false},
+		{"unknown size", "01234", "", 0, false},
+		{"shorter than the artifact", "01234", "", 10, true},
+		{"content length over the artifact size", "01234", "5", 10, false},
+		{"truncated body", "01234", "10", 5, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.contentLength != "" {
+					w.Header().Set("Content-Length", tt.contentLength)
+				} else {
+					// Flushing first sends the body chunked, without a length
+					w.(http.Flusher).Flush()
+				}
+
+				fmt.Fprint(w, tt.body)
+			}))
+			defer server.Close()
+
+			fileName := filepath.Join(t.TempDir(), "archive.zip")
+			u := newTestUpdater(t, "-r", "owner/repo", "-t", "token", "-d", t.TempDir())
+			err := u.DownloadFile(server.URL, fileName, tt.expectedSize)
+
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("DownloadFile() = %v, want nil", err)
+				}
+
+				return
+			}
+
+			if err == nil {
+				t.Fatal("DownloadFile() succeeded, want a size mismatch")
+			}
+
+			if _, statErr := os.Stat(fileName); !os.IsNotExist(statErr) {
+				t.Errorf("the short download was left behind: %v", statErr)
+			}
+
+			var checksumErr *ChecksumError
+
+			if tt.contentLength == "" && (!errors.As(err, &checksumErr) || !strings.Contains(err.Error(), "10 bytes") || !strings.Contains(err.Error(), "5 bytes")) {
+				t.Errorf("DownloadFile() = %v, want the expected and actual sizes", err)
+			}
+		})
+	}
+}
+
+// failingReader returns its data and then err.
+type failingReader struct {
+	data []byte
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+
+	return n, nil
+}
+
+func TestSaveFileRemovesPartialFile(t *testing.T) {
+	errBroken := errors.New("connection reset")
+
+	tests := []struct {
+		name        string
+		r           io.Reader
+		wantWritten int64
+		wantErr     error
+	}{
+		{"complete", strings.NewReader("complete"), 8, nil},
+		{"fails after some bytes", &failingReader{data: []byte("partial"), err: errBroken}, 7, errBroken},
+		{"fails right away", &failingReader{err: errBroken}, 0, errBroken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileName := filepath.Join(t.TempDir(), "archive.zip")
+			written, err := saveFile(fileName, tt.r)
+
+			if written != tt.wantWritten || !errors.Is(err, tt.wantErr) {
+				t.Fatalf("saveFile() = %d, %v, want %d, %v", written, err, tt.wantWritten, tt.wantErr)
+			}
+
+			_, statErr := os.Stat(fileName)
+
+			if exists := statErr == nil; exists != (tt.wantErr == nil) {
+				t.Errorf("file exists %v after saveFile() returned %v", exists, err)
+			}
+		})
+	}
+}
+
+func TestBadDownloadLeavesDirectoryIntact(t *testing.T) {
+	valid, err := os.ReadFile(writeTestZip(t, map[string]string{"index.html": "new"}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		body         []byte
+		wantDeployed bool
+	}{
+		{"valid archive", valid, true},
+		{"not an archive", []byte("<html>error page</html>"), false},
+		{"truncated archive", valid[:len(valid)/2], false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(tt.body)
+			}))
+			defer server.Close()
+
+			dir := filepath.Join(t.TempDir(), "site")
+			writeTestTree(t, dir, map[string]string{"index.html": "old", "app.js": "app"})
+			u := newTestUpdater(t, "-r", "owner/repo", "-t", "token", "-d", dir, "-force")
+
+			archive, err := u.DownloadAndDeploy(artifact{ID: 1, Name: "dist", ArchiveDownloadURL: server.URL})
+			os.Remove(archive)
+
+			want := map[string]string{"index.html": "old", "app.js": "app"}
+
+			if tt.wantDeployed {
+				want = map[string]string{"index.html": "new"}
+			}
+
+			if (err == nil) != tt.wantDeployed {
+				t.Errorf("DownloadAndDeploy() = %v, want deployed %v", err, tt.wantDeployed)
+			}
+
+			if got := readTestTree(t, dir); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("directory holds %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestAPIResponseErrorPermissions(t *testing.T) {
+	tests := []struct {
+		name           string
+		code           int
+		accepted       string
+		body           string
+		wantPermission string
+		wantAuth       bool
+	}{
+		{"accepted permissions header", http.StatusForbidden, "actions=read; contents=read", `{"message":"Resource not accessible by personal access token"}`, "actions=read; contents=read", true},
+		{"scope error body only", http.StatusForbidden, "", `{"message":"Resource not accessible by personal access token"}`, "actions=read", true},
+		{"other forbidden", http.StatusForbidden, "", `{"message":"API rate limit exceeded"}`, "", false},
+		{"bad credentials", http.StatusUnauthorized, "", `{"message":"Bad credentials"}`, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+
+			if tt.accepted != "" {
+				recorder.Header().Set("X-Accepted-GitHub-Permissions", tt.accepted)
+			}
+
+			recorder.WriteHeader(tt.code)
+			recorder.WriteString(tt.body)
+			err := apiResponseError(recorder.Result())
+
+			var authErr *AuthError
+
+			if isAuth := errors.As(err, &authErr); isAuth != tt.wantAuth {
+				t.Fatalf("apiResponseError() = %v, want an AuthError %v", err, tt.wantAuth)
+			}
+
+			if authErr != nil && authErr.Permission != tt.wantPermission {
+				t.Errorf("Permission = %q, want %q", authErr.Permission, tt.wantPermission)
+			}
+
+			if tt.wantPermission != "" && !strings.Contains(err.Error(), tt.wantPermission) {
+				t.Errorf("error %q doesn't name the missing permission", err)
+			}
+
+			var httpErr *HTTPError
+
+			if !errors.As(err, &httpErr) || httpErr.Code != tt.code {
+				t.Errorf("apiResponseError() = %v, want an HTTPError with code %d", err, tt.code)
+			}
+		})
+	}
+}
+
+func TestErrorIdentity(t *testing.T) {
+	notFound := &HTTPError{Code: http.StatusNotFound, Message: "Not Found"}
+
+	tests := []struct {
+		name     string
+		err      error
+		wantCode int
+		wantIs   error
+	}{
+		{"nil", nil, 0, nil},
+		{"untyped", errors.New("something else"), 1, nil},
+		{"auth", fmt.Errorf("listing: %w", &AuthError{HTTPError: HTTPError{Code: http.StatusUnauthorized}}), exitAuthError, &HTTPError{Code: http.StatusUnauthorized}},
+		{"not found response", inPhase("download", &NotFoundError{HTTP: notFound}), exitNotFound, &HTTPError{Code: http.StatusNotFound}},
+		{"no suitable artifact", fmt.Errorf("owner/repo: %w", errNoSuitableArtifact), exitNotFound, errNoSuitableArtifact},
+		{"checksum", &ChecksumError{Subject: "dist.zip"}, exitChecksumError, nil},
+		{"extraction", &ExtractionError{Archive: "dist.zip", Err: zip.ErrFormat}, exitExtractionError, zip.ErrFormat},
+		{"other status", fmt.Errorf("listing: %w", &HTTPError{Code: http.StatusBadGateway}), exitHTTPError, &HTTPError{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := exitCode(tt.err); code != tt.wantCode {
+				t.Errorf("exitCode() = %d, want %d", code, tt.wantCode)
+			}
+
+			if tt.wantIs != nil && !errors.Is(tt.err, tt.wantIs) {
+				t.Errorf("errors.Is(%v, %v) = false", tt.err, tt.wantIs)
+			}
+		})
+	}
+
+	if errors.Is(&HTTPError{Code: http.StatusBadGateway}, &HTTPError{Code: http.StatusNotFound}) {
+		t.Error("HTTPError matches a different code")
+	}
+}
+
+func TestLatestActiveArtifactReturnsUntypedNil(t *testing.T) {
+	tests := []struct {
+		name      string
+		artifacts []artifact
+		wantID    int
+	}{
+		{"no artifacts", nil, 0},
+		{"only expired", []artifact{{ID: 1, Name: "dist", Expired: true}}, 0},
+		{"other name", []artifact{{ID: 1, Name: "docs"}}, 0},
+		{"match", []artifact{{ID: 1, Name: "dist", Expired: true}, {ID: 2, Name: "dist"}}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found, err := artifacts{Artifacts: tt.artifacts}.LatestActiveArtifact(func(a artifact) bool { return a.Name == "dist" }, "newest")
+
+			if tt.wantID == 0 {
+				if !errors.Is(err, errNoSuitableArtifact) {
+					t.Errorf("LatestActiveArtifact() = %v, want errNoSuitableArtifact", err)
+				}
+
+				return
+			}
+
+			// A nil *NotFoundError in the error interface wouldn't compare equal to nil
+			if err != nil || found.ID != tt.wantID {
+				t.Errorf("LatestActiveArtifact() = %d, %#v, want %d, nil", found.ID, err, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  []string
+		want    http.Header
+		wantErr bool
+	}{
+		{"none", nil, http.Header{}, false},
+		{"trimmed", []string{"  X-Api-Key :  secret "}, http.Header{"X-Api-Key": {"secret"}}, false},
+		{"value with colon", []string{"X-Forwarded-Host: example.com:8443"}, http.Header{"X-Forwarded-Host": {"example.com:8443"}}, false},
+		{"repeated", []string{"X-Tag: a", "x-tag: b"}, http.Header{"X-Tag": {"a", "b"}}, false},
+		{"empty value", []string{"X-Empty:"}, http.Header{"X-Empty": {""}}, false},
+		{"missing colon", []string{"X-Api-Key secret"}, nil, true},
+		{"empty name", []string{": value"}, nil, true},
+		{"space in name", []string{"X Api: value"}, nil, true},
+		{"authorization", []string{"authorization: Bearer other"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers, err := parseHeaders(tt.values)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseHeaders() = %v, want error %v", err, tt.wantErr)
+			}
+
+			if !tt.wantErr && fmt.Sprint(headers) != fmt.Sprint(tt.want) {
+				t.Errorf("parseHeaders() = %v, want %v", headers, tt.want)
+			}
+		})
+	}
+}
+
+func TestCustomHeadersReachServer(t *testing.T) {
+	received := make(chan http.Header, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+		json.NewEncoder(w).Encode(artifacts{})
+	}))
+	defer server.Close()
+
+	u := newTestUpdater(t, "-r", "owner/repo", "-t", "token", "-d", t.TempDir(), "-api-url", server.URL, "-header", "X-Api-Key: secret", "-header", "X-Tag: a")
+
+	if _, err := u.Artifacts(); err != nil {
+		t.Fatal(err)
+	}
+
+	header := <-received
+
+	if header.Get("X-Api-Key") != "secret" || header.Get("X-Tag") != "a" {
+		t.Errorf("server received %v, want the custom headers", header)
+	}
+
+	if !strings.HasSuffix(header.Get("Authorization"), "token") {
+		t.Errorf("Authorization = %q, want the token of -t", header.Get("Authorization"))
+	}
+}
+
+func TestConfigPrintRedactsSecrets(t *testing.T) {
+	var cfg config
+	flags := flag.NewFlagSet("updater", flag.ContinueOnError)
+	cfg.RegisterFlags(flags)
+
+	if err := flags.Parse([]string{"-r", "owner/repo", "-t", "sekrit-t", "-token", "ghe.example.com=sekrit-host", "-header", "X-Api-Key: sekrit123", "-header", "X-Tag: sekrit-tag", "-print-config"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+
+	if err := cfg.Print(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(out.String(), "sekrit") {
+		t.Errorf("Print() revealed a secret:\n%s", out.String())
+	}
+
+	var printed struct {
+		Token   string   `json:"token"`
+		Tokens  []string `json:"tokens"`
+		Headers []string `json:"headers"`
+	}
+
+	if err := json.Unmarshal([]byte(out.String()), &printed); err != nil {
+		t.Fatal(err)
+	}
+
+	want := config{Token: "[redacted]", Tokens: stringList{"ghe.example.com=[redacted]"}, Headers: stringList{"X-Api-Key: [redacted]", "X-Tag: [redacted]"}}
+
+	if printed.Token != want.Token || fmt.Sprint(printed.Tokens) != fmt.Sprint(want.Tokens) || fmt.Sprint(printed.Headers) != fmt.Sprint(want.Headers) {
+		t.Errorf("Print() = %q, %q, %q, want %q, %q, %q", printed.Token, printed.Tokens, printed.Headers, want.Token, want.Tokens, want.Headers)
+	}
+
+	if cfg.Headers[0] != "X-Api-Key: sekrit123" {
+		t.Errorf("Print() changed the configuration to %q", cfg.Headers)
+	}
+}
+
+func TestBandwidthSet(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{"5MB/s", 5 * 1024 * 1024, false},
+		{"512kb/s", 512 * 1024, false},
+		{"100", 100, false},
+		{"1.5KB", 1536, false},
+		{"fast", 0, true},
+		{"-1MB/s", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			var b bandwidth
+			err := b.Set(tt.value)
+
+			if (err != nil) != tt.wantErr || (!tt.wantErr && int64(b.byteSize) != tt.want) {
+				t.Errorf("Set(%q) = %d, %v, want %d, error %v", tt.value, b.byteSize, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestThrottledReaderThroughput(t *testing.T) {
+	tests := []struct {
+		name string
+		rate int64
+		size int
+	}{
+		{"100KB/s", 100 * 1024, 30 * 1024},
+		{"1MB/s", 1024 * 1024, 256 * 1024},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started := time.Now()
+			r := newThrottledReader(strings.NewReader(strings.Repeat("x", tt.size)), tt.rate)
+			buf := make([]byte, 1024*1024)
+			total := 0
+
+			for {
+				n, err := r.Read(buf)
+				total += n
+
+				if int64(n) > tt.rate/10 {
+					t.Fatalf("read %d bytes at once, more than a tenth of a second worth", n)
+				}
+
+				if err == io.EOF {
+					break
+				}
+
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want := time.Duration(float64(tt.size) / float64(tt.rate) * float64(time.Second))
+
+			if elapsed := time.Since(started); total != tt.size || elapsed < want*8/10 || elapsed > want*2 {
+				t.Errorf("read %d bytes in %s, want %d in about %s", total, elapsed, tt.size, want)
+			}
+		})
+	}
+}
+
+func TestExtractCreatesEmptyDirectories(t *testing.T) {
+	tests := []struct {
+		name       string
+		files      map[string]string
+		ensureDirs []string
+		wantDirs   []string
+	}{
+		{"explicit empty directory entry", map[string]string{"index.html": "index", "logs/": ""}, nil, []string{"logs"}},
+		{"nested empty directory entry", map[string]string{"var/cache/": ""}, nil, []string{"var/cache"}},
+		{"ensure-dir", map[string]string{"index.html": "index"}, []string{"tmp", "data/uploads"}, []string{"tmp", "data/uploads"}},
+		{"ensure-dir already in the archive", map[string]string{"tmp/": ""}, []string{"tmp"}, []string{"tmp"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive := writeTestZip(t, tt.files)
+			dest := t.TempDir()
+			u := updater{ensureDirs: tt.ensureDirs, stats: &runStats{}}
+
+			if _, err := u.Extract(archive, dest); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, dir := range tt.wantDirs {
+				if info, err := os.Stat(filepath.Join(dest, filepath.FromSlash(dir))); err != nil || !info.IsDir() {
+					t.Errorf("%s wasn't created: %v", dir, err)
+				}
+			}
+		})
+	}
+}
+
+func TestBackupsIgnoreOtherFiles(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "site")
+	writeTestTree(t, dir, map[string]string{"index.html": "v1"})
+	u := newTestUpdater(t, "-r", "owner/repo", "-t", "token", "-d", dir, "-backup", "-keep-backups", "2")
+	writeTestTree(t, u.BackupDirectory(), map[string]string{
+		"20240101120000/index.html": "old",
+		"20240101120000.tar.gz":     "",
+		"notes.txt":                 "mine",
+		"zz-unrelated/file":         "mine",
+	})
+
+	first, err := u.Backup()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := u.Backup()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first == second {
+		t.Fatalf("two backups share the path %s", first)
+	}
+
+	latest, err := u.LatestBackup()
+
+	if err != nil || latest != second {
+		t.Errorf("LatestBackup() = %s, %v, want %s", latest, err, second)
+	}
+
+	if err := u.PruneBackups(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(u.BackupDirectory())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+
+	want := []string{filepath.Base(first), filepath.Base(second), "notes.txt", "zz-unrelated"}
+
+	if fmt.Sprint(names) != fmt.Sprint(want) {
+		t.Errorf("backup directory holds %v after pruning, want %v", names, want)
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("UPDATER_TEST_ENV", "staging")
+	t.Setenv("UPDATER_TEST_EMPTY", "")
+
+	tests := []struct {
+		value   string
+		want    string
+		wantErr string
+	}{
+		{"app-${UPDATER_TEST_ENV}-bundle", "app-staging-bundle", ""},
+		{"app-$UPDATER_TEST_ENV", "app-staging", ""},
+		{"plain-name", "plain-name", ""},
+		{"app${UPDATER_TEST_EMPTY}", "app", ""},
+		{"app-${UPDATER_TEST_UNSET}", "", "UPDATER_TEST_UNSET is not set"},
+		{"${UPDATER_TEST_UNSET}-${UPDATER_TEST_OTHER}", "", "UPDATER_TEST_UNSET, UPDATER_TEST_OTHER is not set"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			expanded, err := expandEnv(tt.value)
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("expandEnv() = %q, %v, want error %q", expanded, err, tt.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil || expanded != tt.want {
+				t.Errorf("expandEnv() = %q, %v, want %q", expanded, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestArtifactsConditionalGet(t *testing.T) {
+	const lastModified = "Wed, 01 May 2024 10:00:00 GMT"
+
+	tests := []struct {
+		name            string
+		lastModified    string
+		wantCondition   string
+		wantNotModified bool
+	}{
+		{"not modified", lastModified, lastModified, true},
+		{"no Last-Modified", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var conditions []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conditions = append(conditions, r.Header.Get("If-Modified-Since"))
+
+				if tt.lastModified != "" && r.Header.Get("If-Modified-Since") == tt.lastModified {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+
+				if tt.lastModified != "" {
+					w.Header().Set("Last-Modified", tt.lastModified)
+				}
+
+				json.NewEncoder(w).Encode(artifacts{Count: 1, Artifacts: []artifact{{ID: 7, Name: "dist"}}})
+			}))
+			defer server.Close()
+
+			cacheFile := filepath.Join(t.TempDir(), "cache.json")
+			args := []string{"-r", "owner/repo", "-t", "token", "-d", t.TempDir(), "-api-url", server.URL, "-cache-file", cacheFile, "-cache-ttl", "0s"}
+
+			for i, want := range []string{"", tt.wantCondition} {
+				u := newTestUpdater(t, args...)
+				data, err := u.Artifacts()
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if len(data.Artifacts) != 1 || data.Artifacts[0].ID != 7 {
+					t.Errorf("request %d returned %+v, want the listing", i+1, data)
+				}
+
+				if conditions[i] != want {
+					t.Errorf("request %d sent If-Modified-Since %q, want %q", i+1, conditions[i], want)
+				}
+
+				if notModified := i == 1 && tt.wantNotModified; u.stats.ListingNotModified != notModified {
+					t.Errorf("request %d ListingNotModified = %v, want %v", i+1, u.stats.ListingNotModified, notModified)
+				}
+			}
+		})
+	}
+}
+
+func TestRequireEmpty(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		force   bool
+		wantErr bool
+	}{
+		{"empty", nil, false, false},
+		{"state marker present", map[string]string{stateMarker: "{}", "index.html": "index"}, false, false},
+		{"unexpected contents", map[string]string{"notes.txt": "mine"}, false, true},
+		{"unexpected contents with force", map[string]string{"notes.txt": "mine"}, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTestTree(t, dir, tt.files)
+			err := updater{directory: dir, requireEmpty: true, force: tt.force, allowProtected: true}.CheckDirectory()
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CheckDirectory() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckProtectedDirectory(t *testing.T) {
+	home := t.TempDir()
+	cwd := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Chdir(cwd)
+
+	linkToHome := filepath.Join(t.TempDir(), "home")
+
+	if err := os.Symlink(home, linkToHome); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		dir     string
+		wantErr bool
+	}{
+		{"root", "/", true},
+		{"root with dots", "/tmp/..", true},
+		{"home", home, true},
+		{"symlink to home", linkToHome, true},
+		{"working directory", ".", true},
+		{"etc", "/etc", true},
+		{"usr", "/usr", true},
+		{"tmp", "/tmp", false},
+		{"var", "/var", false},
+		{"opt", "/opt", false},
+		{"srv", "/srv", false},
+		{"subdirectory of usr", "/usr/share/site", false},
+		{"subdirectory of home", filepath.Join(home, "site"), false},
+		{"missing directory", filepath.Join(cwd, "missing", "site"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkProtectedDirectory(tt.dir); (err != nil) != tt.wantErr {
+				t.Errorf("checkProtectedDirectory(%q) = %v, want error %v", tt.dir, err, tt.wantErr)
+			}
+		})
+	}
+
+	if err := (updater{directory: home, allowProtected: true}).CheckDirectory(); err != nil {
+		t.Errorf("CheckDirectory() with -i-know-what-im-doing = %v, want nil", err)
+	}
+}
+
+func TestExtractSubpath(t *testing.T) {
+	archive := writeTestZip(t, map[string]string{"web/index.html": "index", "web/js/app.js": "app", "worker/main.go": "main", "website/other.html": "other"})
+
+	tests := []struct {
+		name    string
+		subpath string
+		want    map[string]string
+		wantErr string
+	}{
+		{"top-level path", "web", map[string]string{"index.html": "index", "js/app.js": "app"}, ""},
+		{"nested path", "web/js", map[string]string{"app.js": "app"}, ""},
+		{"trailing slash", "worker/", map[string]string{"main.go": "main"}, ""},
+		{"no match", "docs", nil, "no such path in the archive"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := t.TempDir()
+			u := updater{subpath: cleanSubpath(tt.subpath), stats: &runStats{}}
+			_, err := u.Extract(archive, dest)
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Extract() = %v, want %q", err, tt.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := readTestTree(t, dest); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("extracted %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDownloadFileRedirects(t *testing.T) {
+	tests := []struct {
+		name          string
+		cdnStatus     int
+		wantErr       bool
+		wantAuthError bool
+	}{
+		{"pre-signed redirect", http.StatusOK, false, false},
+		{"unauthorized after redirect", http.StatusUnauthorized, true, true},
+		{"forbidden after redirect", http.StatusForbidden, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cdnAuthorization string
+			cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				cdnAuthorization = r.Header.Get("Authorization")
+
+				if r.URL.Query().Get("sig") != "signed" || tt.cdnStatus != http.StatusOK {
+					w.WriteHeader(tt.cdnStatus)
+					return
+				}
+
+				fmt.Fprint(w, "archive")
+			}))
+			defer cdn.Close()
+
+			var apiAuthorization string
+			api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				apiAuthorization = r.Header.Get("Authorization")
+				http.Redirect(w, r, cdn.URL+"/archive.zip?sig=signed", http.StatusFound)
+			}))
+			defer api.Close()
+
+			fileName := filepath.Join(t.TempDir(), "archive.zip")
+			u := newTestUpdater(t, "-r", "owner/repo", "-t", "token", "-d", t.TempDir(), "-api-url", api.URL)
+			err := u.DownloadFile(api.URL+"/repos/owner/repo/actions/artifacts/1/zip", fileName, 0)
+
+			if !strings.HasSuffix(apiAuthorization, "token") {
+				t.Errorf("API host got Authorization %q, want the token", apiAuthorization)
+			}
+
+			if cdnAuthorization != "" {
+				t.Errorf("pre-signed URL got Authorization %q, want none", cdnAuthorization)
+			}
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DownloadFile() = %v, want error %v", err, tt.wantErr)
+			}
+
+			var authErr *AuthError
+
+			if tt.wantAuthError && (!errors.As(err, &authErr) || !strings.Contains(err.Error(), "redirected from")) {
+				t.Errorf("DownloadFile() = %v, want an AuthError about the redirect", err)
+			}
+		})
+	}
+}
+
+func TestRequireConclusion(t *testing.T) {
+	conclusions := map[string]string{"/repos/owner/repo/actions/runs/1": "success", "/repos/owner/repo/actions/runs/2": "failure"}
+	lookups := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conclusion, ok := conclusions[r.URL.Path]
+		lookups[r.URL.Path]++
+
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		json.NewEncoder(w).Encode(workflowRun{Status: "completed", Conclusion: conclusion})
+	}))
+	defer server.Close()
+
+	u := newTestUpdater(t, "-r", "owner/repo", "-t", "token", "-d", t.TempDir(), "-api-url", server.URL, "-require-conclusion", "success")
+
+	tests := []struct {
+		name string
+		run  *workflowRun
+		want bool
+	}{
+		{"successful run", &workflowRun{ID: 1}, true},
+		{"failed run", &workflowRun{ID: 2}, false},
+		{"successful run again", &workflowRun{ID: 1}, true},
+		{"unknown run", &workflowRun{ID: 3}, false},
+		{"no run", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := u.HasConclusion(artifact{ID: 10, Name: "dist", WorkflowRun: tt.run}); got != tt.want {
+				t.Errorf("HasConclusion() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if lookups["/repos/owner/repo/actions/runs/1"] != 1 {
+		t.Errorf("run 1 was looked up %d times, want once", lookups["/repos/owner/repo/actions/runs/1"])
+	}
+
+	if !newTestUpdater(t, "-r", "owner/repo", "-t", "token", "-d", t.TempDir()).HasConclusion(artifact{ID: 10}) {
+		t.Error("HasConclusion() without -require-conclusion = false, want true")
+	}
+}
+
+func TestBestEffortExtraction(t *testing.T) {
+	archive := writeTestZip(t, map[string]string{"a.txt": "a", "blocked/file.txt": "blocked", "z.txt": "z"})
+
+	tests := []struct {
+		name       string
+		bestEffort bool
+		wantFiles  []string
+	}{
+		{"fail fast", false, nil},
+		{"best effort", true, []string{"a.txt", "z.txt"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := t.TempDir()
+
+			// A file where the archive wants a directory can't be written around
+			writeTestTree(t, dest, map[string]string{"blocked": "in the way"})
+
+			_, err := unzip(archive, dest, extractOptions{BestEffort: tt.bestEffort, Workers: 1})
+
+			if err == nil {
+				t.Fatal("unzip() succeeded, want an error for blocked/file.txt")
+			}
+
+			if tt.bestEffort && (!strings.Contains(err.Error(), "1 of 3 entries failed") || !strings.Contains(err.Error(), "blocked/file.txt")) {
+				t.Errorf("unzip() = %v, want a report naming blocked/file.txt", err)
+			}
+
+			for _, name := range tt.wantFiles {
+				if _, err := os.Stat(filepath.Join(dest, name)); err != nil {
+					t.Errorf("%s wasn't extracted past the failure: %v", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestNormalizeEOL(t *testing.T) {
+	files := map[string]string{
+		"run.sh":          "#!/bin/sh\r\necho hi\r\n",
+		"lib/util.sh":     "a\r\nb\r\n",
+		"notes.txt":       "kept\r\nas is\r\n",
+		"data.sh":         "binary\x00\r\ncontent\r\n",
+		"lone-cr-only.sh": "a\rb\r",
+	}
+	archive := writeTestZip(t, files)
+
+	tests := []struct {
+		name         string
+		normalizeEOL bool
+		want         map[string]string
+	}{
+		{"off", false, files},
+		{"on", true, map[string]string{
+			"run.sh":          "#!/bin/sh\necho hi\n",
+			"lib/util.sh":     "a\nb\n",
+			"notes.txt":       "kept\r\nas is\r\n",
+			"data.sh":         "binary\x00\r\ncontent\r\n",
+			"lone-cr-only.sh": "a\rb\r",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := t.TempDir()
+			u := updater{normalizeEOL: tt.normalizeEOL, textGlobs: []string{"*.sh"}, stats: &runStats{}}
+
+			if _, err := u.Extract(archive, dest); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := readTestTree(t, dest); fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tt.want) {
+				t.Errorf("extracted %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchesCommit(t *testing.T) {
+	const sha = "0123456789abcdef0123456789abcdef01234567"
+	lookups := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups++
+		json.NewEncoder(w).Encode(workflowRun{ID: 5, HeadSHA: sha, Status: "completed"})
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		commit string
+		run    *workflowRun
+		want   bool
+	}{
+		{"full sha", sha, &workflowRun{ID: 1, HeadSHA: sha}, true},
+		{"abbreviated sha", "0123456", &workflowRun{ID: 1, HeadSHA: sha}, true},
+		{"uppercase sha", "0123456789ABCDEF", &workflowRun{ID: 1, HeadSHA: sha}, true},
+		{"other sha", "fedcba9", &workflowRun{ID: 1, HeadSHA: sha}, false},
+		{"no run", "0123456", nil, false},
+		{"looked up sha", "0123456", &workflowRun{ID: 5}, true},
+		{"looked up other sha", "fedcba9", &workflowRun{ID: 5}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := newTestUpdater(t, "-r", "owner/repo", "-t", "token", "-d", t.TempDir(), "-api-url", server.URL, "-commit", tt.commit)
+
+			if got := u.MatchesCommit(artifact{ID: 10, Name: "dist", WorkflowRun: tt.run}); got != tt.want {
+				t.Errorf("MatchesCommit() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	u := newTestUpdater(t, "-r", "owner/repo", "-t", "token", "-d", t.TempDir(), "-api-url", server.URL, "-commit", "0123456")
+	lookups = 0
+
+	for i := 0; i < 2; i++ {
+		u.MatchesCommit(artifact{ID: 10, Name: "dist", WorkflowRun: &workflowRun{ID: 5}})
+	}
+
+	if lookups != 1 {
+		t.Errorf("run 5 was looked up %d times, want once", lookups)
+	}
+
+	_, err := artifacts{Artifacts: []artifact{{ID: 10, Name: "dist", WorkflowRun: &workflowRun{ID: 1, HeadSHA: sha}}}}.LatestActiveArtifact(newTestUpdater(t, "-r", "owner/repo", "-t", "token", "-d", t.TempDir(), "-commit", "fedcba9").Accepts, "newest")
+
+	if !errors.Is(err, errNoSuitableArtifact) {
+		t.Errorf("LatestActiveArtifact() for another commit = %v, want errNoSuitableArtifact", err)
+	}
+}
+
+func TestClearDirectoryManyEntries(t *testing.T) {
+	files := make(map[string]string)
+
+	for i := 0; i < 500; i++ {
+		files[fmt.Sprintf("file%03d.txt", i)] = "x"
+		files[fmt.Sprintf("dir%02d/file%03d.txt", i%20, i)] = "x"
+	}
+
+	files["config/local.json"] = "{}"
+
+	tests := []struct {
+		name string
+		keep []string
+		want map[string]string
+	}{
+		{"everything", nil, map[string]string{}},
+		{"keep one file", []string{"-keep", "config/local.json"}, map[string]string{"config/local.json": "{}"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTestTree(t, dir, files)
+			u := newTestUpdater(t, append([]string{"-r", "owner/repo", "-t", "token", "-d", dir}, tt.keep...)...)
+
+			if err := u.ClearDirectory(dir); err != nil {
+				t.Fatalf("ClearDirectory() error = %v", err)
+			}
+
+			got := readTestTree(t, dir)
+
+			if len(got) != len(tt.want) || got["config/local.json"] != tt.want["config/local.json"] {
+				t.Errorf("ClearDirectory() left %v, want %v", got, tt.want)
+			}
+
+			entries, err := os.ReadDir(dir)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(entries) != len(tt.want) {
+				t.Errorf("ClearDirectory() left %d entries, want %d", len(entries), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestCacheDir(t *testing.T) {
+	requests := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		json.NewEncoder(w).Encode(artifacts{Count: 1, Artifacts: []artifact{{ID: requests[r.URL.Path], Name: "dist"}}})
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		repository string
+		args       []string
+		wantID     int
+	}{
+		{"miss", "owner/repo", nil, 1},
+		{"hit", "owner/repo", nil, 1},
+		{"other repository", "owner/other", nil, 1},
+		{"refresh", "owner/repo", []string{"-refresh"}, 2},
+		{"expired", "owner/repo", []string{"-cache-ttl", "0s"}, 3},
+	}
+
+	cacheHome := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cacheHome)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := newTestUpdater(t, append([]string{"-r", tt.repository, "-t", "token", "-d", t.TempDir(), "-api-url", server.URL, "-cache"}, tt.args...)...)
+
+			if dir := filepath.Join(cacheHome, "updater"); u.cacheDir != dir {
+				t.Errorf("cacheDir = %s, want %s", u.cacheDir, dir)
+			}
+
+			data, err := u.Artifacts()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(data.Artifacts) != 1 || data.Artifacts[0].ID != tt.wantID {
+				t.Errorf("Artifacts() = %+v, want artifact %d", data, tt.wantID)
+			}
+		})
+	}
+
+	entries, err := filepath.Glob(filepath.Join(cacheHome, "updater", "*"+compressedCacheSuffix))
+
+	if err != nil || len(entries) != 2 {
+		t.Errorf("cache directory holds %v, want an entry per repository", entries)
+	}
+}
+
+func TestEvictCache(t *testing.T) {
+	dir := t.TempDir()
+	stale := time.Now().Add(-2 * cacheRetention)
+
+	tests := []struct {
+		name     string
+		modTime  time.Time
+		wantKept bool
+	}{
+		{"fresh.json.gz", time.Now(), true},
+		{"stale.json.gz", stale, false},
+		{"other.txt", stale, true},
+	}
+
+	for _, tt := range tests {
+		filePath := filepath.Join(dir, tt.name)
+
+		if err := os.WriteFile(filePath, []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Chtimes(filePath, tt.modTime, tt.modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := newTestUpdater(t, "-r", "owner/repo", "-t", "token", "-d", t.TempDir(), "-cache-dir", dir).EvictCache(); err != nil {
+		t.Fatalf("EvictCache() error = %v", err)
+	}
+
+	for _, tt := range tests {
+		if _, err := os.Stat(filepath.Join(dir, tt.name)); (err == nil) != tt.wantKept {
+			t.Errorf("%s kept = %v, want %v", tt.name, err == nil, tt.wantKept)
+		}
+	}
+
+	if err := newTestUpdater(t, "-r", "owner/repo", "-t", "token", "-d", t.TempDir(), "-cache-dir", filepath.Join(dir, "missing")).EvictCache(); err != nil {
+		t.Errorf("EvictCache() of a missing directory error = %v, want nil", err)
+	}
+}
+
+func TestMatchesPathOrParent(t *testing.T) {
+	patterns := []string{"bin/*", "web", "*.txt"}
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"bin/app", true},
+		{"bin/sub/app", true},
+		{"web/js/app.js", true},
+		{"website/index.html", false},
+		{"notes.txt", true},
+		{"docs/notes.txt", false},
+		{"../notes.txt", false},
+		{"/bin/app", false},
+		{"web/../etc/passwd", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchesPathOrParent(patterns, tt.name); got != tt.want {
+				t.Errorf("matchesPathOrParent(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowPathsRejectsArchive(t *testing.T) {
+	files := map[string]string{"web/index.html": "index", "web/js/app.js": "app", "cron/backdoor.sh": "evil"}
+	headers := []tar.Header{
+		{Name: "web/index.html", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "cron/backdoor.sh", Typeflag: tar.TypeReg, Mode: 0755},
+	}
+
+	tests := []struct {
+		name       string
+		archive    string
+		allowPaths []string
+		wantErr    bool
+	}{
+		{"zip within allowlist", writeTestZip(t, files), []string{"web", "cron/*"}, false},
+		{"zip outside allowlist", writeTestZip(t, files), []string{"web"}, true},
+		{"tar.gz within allowlist", writeTestTarGz(t, headers, files), []string{"web", "cron/*"}, false},
+		{"tar.gz outside allowlist", writeTestTarGz(t, headers, files), []string{"web"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := t.TempDir()
+			u := updater{directory: dest, allowPaths: tt.allowPaths, stats: &runStats{}}
+			err := u.ValidateArchive(tt.archive)
+
+			var disallowedErr *DisallowedPathError
+
+			if tt.wantErr {
+				if !errors.As(err, &disallowedErr) || disallowedErr.Name != "cron/backdoor.sh" {
+					t.Errorf("ValidateArchive() = %v, want a DisallowedPathError for cron/backdoor.sh", err)
+				}
+
+				if _, err := u.Extract(tt.archive, dest); !errors.As(err, &disallowedErr) {
+					t.Errorf("Extract() = %v, want a DisallowedPathError", err)
+				}
+
+				if got := readTestTree(t, dest); len(got) != 0 {
+					t.Errorf("rejected archive wrote %v", got)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Errorf("ValidateArchive() = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestTokenFor(t *testing.T) {
+	netrc := filepath.Join(t.TempDir(), ".netrc")
+	content := "machine api.github.com login x-access-token password from-netrc\nmachine GHE.example.com password overridden\ndefault login anonymous password ignored\n"
+
+	if err := os.WriteFile(netrc, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	u := newTestUpdater(t, "-r", "owner/repo", "-t", "default", "-d", t.TempDir(), "-netrc", netrc, "-token", "ghe.example.com=from-flag", "-token", "localhost:8443=with-port")
+
+	tests := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{"netrc entry", "https://api.github.com/repos/owner/repo/actions/artifacts", "from-netrc"},
+		{"-token over netrc", "https://ghe.example.com/api/v3/repos/owner/repo", "from-flag"},
+		{"host with port", "https://localhost:8443/api/v3", "with-port"},
+		{"host without port entry", "https://ghe.example.com:8443/api/v3", "from-flag"},
+		{"fallback to -t", "https://other.example.com/api/v3", "default"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, tt.url, nil)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			u.AddAuthorizationHeader(req)
+
+			if got := req.Header.Get("Authorization"); got != "Bearer "+tt.want {
+				t.Errorf("Authorization = %q, want %q", got, "Bearer "+tt.want)
+			}
+		})
+	}
+
+	for _, value := range []string{"ghe.example.com", "=token", "ghe.example.com= "} {
+		if err := parseHostTokens([]string{value}, make(map[string]string)); err == nil {
+			t.Errorf("parseHostTokens(%q) = nil, want an error", value)
+		}
+	}
+}
+
+func TestCopyTreePreservesModesAndTimes(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "staging")
+	writeTestTree(t, src, map[string]string{"index.html": "index", "bin/run.sh": "#!/bin/sh", "static/css/site.css": "body {}"})
+
+	if err := os.Symlink("index.html", filepath.Join(src, "home.html")); err != nil {
+		t.Fatal(err)
+	}
+
+	modTime := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		mode os.FileMode
+	}{
+		{"index.html", 0640},
+		{"bin/run.sh", 0755},
+		{"static/css/site.css", 0600},
+		{"static/css", 0750},
+		{"bin", 0711},
+	}
+
+	for _, tt := range tests {
+		filePath := filepath.Join(src, filepath.FromSlash(tt.name))
+
+		if err := os.Chmod(filePath, tt.mode); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Chtimes(filePath, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dst := filepath.Join(t.TempDir(), "target")
+
+	if err := copyTree(src, dst); err != nil {
+		t.Fatalf("copyTree() error = %v", err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := os.Stat(filepath.Join(dst, filepath.FromSlash(tt.name)))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if info.Mode().Perm() != tt.mode {
+				t.Errorf("mode = %v, want %v", info.Mode().Perm(), tt.mode)
+			}
+
+			if !info.ModTime().Equal(modTime) {
+				t.Errorf("modification time = %v, want %v", info.ModTime(), modTime)
+			}
+		})
+	}
+
+	if link, err := os.Readlink(filepath.Join(dst, "home.html")); err != nil || link != "index.html" {
+		t.Errorf("home.html links to %q, %v, want index.html", link, err)
+	}
+
+	if got, want := readTestTree(t, dst), readTestTree(t, src); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("copied %v, want %v", got, want)
+	}
+}
+
+func TestMoveDirectory(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "staging")
+	writeTestTree(t, src, map[string]string{"index.html": "index"})
+	dst := filepath.Join(filepath.Dir(src), "target")
+
+	if err := moveDirectory(src, dst); err != nil {
+		t.Fatalf("moveDirectory() error = %v", err)
+	}
+
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("source still exists: %v", err)
+	}
+
+	if got := readTestTree(t, dst); got["index.html"] != "index" {
+		t.Errorf("moved %v, want index.html", got)
+	}
+}
+
+func TestSelectPolicy(t *testing.T) {
+	candidates := []artifact{
+		{ID: 1, Name: "dist", SizeInBytes: 300, CreatedAt: "2024-05-01T10:00:00Z"},
+		{ID: 2, Name: "dist", SizeInBytes: 100, CreatedAt: "2024-05-02T10:00:00Z"},
+		{ID: 3, Name: "dist", SizeInBytes: 300, CreatedAt: "2024-05-03T10:00:00Z"},
+		{ID: 4, Name: "dist", SizeInBytes: 200, CreatedAt: "2024-05-04T10:00:00Z"},
+		{ID: 5, Name: "dist", SizeInBytes: 100, CreatedAt: "2024-05-01T09:00:00Z"},
+		{ID: 6, Name: "dist", SizeInBytes: 900, CreatedAt: "2024-05-05T10:00:00Z", Expired: true},
+		{ID: 7, Name: "docs", SizeInBytes: 10, CreatedAt: "2024-05-06T10:00:00Z"},
+	}
+
+	tests := []struct {
+		policy string
+		wantID int
+	}{
+		{"newest", 4},
+		{"largest", 3},
+		{"smallest", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			found, err := artifacts{Artifacts: candidates}.LatestActiveArtifact(func(a artifact) bool { return a.Name == "dist" }, tt.policy)
+
+			if err != nil || found.ID != tt.wantID {
+				t.Errorf("LatestActiveArtifact(%s) = %d, %v, want %d", tt.policy, found.ID, err, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestSinceLastDeploy(t *testing.T) {
+	archive, err := os.ReadFile(writeTestZip(t, map[string]string{"index.html": "new"}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deployed := artifact{ID: 42, Name: "dist", CreatedAt: "2024-05-01T10:00:00Z", UpdatedAt: "2024-05-01T10:00:00Z"}
+	newer := artifact{ID: 43, Name: "dist", CreatedAt: "2024-05-02T10:00:00Z", UpdatedAt: "2024-05-02T10:00:00Z"}
+
+	tests := []struct {
+		name      string
+		listing   []artifact
+		force     bool
+		wantID    int
+		wantFiles map[string]string
+	}{
+		{"nothing newer", []artifact{deployed}, false, 42, map[string]string{"index.html": "old"}},
+		{"newer artifact", []artifact{deployed, newer}, false, 43, map[string]string{"index.html": "new"}},
+		{"forced", []artifact{deployed}, true, 42, map[string]string{"index.html": "new"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			downloads := 0
+			var server *httptest.Server
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/artifacts") {
+					listing := artifacts{Count: len(tt.listing)}
+
+					for _, a := range tt.listing {
+						a.ArchiveDownloadURL = fmt.Sprintf("%s/download/%d", server.URL, a.ID)
+						listing.Artifacts = append(listing.Artifacts, a)
+					}
+
+					json.NewEncoder(w).Encode(listing)
+					return
+				}
+
+				downloads++
+				w.Write(archive)
+			}))
+			defer server.Close()
+
+			dir := filepath.Join(t.TempDir(), "site")
+			writeTestTree(t, dir, map[string]string{"index.html": "old"})
+			args := []string{"-r", "owner/repo", "-t", "token", "-d", dir, "-api-url", server.URL, "-since-last-deploy"}
+
+			if tt.force {
+				args = append(args, "-force")
+			}
+
+			u := newTestUpdater(t, args...)
+
+			if err := u.WriteState(dir, deployed); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := u.Update(); err != nil {
+				t.Fatalf("Update() error = %v", err)
+			}
+
+			state, err := u.ReadState()
+
+			if err != nil || state.ArtifactID != tt.wantID {
+				t.Errorf("deployed artifact %d, %v, want %d", state.ArtifactID, err, tt.wantID)
+			}
+
+			if wantDownloads := tt.wantFiles["index.html"] == "new"; (downloads == 1) != wantDownloads {
+				t.Errorf("downloaded %d archives, want a download %v", downloads, wantDownloads)
+			}
+
+			if got := readTestTree(t, dir); fmt.Sprint(got) != fmt.Sprint(tt.wantFiles) {
+				t.Errorf("directory holds %v, want %v", got, tt.wantFiles)
+			}
+		})
+	}
+}
+
+// newRangeServer serves content, answering range requests when ranges is set
+// and streaming every response at about a megabyte per second otherwise, like
+// a bandwidth-limited storage host.
+func newRangeServer(content []byte, ranges bool, rangeRequests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			atomic.AddInt32(rangeRequests, 1)
+		}
+
+		if ranges {
+			http.ServeContent(w, r, "archive.zip", time.Time{}, &slowReadSeeker{bytes.NewReader(content)})
+			return
+		}
+
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		io.Copy(w, &slowReadSeeker{bytes.NewReader(content)})
+	}))
+}
+
+// slowReadSeeker reads at most 16 KiB every 16 milliseconds.
+type slowReadSeeker struct {
+	*bytes.Reader
+}
+
+func (s *slowReadSeeker) Read(p []byte) (int, error) {
+	if len(p) > 16*1024 {
+		p = p[:16*1024]
+	}
+
+	time.Sleep(16 * time.Millisecond)
+
+	return s.Reader.Read(p)
+}
+
+func TestDownloadChunks(t *testing.T) {
+	content := make([]byte, 256*1024+17)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	tests := []struct {
+		name              string
+		ranges            bool
+		chunks            string
+		wantRangeRequests int32
+	}{
+		{"range requests", true, "4", 3},
+		{"more chunks than needed", true, "3", 2},
+		{"no range support", false, "4", 0},
+		{"single stream", true, "0", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rangeRequests int32
+			server := newRangeServer(content, tt.ranges, &rangeRequests)
+			defer server.Close()
+
+			fileName := filepath.Join(t.TempDir(), "archive.zip")
+			u := newTestUpdater(t, "-r", "owner/repo", "-t", "token", "-d", t.TempDir(), "-download-chunks", tt.chunks)
+
+			if err := u.DownloadFile(server.URL, fileName, int64(len(content))); err != nil {
+				t.Fatalf("DownloadFile() error = %v", err)
+			}
+
+			downloaded, err := os.ReadFile(fileName)
+
+			if err != nil || !bytes.Equal(downloaded, content) {
+				t.Errorf("downloaded %d bytes, %v, want the %d bytes served", len(downloaded), err, len(content))
+			}
+
+			if rangeRequests != tt.wantRangeRequests {
+				t.Errorf("made %d range requests, want %d", rangeRequests, tt.wantRangeRequests)
+			}
+
+			if u.stats.BytesDownloaded != int64(len(content)) {
+				t.Errorf("BytesDownloaded = %d, want %d", u.stats.BytesDownloaded, len(content))
+			}
+		})
+	}
+}
+
+func TestDownloadChunksRejectsIgnoredRanges(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 100))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	fileName := filepath.Join(t.TempDir(), "archive.zip")
+	u := newTestUpdater(t, "-r", "owner/repo", "-t", "token", "-d", t.TempDir(), "-download-chunks", "4")
+	err := u.DownloadFile(server.URL, fileName, int64(len(content)))
+
+	if err == nil || !strings.Contains(err.Error(), "instead of partial content") {
+		t.Errorf("DownloadFile() = %v, want the ignored range request", err)
+	}
+
+	if _, statErr := os.Stat(fileName); !os.IsNotExist(statErr) {
+		t.Errorf("the failed download was left behind: %v", statErr)
+	}
+}
+
+func BenchmarkDownloadChunks(b *testing.B) {
+	content := make([]byte, 512*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	for _, chunks := range []string{"1", "4", "8"} {
+		b.Run(chunks, func(b *testing.B) {
+			var rangeRequests int32
+			server := newRangeServer(content, true, &rangeRequests)
+			defer server.Close()
+
+			u := newTestUpdater(b, "-r", "owner/repo", "-t", "token", "-d", b.TempDir(), "-download-chunks", chunks)
+			fileName := filepath.Join(b.TempDir(), "archive.zip")
+			b.SetBytes(int64(len(content)))
+
+			for i := 0; i < b.N; i++ {
+				if err := u.DownloadFile(server.URL, fileName, int64(len(content))); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestFsyncExtraction(t *testing.T) {
+	archive := writeTestZip(t, map[string]string{"index.html": "index", "static/css/site.css": "body {}", "static/js/app.js": "app"})
+
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"without -fsync", nil},
+		{"with -fsync", []string{"-fsync"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := t.TempDir()
+			u := newTestUpdater(t, append([]string{"-r", "owner/repo", "-t", "token", "-d", dest}, tt.args...)...)
+
+			if _, err := u.Extract(archive, dest); err != nil {
+				t.Fatalf("Extract() error = %v", err)
+			}
+
+			if got := readTestTree(t, dest); len(got) != 3 || got["static/js/app.js"] != "app" {
+				t.Errorf("extracted %v, want the three files", got)
+			}
+		})
+	}
+
+	if err := syncTree(filepath.Join(t.TempDir(), "missing")); !os.IsNotExist(err) {
+		t.Errorf("syncTree() of a missing directory = %v, want not exist", err)
+	}
+}
+
+func TestOnlyActiveListing(t *testing.T) {
+	listing := artifacts{Count: 4, Artifacts: []artifact{
+		{ID: 1, Name: "dist-active", SizeInBytes: 100},
+		{ID: 2, Name: "dist-expired", SizeInBytes: 100, Expired: true},
+		{ID: 3, Name: "docs-active", SizeInBytes: 100},
+		{ID: 4, Name: "docs-expired", SizeInBytes: 100, Expired: true},
+	}}
+
+	active := listing.Active()
+
+	if active.Count != 2 || len(active.Artifacts) != 2 || active.Artifacts[0].ID != 1 || active.Artifacts[1].ID != 3 {
+		t.Errorf("Active() = %+v, want artifacts 1 and 3", active)
+	}
+
+	if len(listing.Artifacts) != 4 {
+		t.Errorf("Active() changed the listing to %+v", listing)
+	}
+
+	for _, format := range []string{"table", "json", "csv"} {
+		t.Run(format, func(t *testing.T) {
+			var output strings.Builder
+
+			if err := active.Print(&output, format); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, a := range listing.Artifacts {
+				if shown := strings.Contains(output.String(), a.Name); shown == a.Expired {
+					t.Errorf("%s shown %v, expired %v:\n%s", a.Name, shown, a.Expired, output.String())
+				}
+			}
+		})
+	}
+
+	if empty := (artifacts{Artifacts: []artifact{{ID: 2, Expired: true}}}).Active(); empty.Artifacts == nil || empty.Count != 0 {
+		t.Errorf("Active() without active artifacts = %#v, want an empty list", empty)
+	}
+}
+
+func TestDestOwnerCheck(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file ownership is not supported on Windows")
+	}
+
+	uid := os.Getuid()
+	current, err := user.Current()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		check   bool
+		owner   string
+		force   bool
+		wantErr bool
+	}{
+		{"current user", true, "", false, false},
+		{"owner by uid", false, strconv.Itoa(uid), false, false},
+		{"owner by name", false, current.Username, false, false},
+		{"other owner", false, strconv.Itoa(uid + 1), false, true},
+		{"other owner with force", false, strconv.Itoa(uid + 1), true, false},
+		{"check off", false, "", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTestTree(t, dir, map[string]string{"index.html": "index"})
+			err := updater{directory: dir, destOwnerCheck: tt.check, destOwner: tt.owner, force: tt.force, allowProtected: true}.CheckDirectory()
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CheckDirectory() = %v, want error %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr && !strings.Contains(err.Error(), fmt.Sprintf("owned by uid %d instead of uid %d", uid, uid+1)) {
+				t.Errorf("CheckDirectory() = %v, want the ownership mismatch", err)
+			}
+		})
+	}
+}
+
+func TestGrepAndSortListing(t *testing.T) {
+	listing := artifacts{Count: 5, Artifacts: []artifact{
+		{ID: 1, Name: "web-dist", SizeInBytes: 200, CreatedAt: "2024-05-02T10:00:00Z"},
+		{ID: 2, Name: "docs", SizeInBytes: 900, CreatedAt: "2024-05-05T10:00:00Z"},
+		{ID: 3, Name: "api-dist", SizeInBytes: 300, CreatedAt: "2024-05-01T10:00:00Z"},
+		{ID: 4, Name: "cli-dist", SizeInBytes: 200, CreatedAt: "2024-05-03T10:00:00Z"},
+		{ID: 5, Name: "api-dist", SizeInBytes: 100, CreatedAt: "2024-05-04T10:00:00Z"},
+	}}
+
+	tests := []struct {
+		name    string
+		grep    string
+		sort    string
+		wantIDs []int
+	}{
+		{"listing order", "", "", []int{1, 2, 3, 4, 5}},
+		{"by name", "", "name", []int{3, 5, 4, 2, 1}},
+		{"by date", "", "date", []int{2, 5, 4, 1, 3}},
+		{"by size", "", "size", []int{2, 3, 1, 4, 5}},
+		{"grep only", "dist", "", []int{1, 3, 4, 5}},
+		{"grep by name", "dist", "name", []int{3, 5, 4, 1}},
+		{"grep by date", "dist", "date", []int{5, 4, 1, 3}},
+		{"grep by size", "dist", "size", []int{3, 1, 4, 5}},
+		{"grep without match", "mobile", "name", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := artifacts{Count: listing.Count, Artifacts: append([]artifact(nil), listing.Artifacts...)}
+
+			if tt.grep != "" {
+				data = data.Grep(tt.grep)
+			}
+
+			data.Sort(tt.sort)
+
+			var ids []int
+
+			for _, a := range data.Artifacts {
+				ids = append(ids, a.ID)
+			}
+
+			if fmt.Sprint(ids) != fmt.Sprint(tt.wantIDs) {
+				t.Errorf("listed %v, want %v", ids, tt.wantIDs)
+			}
+
+			if data.Count != len(tt.wantIDs) {
+				t.Errorf("Count = %d, want %d", data.Count, len(tt.wantIDs))
+			}
+		})
+	}
+}
+
+func TestExtractUmask(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not supported on Windows")
+	}
+
+	archive := filepath.Join(t.TempDir(), "test.zip")
+	file, err := os.Create(archive)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := zip.NewWriter(file)
+
+	// The directory of the files is implicit, it has no entry of its own
+	for _, entry := range []struct {
+		name string
+		mode os.FileMode
+	}{{"site/data.json", 0666}, {"site/run.sh", 0777}} {
+		header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate}
+		header.SetMode(entry.mode)
+		fw, err := w.CreateHeader(header)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := fw.Write([]byte(entry.name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without -umask the modes of the archive only lose the bits the umask of
+	// the process clears
+	probe := filepath.Join(t.TempDir(), "probe")
+
+	if err := os.WriteFile(probe, nil, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(probe)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	processUmask := 0777 &^ info.Mode().Perm()
+
+	tests := []struct {
+		name      string
+		args      []string
+		wantModes map[string]os.FileMode
+	}{
+		{"umask", []string{"-umask", "022"}, map[string]os.FileMode{"site/data.json": 0644, "site/run.sh": 0755, "site": 0755}},
+		{"archive modes", nil, map[string]os.FileMode{"site/data.json": 0666 &^ processUmask, "site/run.sh": 0777 &^ processUmask}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := t.TempDir()
+			u := newTestUpdater(t, append([]string{"-r", "owner/repo", "-t", "token", "-d", dest}, tt.args...)...)
+
+			if _, err := u.Extract(archive, dest); err != nil {
+				t.Fatal(err)
+			}
+
+			for name, want := range tt.wantModes {
+				info, err := os.Stat(filepath.Join(dest, filepath.FromSlash(name)))
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if info.Mode().Perm() != want {
+					t.Errorf("%s has mode %v, want %v", name, info.Mode().Perm(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestResumeExtract(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	files := map[string]string{"a.txt": "aaaaa", "b.txt": "bbbbb", "c.txt": "ccccc", "d.txt": "ddddd"}
+	archive := filepath.Join(t.TempDir(), "test.zip")
+	file, err := os.Create(archive)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := zip.NewWriter(file)
+
+	for _, name := range []string{"a.txt", "b.txt", "c.txt", "d.txt"} {
+		fw, err := w.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modTime})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := fw.Write([]byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same sized stand-ins tell skipped files apart from extracted ones
+	tests := []struct {
+		name     string
+		existing string
+		modTime  time.Time
+		want     string
+	}{
+		{"a.txt", "AAAAA", modTime, "AAAAA"},
+		{"b.txt", "bb", modTime, "bbbbb"},
+		{"c.txt", "CCCCC", modTime.Add(time.Hour), "ccccc"},
+		{"d.txt", "", time.Time{}, "ddddd"},
+	}
+
+	runs := []struct {
+		name   string
+		resume bool
+	}{
+		{"resume", true},
+		{"without resume", false},
+	}
+
+	for _, run := range runs {
+		t.Run(run.name, func(t *testing.T) {
+			dest := t.TempDir()
+
+			for _, tt := range tests {
+				if tt.existing == "" {
+					continue
+				}
+
+				filePath := filepath.Join(dest, tt.name)
+
+				if err := os.WriteFile(filePath, []byte(tt.existing), 0644); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := os.Chtimes(filePath, tt.modTime, tt.modTime); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			u := updater{directory: dest, resumeExtract: run.resume, stats: &runStats{}}
+			extracted, err := u.Extract(archive, dest)
+
+			if err != nil {
+				t.Fatalf("Extract() error = %v", err)
+			}
+
+			if len(extracted) != len(tests) {
+				t.Errorf("Extract() returned %d files, want %d", len(extracted), len(tests))
+			}
+
+			got := readTestTree(t, dest)
+
+			for _, tt := range tests {
+				want := tt.want
+
+				if !run.resume {
+					want = files[tt.name]
+				}
+
+				if got[tt.name] != want {
+					t.Errorf("%s holds %q, want %q", tt.name, got[tt.name], want)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	listing, err := json.Marshal(artifacts{Count: 1, Artifacts: []artifact{{ID: 7, Name: "dist"}}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	padded := append(append([]byte(nil), listing...), bytes.Repeat([]byte(" "), 2048)...)
+
+	tests := []struct {
+		name    string
+		body    []byte
+		limit   string
+		wantErr bool
+	}{
+		{"default limit", padded, "", false},
+		{"exact fit", listing, fmt.Sprint(len(listing)), false},
+		{"oversized listing", padded, "1KB", true},
+		{"no limit", padded, "0", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(tt.body)
+			}))
+			defer server.Close()
+
+			args := []string{"-r", "owner/repo", "-t", "token", "-d", t.TempDir(), "-api-url", server.URL}
+
+			if tt.limit != "" {
+				args = append(args, "-max-response-size", tt.limit)
+			}
+
+			data, err := newTestUpdater(t, args...).Artifacts()
+
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "exceeds the maximum response size") {
+					t.Errorf("Artifacts() = %v, want the response size error", err)
+				}
+
+				return
+			}
+
+			if err != nil || len(data.Artifacts) != 1 {
+				t.Errorf("Artifacts() = %+v, %v, want the listing", data, err)
+			}
+		})
+	}
+}
+
+func TestChannelSelection(t *testing.T) {
+	listing := artifacts{Artifacts: []artifact{
+		{ID: 1, Name: "app@stable", CreatedAt: "2024-05-01T10:00:00Z"},
+		{ID: 2, Name: "app@beta", CreatedAt: "2024-05-02T10:00:00Z"},
+		{ID: 3, Name: "app@stable", CreatedAt: "2024-05-03T10:00:00Z"},
+		{ID: 4, Name: "app", CreatedAt: "2024-05-04T10:00:00Z"},
+		{ID: 5, Name: "app@beta", CreatedAt: "2024-05-05T10:00:00Z", Expired: true},
+		{ID: 6, Name: "app:beta", CreatedAt: "2024-05-06T10:00:00Z"},
+		{ID: 7, Name: "other@stable", CreatedAt: "2024-05-07T10:00:00Z"},
+		{ID: 8, Name: "app@stable-rc", CreatedAt: "2024-05-08T10:00:00Z"},
+	}}
+
+	tests := []struct {
+		name   string
+		args   []string
+		wantID int
+	}{
+		{"stable channel", []string{"-channel", "stable"}, 3},
+		{"beta channel", []string{"-channel", "beta"}, 2},
+		{"other separator", []string{"-channel", "beta", "-channel-separator", ":"}, 6},
+		{"missing channel", []string{"-channel", "nightly"}, 0},
+		{"no channel", nil, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := newTestUpdater(t, append([]string{"-r", "owner/repo", "-t", "token", "-d", t.TempDir(), "-a", "app"}, tt.args...)...)
+			found, err := listing.LatestActiveArtifact(u.Accepts, "newest")
+
+			if tt.wantID == 0 {
+				if !errors.Is(err, errNoSuitableArtifact) {
+					t.Errorf("LatestActiveArtifact() = %d, %v, want errNoSuitableArtifact", found.ID, err)
+				}
+
+				return
+			}
+
+			if err != nil || found.ID != tt.wantID {
+				t.Errorf("LatestActiveArtifact() = %d, %v, want %d", found.ID, err, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestUpdateLatestSymlink(t *testing.T) {
+	dir := t.TempDir()
+	writeTestTree(t, dir, map[string]string{"releases/1/index.html": "one", "releases/2/index.html": "two"})
+	u := updater{directory: dir, latestSymlink: "latest"}
+	link := filepath.Join(dir, "latest")
+
+	for _, release := range []string{"1", "2"} {
+		if err := u.CheckLatestSymlink(); err != nil {
+			t.Fatalf("CheckLatestSymlink() error = %v", err)
+		}
+
+		if err := u.UpdateLatestSymlink(filepath.Join(dir, "releases", release)); err != nil {
+			t.Fatalf("UpdateLatestSymlink() error = %v", err)
+		}
+
+		if target, err := os.Readlink(link); err != nil || target != filepath.Join("releases", release) {
+			t.Errorf("latest points to %q, %v, want releases/%s", target, err, release)
+		}
+	}
+
+	// Readers of the link always find one of the releases while it's repointed
+	done := make(chan struct{})
+	failures := make(chan error, 1)
+
+	go func() {
+		defer close(failures)
+
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			if _, err := os.ReadFile(filepath.Join(link, "index.html")); err != nil {
+				failures <- err
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		if err := u.UpdateLatestSymlink(filepath.Join(dir, "releases", strconv.Itoa(i%2+1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	close(done)
+
+	if err := <-failures; err != nil {
+		t.Errorf("reading through the link failed while it was repointed: %v", err)
+	}
+
+	if _, err := os.Lstat(link + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("the temporary symlink was left behind: %v", err)
+	}
+
+	blocked := updater{directory: dir, latestSymlink: "releases"}
+
+	if err := blocked.CheckLatestSymlink(); err == nil || !strings.Contains(err.Error(), "is not a symlink") {
+		t.Errorf("CheckLatestSymlink() over a directory = %v, want an error", err)
+	}
+
+	if err := (updater{directory: dir}).UpdateLatestSymlink(filepath.Join(dir, "releases", "1")); err != nil {
+		t.Errorf("UpdateLatestSymlink() without -update-latest-symlink = %v, want nil", err)
+	}
+}
+
+func TestRateLimiterSerializesBursts(t *testing.T) {
+	const interval = 10 * time.Millisecond
+
+	tests := []struct {
+		name     string
+		burst    int
+		requests int
+	}{
+		{"burst of one", 1, 8},
+		{"larger burst", 4, 12},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := newRateLimiter(int(time.Hour/interval), tt.burst)
+			start := time.Now()
+			elapsed := make(chan time.Duration, tt.requests)
+
+			for i := 0; i < tt.requests; i++ {
+				go func() {
+					limiter.Wait()
+					elapsed <- time.Since(start)
+				}()
+			}
+
+			var times []time.Duration
+
+			for i := 0; i < tt.requests; i++ {
+				times = append(times, <-elapsed)
+			}
+
+			sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+
+			for i, got := range times {
+				// Allow for the goroutines starting late, never for passing early
+				if want := time.Duration(i-tt.burst+1) * interval; got < want-interval/2 {
+					t.Errorf("request %d went through after %s, want at least %s", i+1, got, want)
+				}
+			}
+		})
+	}
+
+	var disabled *rateLimiter
+
+	if newRateLimiter(0, 10) != nil {
+		t.Error("newRateLimiter(0) returned a limiter, want nil")
+	}
+
+	start := time.Now()
+
+	for i := 0; i < 1000; i++ {
+		disabled.Wait()
+	}
+
+	if time.Since(start) > 100*time.Millisecond {
+		t.Errorf("a disabled limiter waited %s", time.Since(start))
+	}
+}
+
+func TestArtifactDigest(t *testing.T) {
+	content := []byte("archive contents")
+	sum := sha256.Sum256(content)
+	digest := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name    string
+		digest  string
+		wantErr bool
+	}{
+		{"matching digest", "sha256:" + digest, false},
+		{"uppercase digest", "SHA256:" + strings.ToUpper(digest), false},
+		{"mismatching digest", "sha256:" + strings.Repeat("0", 64), true},
+		{"no digest", "", false},
+		{"unsupported algorithm", "sha512:" + strings.Repeat("0", 128), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/artifacts") {
+					fmt.Fprintf(w, `{"total_count": 1, "artifacts": [{"id": 7, "name": "dist", "digest": %q, "archive_download_url": "http://%s/download"}]}`, tt.digest, r.Host)
+					return
+				}
+
+				w.Write(content)
+			}))
+			defer server.Close()
+
+			u := newTestUpdater(t, "-r", "owner/repo", "-t", "token", "-d", t.TempDir(), "-api-url", server.URL)
+			data, err := u.Artifacts()
+
+			if err != nil || len(data.Artifacts) != 1 || data.Artifacts[0].Digest != tt.digest {
+				t.Fatalf("Artifacts() = %+v, %v, want the digest %q", data, err, tt.digest)
+			}
+
+			fileName := filepath.Join(t.TempDir(), "archive.zip")
+			err = u.Download(data.Artifacts[0], fileName)
+
+			if !tt.wantErr {
+				if err != nil {
+					t.Errorf("Download() = %v, want nil", err)
+				}
+
+				return
+			}
+
+			var checksumErr *ChecksumError
+
+			if !errors.As(err, &checksumErr) || checksumErr.Actual != digest {
+				t.Errorf("Download() = %v, want a ChecksumError with the actual digest", err)
+			}
+
+			if _, statErr := os.Stat(fileName); !os.IsNotExist(statErr) {
+				t.Errorf("the mismatching archive was left behind: %v", statErr)
+			}
+		})
+	}
+}
+
+func TestCheckInodes(t *testing.T) {
+	tests := []struct {
+		name       string
+		freeInodes int64
+		entries    int
+		wantErr    bool
+	}{
+		{"enough inodes", 1000, 10, false},
+		{"exactly enough", 10, 10, false},
+		{"inode shortage", 9, 10, true},
+		{"no inodes left", 0, 1, true},
+		{"not reported", -1, 1000000, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := spaceProjection{Bytes: 1 << 30, FreeInodes: tt.freeInodes, Entries: tt.entries}.CheckInodes()
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CheckInodes() = %v, want error %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr && !strings.Contains(err.Error(), fmt.Sprintf("needs %d inodes, only %d are free", tt.entries, tt.freeInodes)) {
+				t.Errorf("CheckInodes() = %v, want the inode counts", err)
+			}
+		})
+	}
+
+	size, entries, err := zipExtractor{}.Size(writeTestZip(t, map[string]string{"a.txt": "aaa", "dir/b.txt": "bb"}))
+
+	if err != nil || size != 5 || entries != 2 {
+		t.Errorf("Size() = %d, %d, %v, want 5 bytes in 2 entries", size, entries, err)
+	}
+
+	if _, inodes, err := freeSpace(filepath.Join(t.TempDir(), "missing", "site")); err != nil || inodes < -1 {
+		t.Errorf("freeSpace() = %d inodes, %v", inodes, err)
+	}
+}
+
+func TestSpaceProjectionPrint(t *testing.T) {
+	tests := []struct {
+		name       string
+		freeInodes int64
+		wantInodes string
+	}{
+		{"inodes reported", 100, "Free inodes are 100, 90 after extracting 10 entries\n"},
+		{"inodes not reported", -1, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			projected := spaceProjection{Free: 3 << 20, Size: 1 << 20, Bytes: 2 << 20, FreeInodes: tt.freeInodes, Entries: 10}
+			projected.Print(&out)
+
+			if !strings.HasPrefix(out.String(), "Free space is ") || strings.Count(out.String(), "\n") != 1+strings.Count(tt.wantInodes, "\n") {
+				t.Errorf("Print() wrote %q", out.String())
+			}
+
+			if got := strings.Contains(out.String(), "inodes"); got != (tt.wantInodes != "") || !strings.HasSuffix(out.String(), tt.wantInodes) {
+				t.Errorf("Print() wrote %q, want the inode line %q", out.String(), tt.wantInodes)
+			}
+
+			if err := projected.CheckInodes(); err != nil {
+				t.Errorf("CheckInodes() = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestArtifactDirMapping(t *testing.T) {
+	archives := make(map[string][]byte)
+
+	for _, name := range []string{"frontend", "backend", "docs"} {
+		archive, err := os.ReadFile(writeTestZip(t, map[string]string{"index.html": name}))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		archives[name] = archive
+	}
+
+	tests := []struct {
+		name    string
+		strict  bool
+		wantErr string
+	}{
+		{"unmapped artifact skipped", false, ""},
+		{"unmapped artifact with -strict", true, "docs: no directory given with -artifact-dir"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			var server *httptest.Server
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/artifacts") {
+					listing := artifacts{Count: 3}
+
+					for i, name := range []string{"frontend", "backend", "docs"} {
+						listing.Artifacts = append(listing.Artifacts, artifact{ID: i + 1, Name: name, ArchiveDownloadURL: server.URL + "/download/" + name})
+					}
+
+					json.NewEncoder(w).Encode(listing)
+					return
+				}
+
+				w.Write(archives[path.Base(r.URL.Path)])
+			}))
+			defer server.Close()
+
+			root := t.TempDir()
+			frontend := filepath.Join(root, "www")
+			backend := filepath.Join(root, "api")
+			args := []string{"-r", "owner/repo", "-t", "token", "-api-url", server.URL, "-a", "frontend", "-a", "backend", "-a", "docs", "-artifact-dir", "frontend=" + frontend, "-artifact-dir", "backend=" + backend}
+
+			if tt.strict {
+				args = append(args, "-strict")
+			}
+
+			err := newTestUpdater(t, args...).Update()
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Update() = %v, want %q", err, tt.wantErr)
+				}
+
+				for _, dir := range []string{frontend, backend} {
+					if _, err := os.Stat(dir); !os.IsNotExist(err) {
+						t.Errorf("%s was deployed before failing: %v", dir, err)
+					}
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Update() error = %v", err)
+			}
+
+			for dir, files := range map[string]map[string]string{frontend: {"index.html": "frontend"}, backend: {"index.html": "backend"}} {
+				if got := readTestTree(t, dir); fmt.Sprint(got) != fmt.Sprint(files) {
+					t.Errorf("%s holds %v, want %v", dir, got, files)
+				}
+			}
+
+			entries, err := os.ReadDir(root)
+
+			if err != nil || len(entries) > 2 {
+				t.Errorf("%s holds %v, %v, want only the mapped directories", root, entries, err)
+			}
+		})
+	}
+}
+
+// readRecorder tells whether anything tried to read from r.
+type readRecorder struct {
+	r    io.Reader
+	read bool
+}
+
+func (r *readRecorder) Read(p []byte) (int, error) {
+	r.read = true
+
+	return r.r.Read(p)
+}
+
+func TestConfirmClear(t *testing.T) {
+	files := map[string]string{"index.html": "index", "js/app.js": "app", "config/local.json": "{}"}
+
+	tests := []struct {
+		name        string
+		args        []string
+		files       map[string]string
+		interactive bool
+		answer      string
+		wantErr     string
+		wantPrompt  bool
+	}{
+		{"without -confirm", nil, files, false, "", "", false},
+		{"confirmed", []string{"-confirm"}, files, true, "yes\n", "", true},
+		{"confirmed without newline", []string{"-confirm"}, files, true, " yes ", "", true},
+		{"declined", []string{"-confirm"}, files, true, "y\n", "not confirmed", true},
+		{"no answer", []string{"-confirm"}, files, true, "", "not confirmed", true},
+		{"no terminal", []string{"-confirm"}, files, false, "yes\n", "-confirm needs a terminal to ask before it deletes 3 files", false},
+		{"-yes without terminal", []string{"-confirm", "-yes"}, files, false, "", "", false},
+		{"-yes with terminal", []string{"-confirm", "-yes"}, files, true, "no\n", "", false},
+		{"kept files not counted", []string{"-confirm", "-keep", "config"}, files, false, "", "deletes 2 files", false},
+		{"nothing to delete", []string{"-confirm"}, nil, false, "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTestTree(t, dir, tt.files)
+			u := newTestUpdater(t, append([]string{"-r", "owner/repo", "-t", "token", "-d", dir}, tt.args...)...)
+			u.interactive = tt.interactive
+			stdin := &readRecorder{r: strings.NewReader(tt.answer)}
+			u.stdin = stdin
+			err := u.ConfirmClear()
+
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("ConfirmClear() = %v, want nil", err)
+			}
+
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("ConfirmClear() = %v, want %q", err, tt.wantErr)
+			}
+
+			// Only a prompt reads the answer, nothing blocks on it otherwise
+			if stdin.read != tt.wantPrompt {
+				t.Errorf("read an answer %v, want %v", stdin.read, tt.wantPrompt)
+			}
+		})
+	}
+}
+
+func TestCheckPathLengths(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the limits differ on Windows")
+	}
+
+	dest := t.TempDir()
+	longName := strings.Repeat("n", maxPathElementLength+1)
+	deepPath := strings.TrimSuffix(strings.Repeat(strings.Repeat("d", 200)+"/", maxPathLength/200+1), "/")
+
+	tests := []struct {
+		name        string
+		entries     []string
+		subpath     string
+		wantElement string
+		wantPath    bool
+	}{
+		{"short paths", []string{"index.html", "static/js/app.js"}, "", "", false},
+		{"longest name", []string{"dir/" + strings.Repeat("n", maxPathElementLength)}, "", "", false},
+		{"name over the limit", []string{"index.html", "dir/" + longName}, "", longName, false},
+		{"path over the limit", []string{"index.html", deepPath + "/file.txt"}, "", "", true},
+		{"outside -subpath", []string{"web/index.html", "other/" + longName}, "web", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkPathLengths(tt.entries, dest, extractOptions{Subpath: tt.subpath})
+
+			if tt.wantElement == "" && !tt.wantPath {
+				if err != nil {
+					t.Errorf("checkPathLengths() = %v, want nil", err)
+				}
+
+				return
+			}
+
+			var tooLong *PathTooLongError
+
+			if !errors.As(err, &tooLong) || tooLong.Name != tt.entries[1] || tooLong.Element != tt.wantElement || tooLong.Length <= tooLong.Limit {
+				t.Errorf("checkPathLengths() = %#v, want a PathTooLongError for %s", err, tt.entries[1])
+			}
+		})
+	}
+
+	archive := writeTestZip(t, map[string]string{"index.html": "index", "dir/" + longName: "long"})
+	_, err := updater{stats: &runStats{}}.Extract(archive, dest)
+
+	var tooLong *PathTooLongError
+
+	if !errors.As(err, &tooLong) || !isRejectedPath(err) {
+		t.Errorf("Extract() = %v, want a rejected path", err)
+	}
+
+	if got := readTestTree(t, dest); len(got) != 0 {
+		t.Errorf("Extract() wrote %v before rejecting the archive", got)
+	}
+
+	if longPath("dir/file.txt", true) != "dir/file.txt" {
+		t.Errorf("longPath() changed the path outside Windows")
+	}
+}